@@ -1,12 +1,19 @@
 package client
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"path"
+	"strings"
 
 	"github.com/experimental-platform/platform-utils/dockerutil"
 )
@@ -15,28 +22,112 @@ type skvsResponse struct {
 	Key       string `json:"key"`
 	Namespace bool   `json:"namespace"`
 	Value     string `json:"value"`
+	Error     string `json:"error"`
 }
 
 // Client is an object asociated with a server instance's access URL
 type Client struct {
-	url string
+	url        string
+	token      string
+	httpClient *http.Client
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithToken makes the client authenticate with a bearer token
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// WithTLS makes the client verify the server and present client
+// certificates according to config
+func WithTLS(config *tls.Config) Option {
+	return func(c *Client) {
+		c.transport().TLSClientConfig = config
+	}
+}
+
+// LoadTLSConfig returns a configuration trusting the PEM encoded CAs in
+// caFile and presenting the certificate in certFile, either may be empty
+func LoadTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + caFile)
+		}
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+func newClient(url string, opts []Option) *Client {
+	c := &Client{url: url, httpClient: http.DefaultClient}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// transport returns the transport of the client, replacing the shared
+// default one by a copy the client can change
+func (c *Client) transport() *http.Transport {
+	if c.httpClient == http.DefaultClient {
+		c.httpClient = &http.Client{Transport: http.DefaultTransport.(*http.Transport).Clone()}
+	}
+	return c.httpClient.Transport.(*http.Transport)
 }
 
 // NewFromDocker returns a client attached to an SKVS instance running on
 // a local machine in a container named 'skvs'
-func NewFromDocker() (*Client, error) {
+func NewFromDocker(opts ...Option) (*Client, error) {
 	ip, err := dockerutil.GetContainerIP("skvs")
 	if err != nil {
 		return nil, err
 	}
 
-	return &Client{url: fmt.Sprintf("http://%s", ip)}, nil
+	return newClient(fmt.Sprintf("http://%s", ip), opts), nil
 }
 
 // NewFromURL returns a client attached to an SKVS instance reachable
 // through a specified URL
-func NewFromURL(url string) *Client {
-	return &Client{url: url}
+func NewFromURL(url string, opts ...Option) *Client {
+	return newClient(url, opts)
+}
+
+// NewFromSocket returns a client attached to an SKVS instance listening on
+// the unix socket at socketPath
+func NewFromSocket(socketPath string, opts ...Option) *Client {
+	c := newClient("http://skvs", nil)
+	c.transport().DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "unix", socketPath)
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// do sends req with the client's credentials
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return c.httpClient.Do(req)
 }
 
 func buildFullURL(baseURL, key string) (string, error) {
@@ -49,6 +140,54 @@ func buildFullURL(baseURL, key string) (string, error) {
 	return u.String(), nil
 }
 
+// request sends a request to path, vals are sent as form for POST and PUT
+// and in the query otherwise. It decodes the JSON response into result and
+// returns the status code.
+func (c *Client) request(method, path string, vals url.Values, result interface{}) (int, error) {
+	requestURL, err := buildFullURL(c.url, path)
+	if err != nil {
+		return 0, err
+	}
+
+	var body io.Reader
+	if method == "POST" || method == "PUT" {
+		body = strings.NewReader(vals.Encode())
+	} else if len(vals) > 0 {
+		requestURL += "?" + vals.Encode()
+	}
+
+	req, err := http.NewRequest(method, requestURL, body)
+	if err != nil {
+		return 0, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	responseBodyData, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if result != nil {
+		json.Unmarshal(responseBodyData, result)
+	}
+	return resp.StatusCode, nil
+}
+
+// responseError describes an unexpected response
+func responseError(status int, message string) error {
+	if message != "" {
+		return fmt.Errorf("SKVS responded with %d %s: %s", status, http.StatusText(status), message)
+	}
+	return fmt.Errorf("SKVS responded with %d %s", status, http.StatusText(status))
+}
+
 // Get retrieves a value of an SKVS key
 // It does not propely handle namespaces
 func (c *Client) Get(key string) (string, error) {
@@ -57,7 +196,12 @@ func (c *Client) Get(key string) (string, error) {
 		return "", err
 	}
 
-	resp, err := http.Get(requestURL)
+	req, err := http.NewRequest("GET", requestURL, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := c.do(req)
 	if err != nil {
 		return "", err
 	}
@@ -82,6 +226,20 @@ func (c *Client) Get(key string) (string, error) {
 	return responseStruct.Value, nil
 }
 
+// Reveal retrieves the value of an SKVS key marked secret, which Get only
+// returns redacted
+func (c *Client) Reveal(key string) (string, error) {
+	var data skvsResponse
+	status, err := c.request("GET", key, url.Values{"reveal": {"true"}}, &data)
+	if err != nil {
+		return "", err
+	}
+	if status != http.StatusOK {
+		return "", responseError(status, data.Error)
+	}
+	return data.Value, nil
+}
+
 // Set sets a value of a given SKVS key
 func (c *Client) Set(key string, value string) error {
 	requestURL, err := buildFullURL(c.url, key)
@@ -91,7 +249,13 @@ func (c *Client) Set(key string, value string) error {
 
 	vals := url.Values{}
 	vals.Set("value", value)
-	resp, err := http.PostForm(requestURL, vals)
+	req, err := http.NewRequest("POST", requestURL, strings.NewReader(vals.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := c.do(req)
 	if err != nil {
 		return err
 	}
@@ -116,7 +280,7 @@ func (c *Client) Delete(key string) error {
 		return err
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return err
 	}
@@ -128,3 +292,29 @@ func (c *Client) Delete(key string) error {
 
 	return nil
 }
+
+// ReadOnly reports whether the server currently rejects changes
+func (c *Client) ReadOnly() (bool, error) {
+	requestURL, err := buildFullURL(c.url, "_/admin/read-only")
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequest("GET", requestURL, nil)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch mode := resp.Header.Get("X-SKVS-Mode"); mode {
+	case "read-only":
+		return true, nil
+	case "read-write":
+		return false, nil
+	}
+	return false, responseError(resp.StatusCode, "no mode reported")
+}
@@ -1,9 +1,13 @@
 package client
 
 import (
+	"crypto/tls"
+	"encoding/pem"
 	"io/ioutil"
+	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/experimental-platform/platform-skvs/server"
@@ -70,3 +74,112 @@ func TestSetDelete(t *testing.T) {
 	_, err = c.Get("foobar")
 	assert.NotNil(t, err)
 }
+
+func TestToken(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpdir)
+	tokenFile := filepath.Join(tmpdir, "tokens")
+	assert.Nil(t, ioutil.WriteFile(tokenFile, []byte("alice:"+server.HashToken("secret")+"\n"), 0600))
+	tokens, err := server.LoadTokenStore(tokenFile)
+	assert.Nil(t, err)
+
+	s := server.NewServer(filepath.Join(tmpdir, "data"), nil, nil)
+	s.RequireTokens(tokens)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	assert.NotNil(t, NewFromURL(srv.URL).Set("foo", "bar"))
+	assert.NotNil(t, NewFromURL(srv.URL, WithToken("wrong")).Set("foo", "bar"))
+
+	c := NewFromURL(srv.URL, WithToken("secret"))
+	assert.Nil(t, c.Set("foo", "bar"))
+	value, err := c.Get("foo")
+	assert.Nil(t, err)
+	assert.Equal(t, "bar", value)
+	assert.Nil(t, c.Delete("foo"))
+}
+
+func TestTLS(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpdir)
+	srv := httptest.NewTLSServer(server.NewServerHandler(filepath.Join(tmpdir, "data"), nil, nil))
+	defer srv.Close()
+
+	assert.NotNil(t, NewFromURL(srv.URL).Set("foo", "bar"))
+
+	caFile := filepath.Join(tmpdir, "ca.crt")
+	assert.Nil(t, ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600))
+	config, err := LoadTLSConfig(caFile, "", "")
+	assert.Nil(t, err)
+	c := NewFromURL(srv.URL, WithTLS(config))
+	assert.Nil(t, c.Set("foo", "bar"))
+	value, err := c.Get("foo")
+	assert.Nil(t, err)
+	assert.Equal(t, "bar", value)
+
+	_, err = LoadTLSConfig(filepath.Join(tmpdir, "missing.crt"), "", "")
+	assert.NotNil(t, err)
+}
+
+func TestSocket(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpdir)
+	listener, err := server.ListenUnix(filepath.Join(tmpdir, "skvs.sock"), 0600)
+	assert.Nil(t, err)
+	defer listener.Close()
+	go http.Serve(listener, server.NewServer(filepath.Join(tmpdir, "data"), nil, nil))
+
+	c := NewFromSocket(filepath.Join(tmpdir, "skvs.sock"))
+	assert.Nil(t, c.Set("foo", "bar"))
+	value, err := c.Get("foo")
+	assert.Nil(t, err)
+	assert.Equal(t, "bar", value)
+
+	// options keep the client on the socket
+	c = NewFromSocket(filepath.Join(tmpdir, "skvs.sock"), WithTLS(&tls.Config{}))
+	value, err = c.Get("foo")
+	assert.Nil(t, err)
+	assert.Equal(t, "bar", value)
+}
+
+func TestReadOnly(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpdir)
+	s := server.NewServer(tmpdir, nil, nil)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	c := NewFromURL(srv.URL)
+
+	readOnly, err := c.ReadOnly()
+	assert.Nil(t, err)
+	assert.False(t, readOnly)
+
+	s.SetReadOnly(true)
+	readOnly, err = c.ReadOnly()
+	assert.Nil(t, err)
+	assert.True(t, readOnly)
+	assert.NotNil(t, c.Set("foo", "bar"))
+}
+
+func TestReveal(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpdir)
+	s := server.NewServer(tmpdir, nil, nil)
+	assert.Nil(t, s.MarkSecret("secrets"))
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	c := NewFromURL(srv.URL)
+
+	assert.Nil(t, c.Set("secrets/a", "hunter2"))
+	value, err := c.Get("secrets/a")
+	assert.Nil(t, err)
+	assert.Equal(t, "", value)
+	value, err = c.Reveal("secrets/a")
+	assert.Nil(t, err)
+	assert.Equal(t, "hunter2", value)
+}
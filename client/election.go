@@ -0,0 +1,266 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// ErrNotLeader is returned when resigning from an election not won
+var ErrNotLeader = errors.New("not the leader")
+
+// Election elects a single leader among all candidates campaigning on the
+// same key. The leader's ID is stored at the key with a TTL and renewed by
+// compare-and-swap, so if the leader goes away the key expires and another
+// candidate takes over.
+type Election struct {
+	client *Client
+	key    string
+	id     string
+	ttl    time.Duration
+
+	mutex sync.Mutex
+	stop  chan struct{}
+	lost  chan error
+}
+
+// NewElection returns a candidate with the given ID for the election on key
+func (c *Client) NewElection(key, id string, ttl time.Duration) *Election {
+	return &Election{client: c, key: key, id: id, ttl: ttl}
+}
+
+// ID returns the ID of this candidate
+func (e *Election) ID() string {
+	return e.id
+}
+
+// Campaign blocks until this candidate is the leader or ctx is done
+func (e *Election) Campaign(ctx context.Context) error {
+	for {
+		won, err := e.tryAcquire()
+		if err != nil {
+			return err
+		}
+		if won {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(e.ttl / 4):
+		}
+	}
+}
+
+// tryAcquire creates the key if there is no leader, or renews it if this
+// candidate already is the leader
+func (e *Election) tryAcquire() (bool, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	vals := url.Values{}
+	vals.Set("prevExist", "false")
+	won, err := e.write(vals)
+	if err != nil || !won {
+		// maybe a previous incarnation of this candidate still leads
+		won, err = e.write(url.Values{"prevValue": {e.id}})
+	}
+	if err != nil || !won {
+		return false, err
+	}
+
+	if e.stop == nil {
+		e.stop = make(chan struct{})
+		e.lost = make(chan error, 1)
+		go e.renew(e.stop, e.lost)
+	}
+	return true, nil
+}
+
+// Lost returns a channel receiving an error if the leadership is lost:
+// ErrNotLeader if another candidate took over, or the error of the renewal
+// if it could not be renewed within the TTL. Every term gets a new
+// channel, before the first one it is nil.
+func (e *Election) Lost() <-chan error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.lost
+}
+
+// write stores the candidate's ID with a fresh TTL under the given
+// preconditions and reports whether they held
+func (e *Election) write(vals url.Values) (bool, error) {
+	vals.Set("value", e.id)
+	vals.Set("ttl", formatSeconds(e.ttl))
+	var responseStruct skvsResponse
+	status, err := e.client.request("PUT", e.key, vals, &responseStruct)
+	if err != nil {
+		return false, err
+	}
+	switch status {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusPreconditionFailed:
+		return false, nil
+	}
+	return false, responseError(status, responseStruct.Error)
+}
+
+// renew extends the leadership every third of the TTL until stop is closed
+// or the leadership is lost, which is reported on lost
+func (e *Election) renew(stop chan struct{}, lost chan error) {
+	ticker := time.NewTicker(e.ttl / 3)
+	defer ticker.Stop()
+	renewed := time.Now()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			won, err := e.write(url.Values{"prevValue": {e.id}})
+			if err == nil && won {
+				renewed = time.Now()
+				continue
+			}
+			if err != nil && time.Since(renewed) < e.ttl {
+				// the key has not expired yet, try again
+				continue
+			}
+			if err == nil {
+				err = ErrNotLeader
+			}
+
+			e.mutex.Lock()
+			if e.stop == stop {
+				close(e.stop)
+				e.stop = nil
+				lost <- err
+			}
+			e.mutex.Unlock()
+			return
+		}
+	}
+}
+
+// IsLeader reports whether this candidate currently believes to lead
+func (e *Election) IsLeader() bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.stop != nil
+}
+
+// Resign gives up the leadership
+func (e *Election) Resign() error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.stop == nil {
+		return ErrNotLeader
+	}
+	close(e.stop)
+	e.stop = nil
+
+	var responseStruct skvsResponse
+	status, err := e.client.request("DELETE", e.key, url.Values{"prevValue": {e.id}}, &responseStruct)
+	if err != nil {
+		return err
+	}
+	switch status {
+	case http.StatusOK:
+		return nil
+	case http.StatusPreconditionFailed:
+		return ErrNotLeader
+	}
+	return responseError(status, responseStruct.Error)
+}
+
+// Leader returns the ID of the current leader, or an empty string if there
+// is none
+func (e *Election) Leader() (string, error) {
+	var responseStruct skvsResponse
+	status, err := e.client.request("GET", e.key, nil, &responseStruct)
+	if err != nil {
+		return "", err
+	}
+	switch status {
+	case http.StatusOK:
+		return responseStruct.Value, nil
+	case http.StatusNotFound:
+		return "", nil
+	}
+	return "", responseError(status, responseStruct.Error)
+}
+
+// Observe returns a channel receiving the ID of the leader whenever it
+// changes, starting with the current one. An empty ID means there is no
+// leader. The channel is closed once ctx is done.
+func (e *Election) Observe(ctx context.Context) <-chan string {
+	leaders := make(chan string)
+	go func() {
+		defer close(leaders)
+		var last *string
+		emit := func() bool {
+			leader, err := e.Leader()
+			if err != nil || (last != nil && *last == leader) {
+				return true
+			}
+			last = &leader
+			select {
+			case leaders <- leader:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		for ctx.Err() == nil {
+			// subscribe before reading, so no change goes unnoticed
+			resp, err := e.client.events(ctx, e.key)
+			if !emit() {
+				return
+			}
+			if err == nil {
+				scanner := bufio.NewScanner(resp.Body)
+				for scanner.Scan() {
+					if !emit() {
+						resp.Body.Close()
+						return
+					}
+				}
+				resp.Body.Close()
+			}
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(e.ttl / 4):
+			}
+		}
+	}()
+	return leaders
+}
+
+// events opens the stream of changes below prefix
+func (c *Client) events(ctx context.Context, prefix string) (*http.Response, error) {
+	requestURL, err := buildFullURL(c.url, "_/events")
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", requestURL+"?"+url.Values{"prefix": {prefix}}.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, responseError(resp.StatusCode, "")
+	}
+	return resp, nil
+}
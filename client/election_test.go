@@ -0,0 +1,137 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/experimental-platform/platform-skvs/server"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestServer(t *testing.T) (*httptest.Server, func()) {
+	tmpdir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	srv := httptest.NewServer(server.NewServerHandler(tmpdir, nil, nil))
+	return srv, func() {
+		srv.Close()
+		os.RemoveAll(tmpdir)
+	}
+}
+
+func TestElectionSingleLeader(t *testing.T) {
+	srv, cleanup := newTestServer(t)
+	defer cleanup()
+	c := NewFromURL(srv.URL)
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	leaders := 0
+	terms := 0
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			e := c.NewElection("service/leader", fmt.Sprintf("candidate%d", i), time.Second)
+			for j := 0; j < 3; j++ {
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				err := e.Campaign(ctx)
+				cancel()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				mutex.Lock()
+				leaders++
+				terms++
+				if leaders != 1 {
+					t.Errorf("%d leaders at once", leaders)
+				}
+				mutex.Unlock()
+
+				leader, err := e.Leader()
+				assert.Nil(t, err)
+				assert.Equal(t, e.ID(), leader)
+				time.Sleep(20 * time.Millisecond)
+
+				mutex.Lock()
+				leaders--
+				mutex.Unlock()
+				assert.Nil(t, e.Resign())
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, 12, terms)
+}
+
+func TestElectionFailover(t *testing.T) {
+	srv, cleanup := newTestServer(t)
+	defer cleanup()
+	c := NewFromURL(srv.URL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	a := c.NewElection("service/leader", "a", 300*time.Millisecond)
+	b := c.NewElection("service/leader", "b", 300*time.Millisecond)
+	observed := a.Observe(ctx)
+	assert.Equal(t, "", <-observed)
+
+	assert.Nil(t, a.Campaign(ctx))
+	assert.True(t, a.IsLeader())
+	assert.Equal(t, "a", <-observed)
+
+	// a keeps leading beyond its TTL while it renews
+	shortCtx, shortCancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	assert.Equal(t, context.DeadlineExceeded, b.Campaign(shortCtx))
+	shortCancel()
+
+	// a crashes without resigning
+	a.mutex.Lock()
+	close(a.stop)
+	a.stop = nil
+	a.mutex.Unlock()
+
+	assert.Nil(t, b.Campaign(ctx))
+	assert.True(t, b.IsLeader())
+	for leader := range observed {
+		if leader == "b" {
+			break
+		}
+	}
+	assert.Equal(t, ErrNotLeader, a.Resign())
+	assert.Nil(t, b.Resign())
+}
+
+func TestElectionLost(t *testing.T) {
+	srv, cleanup := newTestServer(t)
+	defer cleanup()
+	c := NewFromURL(srv.URL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	a := c.NewElection("service/leader", "a", 300*time.Millisecond)
+	assert.Nil(t, a.Campaign(ctx))
+
+	// another candidate overwrites the key
+	status, err := c.request("PUT", "service/leader", url.Values{"value": {"b"}}, &skvsResponse{})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, status)
+
+	select {
+	case err := <-a.Lost():
+		assert.Equal(t, ErrNotLeader, err)
+	case <-time.After(5 * time.Second):
+		t.Error("Losing the leadership was not reported.")
+	}
+	assert.False(t, a.IsLeader())
+}
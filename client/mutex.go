@@ -0,0 +1,179 @@
+package client
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrLockHeld is returned when a lock could not be acquired because
+// somebody else holds it
+var ErrLockHeld = errors.New("lock is held by another owner")
+
+// ErrNotLocked is returned when unlocking a Mutex that is not held
+var ErrNotLocked = errors.New("mutex is not locked")
+
+// ErrLockLost is returned when the server no longer knows a lock, e.g.
+// after it restarted, so another owner may already hold it
+var ErrLockLost = errors.New("lock is no longer held")
+
+type lockResponse struct {
+	Error string `json:"error"`
+}
+
+// Mutex is a lock shared by all clients of an SKVS instance. While it is
+// held it is renewed in the background, if the process dies the lock is
+// released once its TTL has passed.
+type Mutex struct {
+	client *Client
+	name   string
+	owner  string
+	ttl    time.Duration
+
+	mutex sync.Mutex
+	stop  chan struct{}
+	lost  chan error
+}
+
+// NewMutex returns a Mutex for the lock name with the given TTL and an
+// owner ID unique to this Mutex
+func (c *Client) NewMutex(name string, ttl time.Duration) *Mutex {
+	return &Mutex{client: c, name: name, owner: newOwnerID(), ttl: ttl}
+}
+
+// newOwnerID returns the host name followed by a random suffix
+func newOwnerID() string {
+	host, _ := os.Hostname()
+	suffix := make([]byte, 8)
+	rand.Read(suffix)
+	return fmt.Sprintf("%s-%s", host, hex.EncodeToString(suffix))
+}
+
+// Owner returns the ID the lock is held under
+func (m *Mutex) Owner() string {
+	return m.owner
+}
+
+// Lock acquires the lock, waiting up to timeout for it to become available
+func (m *Mutex) Lock(timeout time.Duration) error {
+	return m.acquire(timeout)
+}
+
+// TryLock acquires the lock if it is available and reports whether it did
+func (m *Mutex) TryLock() (bool, error) {
+	err := m.acquire(0)
+	if err == ErrLockHeld {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (m *Mutex) acquire(wait time.Duration) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	vals := url.Values{}
+	vals.Set("ttl", formatSeconds(m.ttl))
+	vals.Set("wait", formatSeconds(wait))
+	if _, err := m.request("POST", vals); err != nil {
+		return err
+	}
+
+	if m.stop == nil {
+		m.stop = make(chan struct{})
+		m.lost = make(chan error, 1)
+		go m.renew(m.stop, m.lost)
+	}
+	return nil
+}
+
+// Lost returns a channel receiving an error if the lock is lost while held:
+// ErrLockHeld if another owner took it over, ErrLockLost if the server no
+// longer knows it, or the error of the renewal if it could not be renewed
+// within its TTL. Every acquisition gets a new
+// channel, before the first one it is nil.
+func (m *Mutex) Lost() <-chan error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.lost
+}
+
+// Unlock releases the lock
+func (m *Mutex) Unlock() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.stop == nil {
+		return ErrNotLocked
+	}
+	close(m.stop)
+	m.stop = nil
+	_, err := m.request("DELETE", url.Values{})
+	return err
+}
+
+// renew extends the lock every third of its TTL until stop is closed or
+// the lock is lost, which is reported on lost. Only failed connections and
+// server errors are retried, any other answer means the lock is lost.
+func (m *Mutex) renew(stop chan struct{}, lost chan error) {
+	ticker := time.NewTicker(m.ttl / 3)
+	defer ticker.Stop()
+	renewed := time.Now()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			vals := url.Values{}
+			vals.Set("ttl", formatSeconds(m.ttl))
+			status, err := m.request("PUT", vals)
+			if err == nil {
+				renewed = time.Now()
+				continue
+			}
+			if (status < http.StatusBadRequest || status >= http.StatusInternalServerError) && time.Since(renewed) < m.ttl {
+				// the lock is still ours, try again
+				continue
+			}
+
+			m.mutex.Lock()
+			if m.stop == stop {
+				m.stop = nil
+				lost <- err
+			}
+			m.mutex.Unlock()
+			return
+		}
+	}
+}
+
+// request sends a lock request and returns the status, 0 if there was no
+// answer
+func (m *Mutex) request(method string, vals url.Values) (int, error) {
+	vals.Set("owner", m.owner)
+	var responseStruct lockResponse
+	status, err := m.client.request(method, "_/locks/"+m.name, vals, &responseStruct)
+	if err != nil {
+		return status, err
+	}
+
+	switch status {
+	case http.StatusOK:
+		return status, nil
+	case http.StatusConflict:
+		return status, ErrLockHeld
+	case http.StatusNotFound:
+		return status, ErrLockLost
+	}
+	return status, responseError(status, responseStruct.Error)
+}
+
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+}
@@ -0,0 +1,148 @@
+package client
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/experimental-platform/platform-skvs/server"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMutexExcludes(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpdir)
+	srv := httptest.NewServer(server.NewServerHandler(tmpdir, nil, nil))
+	defer srv.Close()
+	c := NewFromURL(srv.URL)
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	holders := 0
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m := c.NewMutex("migration", time.Second)
+			for j := 0; j < 5; j++ {
+				if err := m.Lock(5 * time.Second); err != nil {
+					t.Error(err)
+					return
+				}
+				mutex.Lock()
+				holders++
+				if holders != 1 {
+					t.Errorf("%d holders at once", holders)
+				}
+				mutex.Unlock()
+
+				time.Sleep(5 * time.Millisecond)
+
+				mutex.Lock()
+				holders--
+				mutex.Unlock()
+				if err := m.Unlock(); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestMutexTryLockAndRenewal(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpdir)
+	srv := httptest.NewServer(server.NewServerHandler(tmpdir, nil, nil))
+	defer srv.Close()
+	c := NewFromURL(srv.URL)
+
+	a := c.NewMutex("migration", 300*time.Millisecond)
+	b := c.NewMutex("migration", 300*time.Millisecond)
+
+	ok, err := a.TryLock()
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	// the lock outlives its TTL because it is renewed
+	time.Sleep(500 * time.Millisecond)
+	ok, err = b.TryLock()
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	assert.Nil(t, a.Unlock())
+	assert.Equal(t, ErrNotLocked, a.Unlock())
+	ok, err = b.TryLock()
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Nil(t, b.Unlock())
+}
+
+func TestMutexLost(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpdir)
+	srv := httptest.NewServer(server.NewServerHandler(tmpdir, nil, nil))
+	defer srv.Close()
+	c := NewFromURL(srv.URL)
+
+	a := c.NewMutex("migration", 300*time.Millisecond)
+	b := c.NewMutex("migration", 300*time.Millisecond)
+	assert.Nil(t, a.Lock(time.Second))
+
+	// the lock is released behind a's back and taken by b
+	status, err := c.request("DELETE", "_/locks/migration", url.Values{"owner": {a.Owner()}}, &lockResponse{})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	ok, err := b.TryLock()
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	select {
+	case err := <-a.Lost():
+		assert.Equal(t, ErrLockHeld, err)
+	case <-time.After(5 * time.Second):
+		t.Error("Losing the lock was not reported.")
+	}
+	assert.Equal(t, ErrNotLocked, a.Unlock())
+	assert.Nil(t, b.Unlock())
+}
+
+func TestMutexLostOnServerRestart(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpdir)
+	var mutex sync.Mutex
+	handler := server.NewServerHandler(tmpdir, nil, nil)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		current := handler
+		mutex.Unlock()
+		current(w, r)
+	}))
+	defer srv.Close()
+	c := NewFromURL(srv.URL)
+
+	a := c.NewMutex("migration", 3*time.Second)
+	assert.Nil(t, a.Lock(time.Second))
+
+	// the restarted server forgot the lock, so another owner could take it
+	// right away
+	mutex.Lock()
+	handler = server.NewServerHandler(tmpdir, nil, nil)
+	mutex.Unlock()
+	select {
+	case err := <-a.Lost():
+		assert.Equal(t, ErrLockLost, err)
+	case <-time.After(2 * time.Second):
+		t.Error("Losing the lock was not reported before its TTL passed.")
+	}
+}
@@ -1,10 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/experimental-platform/platform-skvs/server"
 	"github.com/jessevdk/go-flags"
@@ -15,28 +23,272 @@ var opts struct {
 	Port        int      `short:"p" long:"port" default:"8080" description:"Port where server is listening for requests."`
 	WebHookUrls []string `short:"w" long:"webhook-url" description:"WebHook-Urls."`
 	CacheExempt []string `short:"e" long:"exempt-from-cache" description:"Paths which shall not use cache."`
+	TokenFile   string   `long:"token-file" description:"File or directory with 'principal:sha256-of-token' lines, requires a bearer token for all requests. Reloaded on SIGHUP."`
+	ACLFile     string   `long:"acl-file" description:"JSON file with rules granting principals permissions on key prefixes. Reloaded on SIGHUP."`
+	TLSCert     string   `long:"tls-cert" description:"PEM certificate to serve HTTPS with, requires --tls-key. Reloaded on SIGHUP."`
+	TLSKey      string   `long:"tls-key" description:"PEM private key of --tls-cert."`
+	ClientCA    string   `long:"client-ca" description:"PEM CA certificates verifying client certificates, whose subject becomes the principal. Without --token-file a client certificate is required."`
+	Socket      string   `long:"socket" description:"Unix socket to listen on in addition to the port, peers are authorized as 'uid:<uid>' and 'gid:<gid>'. Use --port 0 to only listen on the socket."`
+	SocketMode  string   `long:"socket-mode" default:"0660" description:"Permissions of --socket."`
+	ReadOnly    bool     `long:"read-only" description:"Reject all changes, switchable at runtime through /_/admin/read-only."`
+	Follow      string   `long:"follow" description:"URL of a primary to replicate, changes are redirected to it."`
+	FollowToken string   `long:"follow-token" description:"Bearer token to authenticate at the primary with."`
+	RejectWrite bool     `long:"follow-reject-writes" description:"Answer changes with 503 instead of redirecting them to the primary."`
+	ClusterID   string   `long:"cluster-id" description:"URL the other cluster members reach this server at, enables the Raft cluster mode."`
+	ClusterPeer []string `long:"cluster-peer" description:"URL of an initial cluster member including this one, only used on the first start."`
+	ClusterTok  string   `long:"cluster-token" description:"Bearer token to authenticate at the other cluster members with."`
+	Linearize   bool     `long:"linearizable-reads" description:"Serve all reads through the cluster leader, not only those with 'consistent=true'."`
+	SyncRemote  string   `long:"sync-remote" description:"URL of a server to sync keys with in both directions."`
+	SyncPrefix  []string `long:"sync-prefix" description:"Prefix of the keys to sync, all keys if not given."`
+	SyncToken   string   `long:"sync-token" description:"Bearer token to authenticate at --sync-remote with."`
+	SyncPolicy  string   `long:"sync-policy" default:"newest" description:"Which value wins if a key differs on both sides: 'newest', 'local' or 'remote'."`
+	SyncEvery   int      `long:"sync-interval" default:"60" description:"Seconds between syncs, 0 to only sync on POST /_/sync/run."`
+	SyncKey     string   `long:"sync-key-file" description:"File with the key sync digests are hashed with, the same on both sides of a sync."`
+	BackupDir   string   `long:"backup-dir" description:"Directory to write snapshots to every --backup-interval."`
+	BackupEvery int      `long:"backup-interval" default:"3600" description:"Seconds between snapshots written to --backup-dir."`
+	BackupKeep  int      `long:"backup-keep" default:"24" description:"Number of snapshots kept in --backup-dir."`
+	KeyFile     string   `long:"encryption-key-file" description:"File with 'id:base64-key' lines, the last key encrypts the values below --encrypt-prefix. Reloaded on SIGHUP."`
+	Encrypt     []string `long:"encrypt-prefix" description:"Prefix of the keys whose values are encrypted at rest."`
+	CachePlain  bool     `long:"cache-plaintext" description:"Allow the cache to keep decrypted values."`
+	Secret      []string `long:"secret-prefix" description:"Prefix of keys whose values are only returned with 'reveal=true'."`
+	AuditLog    string   `long:"audit-log" description:"JSON Lines file every change of a key is appended to."`
+	AuditSize   int64    `long:"audit-max-size" default:"10485760" description:"Bytes after which --audit-log is rotated."`
+	AuditFiles  int      `long:"audit-max-files" default:"5" description:"Number of rotated audit log files kept."`
+	MinFree     uint64   `long:"ready-min-free-bytes" default:"104857600" description:"Free disk space below which /_/ready fails."`
+	MaxLag      uint64   `long:"ready-max-lag" default:"100" description:"Mutations a follower or cluster member may be behind and still pass /_/ready."`
+	StopTimeout int      `long:"shutdown-timeout" default:"8" description:"Seconds to finish requests and web hooks in flight after SIGTERM or SIGINT."`
+	LogLevel    string   `long:"log-level" default:"info" description:"Least severe messages logged: debug, info, warn or error."`
+	LogFormat   string   `long:"log-format" default:"text" description:"Format of the log: text or json."`
+	Restore     string   `long:"restore" description:"Verify the snapshot archive, replace --data-path with it and exit. The server must not be running."`
+}
+
+var log *server.Logger
+
+// fail logs a failed start and exits
+func fail(message string, err error) {
+	log.Error(message, server.Fields{"error": err})
+	os.Exit(1)
 }
 
 func main() {
 	flags.Parse(&opts)
+	level, err := server.ParseLevel(opts.LogLevel)
+	if err == nil {
+		log, err = server.NewLogger(os.Stdout, level, opts.LogFormat)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	server.SetLogger(log)
+
 	opts.DataPath, _ = filepath.Abs(opts.DataPath)
-	fmt.Println("DATA_PATH:", opts.DataPath)
-	fmt.Println("PORT:", opts.Port)
+	log.Info("Data path", server.Fields{"path": opts.DataPath})
+	if opts.Restore != "" {
+		if err := server.RestoreSnapshot(opts.Restore, opts.DataPath); err != nil {
+			fail("Restoring failed", err)
+		}
+		log.Info("Restored", server.Fields{"snapshot": opts.Restore})
+		return
+	}
 	for i, hookUrl := range opts.WebHookUrls {
 		if len(hookUrl) >= 4 && hookUrl[:4] != "http" {
 			opts.WebHookUrls[i] = "http://" + hookUrl
 		}
 	}
+	log.Info("Configuration", server.Fields{"port": opts.Port, "exemptFromCache": opts.CacheExempt, "hooks": opts.WebHookUrls})
+
+	if _, err := server.WatchDataPath(opts.DataPath, opts.WebHookUrls); err != nil {
+		log.Warn("Not watching data path", server.Fields{"error": err})
+	}
+
+	s := server.NewServer(opts.DataPath, opts.CacheExempt, opts.WebHookUrls)
+	reloaders := map[string]func() error{}
+	s.ConfigureReadiness(server.ReadinessConfig{MinFreeBytes: opts.MinFree, MaxReplicationLag: opts.MaxLag})
+	for _, prefix := range opts.Secret {
+		if err := s.MarkSecret(prefix); err != nil {
+			fail("Marking secret failed", err)
+		}
+	}
+	if opts.KeyFile != "" {
+		encryption, err := s.EncryptAtRest(server.EncryptionConfig{KeyFile: opts.KeyFile, Prefixes: opts.Encrypt, CachePlaintext: opts.CachePlain})
+		if err != nil {
+			fail("Loading encryption keys failed", err)
+		}
+		log.Info("Encrypted", server.Fields{"prefixes": opts.Encrypt})
+		reloaders["ENCRYPTION KEYS"] = encryption.Reload
+	}
+	if opts.AuditLog != "" {
+		_, err := s.EnableAudit(server.AuditConfig{Path: opts.AuditLog, MaxSize: opts.AuditSize, MaxFiles: opts.AuditFiles})
+		if err != nil {
+			fail("Opening audit log failed", err)
+		}
+		log.Info("Audit log", server.Fields{"path": opts.AuditLog})
+	}
+	if opts.ReadOnly {
+		s.SetReadOnly(true)
+		log.Info("Read-only")
+	}
+	if opts.Follow != "" {
+		s.Follow(server.FollowerConfig{Primary: opts.Follow, Token: opts.FollowToken, RejectWrites: opts.RejectWrite})
+		log.Info("Following", server.Fields{"primary": opts.Follow})
+	}
+	if opts.ClusterID != "" {
+		if opts.Follow != "" {
+			fail("Starting failed", errors.New("--follow and --cluster-id cannot be combined"))
+		}
+		_, err := s.JoinCluster(server.ClusterConfig{
+			ID:                opts.ClusterID,
+			Peers:             opts.ClusterPeer,
+			Token:             opts.ClusterTok,
+			LinearizableReads: opts.Linearize,
+		})
+		if err != nil {
+			fail("Joining cluster failed", err)
+		}
+		log.Info("Cluster", server.Fields{"id": opts.ClusterID})
+	}
+	if opts.SyncKey != "" {
+		key, err := ioutil.ReadFile(opts.SyncKey)
+		if err != nil {
+			fail("Loading sync key failed", err)
+		}
+		s.SetSyncKey(bytes.TrimSpace(key))
+	}
+	if opts.SyncRemote != "" {
+		_, err := s.StartSync(server.SyncConfig{
+			Remote:   opts.SyncRemote,
+			Token:    opts.SyncToken,
+			Prefixes: opts.SyncPrefix,
+			Policy:   opts.SyncPolicy,
+			Interval: time.Duration(opts.SyncEvery) * time.Second,
+		})
+		if err != nil {
+			fail("Starting sync failed", err)
+		}
+		log.Info("Sync", server.Fields{"remote": opts.SyncRemote})
+	}
+	if opts.BackupDir != "" {
+		_, err := s.ScheduleBackups(server.BackupConfig{
+			Dir:      opts.BackupDir,
+			Interval: time.Duration(opts.BackupEvery) * time.Second,
+			Keep:     opts.BackupKeep,
+		})
+		if err != nil {
+			fail("Scheduling backups failed", err)
+		}
+		log.Info("Backups", server.Fields{"dir": opts.BackupDir})
+	}
+	if opts.TokenFile != "" {
+		tokens, err := server.LoadTokenStore(opts.TokenFile)
+		if err != nil {
+			fail("Loading tokens failed", err)
+		}
+		s.RequireTokens(tokens)
+		log.Info("Tokens", server.Fields{"file": opts.TokenFile})
+		reloaders["TOKENS"] = tokens.Reload
+	}
+	if opts.ACLFile != "" {
+		acl, err := server.LoadACL(opts.ACLFile)
+		if err != nil {
+			fail("Loading ACL failed", err)
+		}
+		s.EnforceACL(acl)
+		log.Info("ACL", server.Fields{"file": opts.ACLFile})
+		reloaders["ACL"] = acl.Reload
+	}
+
+	http.HandleFunc("/", s.ServeHTTP)
+	httpServer := &http.Server{Addr: ":" + strconv.Itoa(opts.Port)}
+	if opts.TLSCert != "" {
+		certificate, err := server.LoadCertificateStore(opts.TLSCert, opts.TLSKey)
+		if err == nil {
+			httpServer.TLSConfig, err = certificate.TLSConfig(opts.ClientCA, opts.TokenFile == "")
+		}
+		if err != nil {
+			fail("Loading TLS configuration failed", err)
+		}
+		log.Info("TLS", server.Fields{"certificate": opts.TLSCert})
+		reloaders["CERTIFICATE"] = certificate.Reload
+	}
+	go reloadOnHangup(reloaders)
 
-	fmt.Println("PATHS EXEMPT FROM CACHE:")
-	for _, p := range opts.CacheExempt {
-		fmt.Printf(" - %s\n", p)
+	if opts.Port == 0 && opts.Socket == "" {
+		fail("Starting failed", errors.New("neither a port nor a socket to listen on"))
 	}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	errs := make(chan error, 2)
+	servers := []*http.Server{httpServer}
+	if opts.Socket != "" {
+		mode, err := strconv.ParseUint(opts.SocketMode, 8, 32)
+		if err != nil {
+			fail("Invalid socket mode", err)
+		}
+		listener, err := server.ListenUnix(opts.Socket, os.FileMode(mode))
+		if err != nil {
+			fail("Listening on socket failed", err)
+		}
+		log.Info("Socket", server.Fields{"path": opts.Socket})
+		socketServer := &http.Server{ConnContext: server.ConnContext}
+		servers = append(servers, socketServer)
+		go func() { errs <- socketServer.Serve(listener) }()
+	}
+	if opts.Port != 0 {
+		go func() {
+			if httpServer.TLSConfig != nil {
+				errs <- httpServer.ListenAndServeTLS("", "")
+			} else {
+				errs <- httpServer.ListenAndServe()
+			}
+		}()
+	}
+	s.StartupComplete()
 
-	fmt.Printf("HOOKS: %+v\n", opts.WebHookUrls)
+	status := 0
+	select {
+	case err := <-errs:
+		log.Error("Serving failed", server.Fields{"error": err})
+		status = 1
+	case sig := <-stop:
+		log.Info("Shutting down", server.Fields{"signal": sig.String(), "timeout": opts.StopTimeout})
+	}
+	os.Exit(status | shutdown(s, servers))
+}
 
-	handler := server.NewServerHandler(opts.DataPath, opts.CacheExempt, opts.WebHookUrls)
+// shutdown stops accepting connections, ends the event streams, lets the
+// requests in flight finish and delivers or saves the pending web hooks,
+// all within --shutdown-timeout. It returns 1 if requests were cut off or
+// the web hooks could not be saved.
+func shutdown(s *server.Server, servers []*http.Server) int {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(opts.StopTimeout)*time.Second)
+	defer cancel()
+	status := 0
+	s.Drain()
+	for _, httpServer := range servers {
+		if err := httpServer.Shutdown(ctx); err != nil {
+			log.Error("Finishing requests failed", server.Fields{"error": err})
+			status = 1
+		}
+	}
+	if err := s.Shutdown(ctx); err != nil {
+		log.Error("Shutting down failed", server.Fields{"error": err})
+		status = 1
+	}
+	log.Info("Stopped", server.Fields{"status": status})
+	return status
+}
 
-	http.HandleFunc("/", handler)
-	http.ListenAndServe(":"+strconv.Itoa(opts.Port), nil)
+func reloadOnHangup(reloaders map[string]func() error) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		for name, reload := range reloaders {
+			if err := reload(); err != nil {
+				log.Error("Reloading failed", server.Fields{"name": name, "error": err})
+			} else {
+				log.Info("Reloaded", server.Fields{"name": name})
+			}
+		}
+	}
 }
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Permissions granted by ACL rules
+const (
+	PermissionRead   = "read"
+	PermissionWrite  = "write"
+	PermissionDelete = "delete"
+	PermissionList   = "list"
+	PermissionWatch  = "watch"
+	PermissionReveal = "reveal"
+)
+
+var validPermissions = map[string]bool{
+	PermissionRead:   true,
+	PermissionWrite:  true,
+	PermissionDelete: true,
+	PermissionList:   true,
+	PermissionWatch:  true,
+	PermissionReveal: true,
+}
+
+// ACLRule grants a principal permissions on all keys below a prefix. The
+// principal '*' matches every caller, 'uid:<uid>' and 'gid:<gid>' match
+// unix socket peers.
+type ACLRule struct {
+	Principal   string   `json:"principal"`
+	Prefix      string   `json:"prefix"`
+	Permissions []string `json:"permissions"`
+}
+
+func (rule *ACLRule) grants(names []string, permission string) bool {
+	matches := rule.Principal == "*"
+	for _, name := range names {
+		matches = matches || rule.Principal == name
+	}
+	if !matches {
+		return false
+	}
+	for _, p := range rule.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// ACL decides which principal may do what to which keys. Rules only grant
+// permissions, so a permission on a prefix covers everything below it.
+type ACL struct {
+	path  string
+	mutex sync.RWMutex
+	rules []ACLRule
+}
+
+// LoadACL reads a JSON list of rules from path
+func LoadACL(path string) (*ACL, error) {
+	acl := &ACL{path: path}
+	return acl, acl.Reload()
+}
+
+// Reload reads the rules again, on failure the previous rules are kept
+func (acl *ACL) Reload() error {
+	content, err := ioutil.ReadFile(acl.path)
+	if err != nil {
+		return err
+	}
+	var rules []ACLRule
+	if err = json.Unmarshal(content, &rules); err != nil {
+		return err
+	}
+	for i := range rules {
+		rules[i].Prefix = strings.Trim(rules[i].Prefix, "/")
+		if rules[i].Principal == "" {
+			return fmt.Errorf("rule %d: a principal is required", i)
+		}
+		for _, p := range rules[i].Permissions {
+			if !validPermissions[p] {
+				return fmt.Errorf("rule %d: unknown permission '%s'", i, p)
+			}
+		}
+	}
+
+	acl.mutex.Lock()
+	defer acl.mutex.Unlock()
+	acl.rules = rules
+	return nil
+}
+
+// Allowed reports whether principal has permission on key
+func (acl *ACL) Allowed(principal, permission, key string) bool {
+	return acl.allowed([]string{principal}, permission, key)
+}
+
+// allowed reports whether a caller known by any of names has permission on
+// key
+func (acl *ACL) allowed(names []string, permission, key string) bool {
+	acl.mutex.RLock()
+	defer acl.mutex.RUnlock()
+	for i := range acl.rules {
+		if acl.rules[i].grants(names, permission) && matchesPrefix(key, acl.rules[i].Prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// reaches reports whether the caller has permission on key or on any key
+// below it, which makes key a namespace on the way to something permitted
+func (acl *ACL) reaches(names []string, permission, key string) bool {
+	acl.mutex.RLock()
+	defer acl.mutex.RUnlock()
+	for i := range acl.rules {
+		rule := &acl.rules[i]
+		if rule.grants(names, permission) && (matchesPrefix(key, rule.Prefix) || matchesPrefix(rule.Prefix, key)) {
+			return true
+		}
+	}
+	return false
+}
+
+// visible reports whether the caller may learn that key exists
+func (acl *ACL) visible(names []string, key string) bool {
+	return acl.reaches(names, PermissionRead, key) || acl.reaches(names, PermissionList, key)
+}
+
+// EnforceACL makes the server check every request against acl
+func (s *Server) EnforceACL(acl *ACL) {
+	s.acl = acl
+}
+
+// authorize fails with 403 unless the caller of r has permission on key
+func (s *Server) authorize(r *http.Request, permission, key string) error {
+	if s.acl == nil || isCommand(r) || s.acl.allowed(callerNames(r), permission, key) {
+		return nil
+	}
+	return s.deny(r, permission, key)
+}
+
+func (s *Server) deny(r *http.Request, permission, key string) error {
+	principal := Principal(r)
+	logger().Warn("Denied", Fields{"permission": permission, "key": key, "principal": principal, "method": r.Method, "path": r.URL.Path, "requestId": RequestID(r)})
+	return &requestError{http.StatusForbidden, "'" + principal + "' may not " + permission + " '" + key + "'."}
+}
+
+// authorizeChange checks a PUT, POST or DELETE of key
+func (s *Server) authorizeChange(r *http.Request, key string) error {
+	if r.Method == "DELETE" {
+		return s.authorize(r, PermissionDelete, key)
+	}
+	if operation(r) == "pop" {
+		if err := s.authorize(r, PermissionRead, key); err != nil {
+			return err
+		}
+		return s.authorize(r, PermissionDelete, key)
+	}
+	return s.authorize(r, PermissionWrite, key)
+}
+
+// authorizeReveal checks a request for key asking for secret values in
+// plain
+func (s *Server) authorizeReveal(r *http.Request, key string) error {
+	r.ParseForm()
+	if !reveals(r) {
+		return nil
+	}
+	return s.authorize(r, PermissionReveal, key)
+}
+
+// authorizeRead checks a GET of key. Namespaces can be listed by callers
+// that may list them or anything below them, their children are filtered
+// down to those the caller may see.
+func (s *Server) authorizeRead(r *http.Request, key string, entry *Entry) error {
+	if s.acl == nil {
+		return nil
+	}
+	names := callerNames(r)
+	if !entry.isNamespace {
+		return s.authorize(r, PermissionRead, key)
+	}
+	if !s.acl.reaches(names, PermissionList, key) {
+		return s.deny(r, PermissionList, key)
+	}
+
+	children := []string{}
+	for _, child := range entry.data {
+		if s.acl.visible(names, strings.TrimPrefix(key+"/"+child, "/")) {
+			children = append(children, child)
+		}
+	}
+	entry.data = children
+	return nil
+}
+
+// authorizeSystem checks requests to system APIs. Watching needs the watch
+// permission on the prefix, everything else the permission matching the
+// method on the request path, e.g. write on '_/locks/<name>'. Digests are
+// checked like reads of the key they cover.
+func (s *Server) authorizeSystem(r *http.Request, path string) error {
+	if s.acl == nil {
+		return nil
+	}
+	if path == reservedPrefix+"events" {
+		return s.authorize(r, PermissionWatch, strings.Trim(r.URL.Query().Get("prefix"), "/"))
+	}
+	if path == reservedPrefix+"sync/digest" || strings.HasPrefix(path, reservedPrefix+"sync/digest/") {
+		key := strings.Trim(strings.TrimPrefix(path, reservedPrefix+"sync/digest"), "/")
+		if isCommand(r) || s.acl.reaches(callerNames(r), PermissionList, key) {
+			// the digest only covers the children the caller may see
+			return nil
+		}
+		return s.authorize(r, PermissionRead, key)
+	}
+	switch r.Method {
+	case "GET":
+		return s.authorize(r, PermissionRead, path)
+	case "DELETE":
+		return s.authorize(r, PermissionDelete, path)
+	}
+	return s.authorize(r, PermissionWrite, path)
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testACL = `[
+	{"principal": "billing", "prefix": "billing", "permissions": ["read", "list", "watch"]},
+	{"principal": "billing", "prefix": "billing/state/", "permissions": ["write", "delete"]},
+	{"principal": "*", "prefix": "public", "permissions": ["read", "list"]}
+]`
+
+func newACLServer(t *testing.T) *Server {
+	cleanData()
+	f, err := ioutil.TempFile("", "acl")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString(testACL)
+	f.Close()
+
+	acl, err := LoadACL(f.Name())
+	assert.Nil(t, err)
+	s := NewServer(testDataPath, nil, nil)
+	for _, key := range []string{"billing/state/a", "billing/config", "billing/secret/b", "public/c", "other/d"} {
+		assert.Nil(t, putKey(expandPath(key), false, "x"))
+	}
+	s.EnforceACL(acl)
+	return s
+}
+
+func sendAs(s *Server, principal, method, key string, vals url.Values) *httptest.ResponseRecorder {
+	var req *http.Request
+	if method == "PUT" || method == "POST" {
+		req, _ = http.NewRequest(method, "http://localhost/"+key, strings.NewReader(vals.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		req, _ = http.NewRequest(method, "http://localhost/"+key+"?"+vals.Encode(), nil)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, withPrincipal(req, principal))
+	return w
+}
+
+func TestACLLoadRejectsUnknownPermission(t *testing.T) {
+	f, err := ioutil.TempFile("", "acl")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString(`[{"principal": "a", "prefix": "a", "permissions": ["admin"]}]`)
+	f.Close()
+
+	_, err = LoadACL(f.Name())
+	assert.NotNil(t, err)
+}
+
+func TestACLPermissions(t *testing.T) {
+	s := newACLServer(t)
+
+	assert.Equal(t, http.StatusOK, sendAs(s, "billing", "GET", "billing/config", nil).Code)
+	assert.Equal(t, http.StatusOK, sendAs(s, "billing", "GET", "public/c", nil).Code)
+	assert.Equal(t, http.StatusForbidden, sendAs(s, "billing", "GET", "other/d", nil).Code)
+	assert.Equal(t, http.StatusForbidden, sendAs(s, "billing", "GET", "other/missing", nil).Code)
+	assert.Equal(t, http.StatusForbidden, sendAs(s, "other", "GET", "billing/config", nil).Code)
+
+	assert.Equal(t, http.StatusOK, sendAs(s, "billing", "PUT", "billing/state/a", url.Values{"value": {"y"}}).Code)
+	assert.Equal(t, http.StatusForbidden, sendAs(s, "billing", "PUT", "billing/config", url.Values{"value": {"y"}}).Code)
+	assert.Equal(t, http.StatusForbidden, sendAs(s, "billing", "POST", "billing/config", url.Values{"op": {"incr"}}).Code)
+	assert.Equal(t, http.StatusForbidden, sendAs(s, "billing", "POST", "billing", url.Values{"op": {"pop"}}).Code)
+
+	// deleting a namespace needs the permission on the namespace itself
+	assert.Equal(t, http.StatusForbidden, sendAs(s, "billing", "DELETE", "billing", nil).Code)
+	assert.Equal(t, http.StatusOK, sendAs(s, "billing", "GET", "billing/config", nil).Code)
+	assert.Equal(t, http.StatusOK, sendAs(s, "billing", "DELETE", "billing/state", nil).Code)
+	assert.Equal(t, http.StatusNotFound, sendAs(s, "billing", "GET", "billing/state/a", nil).Code)
+}
+
+func TestACLFiltersListings(t *testing.T) {
+	s := newACLServer(t)
+	acl := s.acl
+	acl.rules = append(acl.rules, ACLRule{Principal: "auditor", Prefix: "billing/secret", Permissions: []string{"list"}})
+
+	w := sendAs(s, "billing", "GET", "billing", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var data ResponseData
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &data))
+	assert.Equal(t, []string{"config", "secret", "state"}, data.Keys)
+
+	// a namespace on the way to a permitted prefix shows only that path
+	w = sendAs(s, "auditor", "GET", "billing", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &data))
+	assert.Equal(t, []string{"secret"}, data.Keys)
+	assert.Equal(t, http.StatusOK, sendAs(s, "auditor", "GET", "billing/secret", nil).Code)
+	assert.Equal(t, http.StatusForbidden, sendAs(s, "auditor", "GET", "billing/secret/b", nil).Code)
+	assert.Equal(t, http.StatusForbidden, sendAs(s, "auditor", "GET", "other", nil).Code)
+}
+
+func TestACLSystemRoutes(t *testing.T) {
+	s := newACLServer(t)
+
+	assert.Equal(t, http.StatusForbidden, sendAs(s, "billing", "GET", "_/events", url.Values{"prefix": {"other"}}).Code)
+	assert.Equal(t, http.StatusForbidden, sendAs(s, "billing", "POST", "_/locks/billing", url.Values{"owner": {"a"}, "ttl": {"1"}}).Code)
+	assert.Equal(t, http.StatusForbidden, sendAs(s, "billing", "GET", "_/schemas", nil).Code)
+}
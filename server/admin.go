@@ -0,0 +1,107 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// ModeHeader tells clients whether the server accepts changes
+const ModeHeader = "X-SKVS-Mode"
+
+type readOnlyResponse struct {
+	ReadOnly bool   `json:"readOnly"`
+	Error    string `json:"error,omitempty"`
+}
+
+// errReadOnly is returned for changes while the server is read-only
+var errReadOnly = &requestError{http.StatusServiceUnavailable, "The server is read-only."}
+
+// SetReadOnly switches the server between rejecting and accepting changes.
+// While read-only, keys do not expire and re-encryption pauses, both
+// continue once the server accepts changes again.
+func (s *Server) SetReadOnly(readOnly bool) {
+	var value int32
+	if readOnly {
+		value = 1
+	}
+	if atomic.SwapInt32(&s.readOnly, value) == value {
+		return
+	}
+	if readOnly {
+		s.expiries.stopTimers()
+		return
+	}
+	if !s.isDraining() {
+		s.expiries.start()
+		if s.encryption != nil && s.encryption.Status().Reencrypting {
+			s.encryption.requestReencryption()
+		}
+	}
+}
+
+// ReadOnly reports whether the server rejects changes
+func (s *Server) ReadOnly() bool {
+	return atomic.LoadInt32(&s.readOnly) == 1
+}
+
+func (s *Server) mode() string {
+	if s.ReadOnly() {
+		return "read-only"
+	}
+	return "read-write"
+}
+
+// rejectsChange reports whether r would change something while the server
+// is read-only. Reads, watches, snapshots, switching the mode back and the
+// requests between cluster nodes stay possible.
+func (s *Server) rejectsChange(r *http.Request, key string) bool {
+	if r.Method == "GET" || r.Method == "HEAD" || !s.ReadOnly() {
+		return false
+	}
+	return key != reservedPrefix+"admin/read-only" && key != reservedPrefix+"admin/snapshot" && !strings.HasPrefix(key, reservedPrefix+"raft/")
+}
+
+// serveAdmin handles /_/admin/read-only: GET shows the mode and PUT with
+// 'value' true or false switches it. /_/admin/cluster manages the members of
+// a cluster, POST /_/admin/snapshot returns a snapshot archive and
+// /_/admin/encryption shows the encryption key and re-encryption progress.
+func (s *Server) serveAdmin(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/_/admin"), "/")
+	switch path {
+	case "cluster", "cluster/members":
+		if s.cluster == nil {
+			writeJSON(w, http.StatusNotFound, ClusterStatus{Error: "This server is not part of a cluster."})
+			return
+		}
+		s.cluster.serveCluster(w, r, path)
+	case "snapshot":
+		s.serveSnapshot(w, r)
+	case "encryption":
+		if s.encryption == nil {
+			writeJSON(w, http.StatusNotFound, EncryptionStatus{Error: "This server does not encrypt values."})
+			return
+		}
+		writeJSON(w, http.StatusOK, s.encryption.Status())
+	case "read-only":
+		switch r.Method {
+		case "GET":
+		case "PUT", "POST":
+			readOnly, err := strconv.ParseBool(r.Form.Get("value"))
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, readOnlyResponse{ReadOnly: s.ReadOnly(), Error: "Parameter 'value' must be true or false."})
+				return
+			}
+			s.SetReadOnly(readOnly)
+			w.Header().Set(ModeHeader, s.mode())
+		default:
+			writeJSON(w, http.StatusMethodNotAllowed, readOnlyResponse{ReadOnly: s.ReadOnly(), Error: "Method not allowed."})
+			return
+		}
+		writeJSON(w, http.StatusOK, readOnlyResponse{ReadOnly: s.ReadOnly()})
+	default:
+		writeResponse(w, ResponseData{StatusCode: http.StatusNotFound, Key: r.URL.Path[1:], Error: "Unknown admin path."})
+	}
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadOnly(t *testing.T) {
+	cleanData()
+	s := NewServer(testDataPath, nil, nil)
+	assert.Equal(t, http.StatusOK, sendRequest(s.ServeHTTP, "PUT", "foo", url.Values{"value": {"a"}}))
+	s.SetReadOnly(true)
+
+	for _, method := range []string{"PUT", "POST", "DELETE"} {
+		assert.Equal(t, http.StatusServiceUnavailable, sendRequest(s.ServeHTTP, method, "foo", url.Values{"value": {"b"}}))
+	}
+	assert.Equal(t, http.StatusServiceUnavailable, sendRequest(s.ServeHTTP, "POST", "_/locks/foo", url.Values{"owner": {"a"}, "ttl": {"1"}}))
+
+	req, _ := http.NewRequest("GET", "http://localhost/foo", nil)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "read-only", w.Header().Get(ModeHeader))
+	assert.Contains(t, w.Body.String(), `"value":"a"`)
+
+	assert.Equal(t, http.StatusBadRequest, sendRequest(s.ServeHTTP, "PUT", "_/admin/read-only", url.Values{"value": {"maybe"}}))
+	assert.Equal(t, http.StatusOK, sendRequest(s.ServeHTTP, "PUT", "_/admin/read-only", url.Values{"value": {"false"}}))
+	assert.False(t, s.ReadOnly())
+	assert.Equal(t, http.StatusOK, sendRequest(s.ServeHTTP, "PUT", "foo", url.Values{"value": {"b"}}))
+	assert.Equal(t, http.StatusOK, sendRequest(s.ServeHTTP, "PUT", "_/admin/read-only", url.Values{"value": {"true"}}))
+	assert.True(t, s.ReadOnly())
+}
+
+func TestReadOnlyPausesBackgroundChanges(t *testing.T) {
+	dataPath, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dataPath)
+	s := NewServer(dataPath, nil, nil)
+	assert.Equal(t, http.StatusOK, sendRequest(s.ServeHTTP, "PUT", "temp", url.Values{"value": {"a"}, "ttl": {"100ms"}}))
+	s.SetReadOnly(true)
+
+	// keys do not expire
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, http.StatusOK, sendRequest(s.ServeHTTP, "GET", "temp", nil))
+
+	// nothing is synced
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("The remote was asked while read-only.")
+	}))
+	defer remote.Close()
+	s.SetSyncKey([]byte("shared"))
+	syncer, err := s.StartSync(SyncConfig{Remote: remote.URL})
+	assert.Nil(t, err)
+	defer syncer.Stop()
+	report := syncer.Run()
+	assert.Equal(t, []string{errReadOnly.Error()}, report.Errors)
+
+	// nothing is re-encrypted
+	keyFile := filepath.Join(dataPath, "keys")
+	assert.Nil(t, ioutil.WriteFile(keyFile, []byte(encryptionKeyLine("k1")), 0600))
+	assert.Nil(t, putKey(filepath.Join(dataPath, "secrets/a"), false, "p"))
+	encryption, err := s.EncryptAtRest(EncryptionConfig{KeyFile: keyFile, Prefixes: []string{"secrets"}})
+	assert.Nil(t, err)
+	time.Sleep(100 * time.Millisecond)
+	assert.True(t, encryption.Status().Reencrypting)
+	assert.Equal(t, "p", rawValue(t, dataPath, "secrets/a"))
+
+	// everything continues once changes are accepted again
+	s.SetReadOnly(false)
+	waitFor(t, func() bool { return sendRequest(s.ServeHTTP, "GET", "temp", nil) == http.StatusNotFound })
+	waitFor(t, func() bool { return !encryption.Status().Reencrypting })
+	assert.True(t, strings.HasPrefix(rawValue(t, dataPath, "secrets/a"), sealedPrefix+"k1:"))
+}
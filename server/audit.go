@@ -0,0 +1,311 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditQueryLimit is the default number of entries returned by /_/audit
+const auditQueryLimit = 1000
+
+// AuditEntry records a change of a key. The hashes are the SHA-256 hashes
+// of the value before and after the change, empty if there was none or the
+// key is a namespace. Secret keys are recorded without hashes.
+type AuditEntry struct {
+	Revision   uint64    `json:"revision"`
+	Time       time.Time `json:"time"`
+	RemoteAddr string    `json:"remoteAddr,omitempty"`
+	Principal  string    `json:"principal,omitempty"`
+	Key        string    `json:"key"`
+	Action     string    `json:"action"`
+	Operation  string    `json:"operation,omitempty"`
+	OldHash    string    `json:"oldHash,omitempty"`
+	NewHash    string    `json:"newHash,omitempty"`
+	Redacted   bool      `json:"redacted,omitempty"`
+}
+
+// AuditConfig configures the audit log
+type AuditConfig struct {
+	// Path of the current log file, rotated files get the suffixes .1, .2…
+	Path string
+	// MaxSize in bytes after which the file is rotated
+	MaxSize int64
+	// MaxFiles is the number of rotated files kept
+	MaxFiles int
+}
+
+// AuditLog appends an entry for every change of a key to a JSON Lines file.
+// Revisions number the entries and continue after a restart.
+type AuditLog struct {
+	config   AuditConfig
+	mutex    sync.Mutex
+	file     *os.File
+	size     int64
+	revision uint64
+}
+
+// EnableAudit records all changes of keys in the audit log at config.Path
+func (s *Server) EnableAudit(config AuditConfig) (*AuditLog, error) {
+	if config.MaxSize <= 0 || config.MaxFiles < 0 {
+		return nil, fmt.Errorf("invalid audit log size %d or number of files %d", config.MaxSize, config.MaxFiles)
+	}
+	log := &AuditLog{config: config}
+	for _, path := range log.files() {
+		entries, err := readAuditFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) > 0 {
+			log.revision = entries[len(entries)-1].Revision
+		}
+	}
+	if err := log.open(); err != nil {
+		return nil, err
+	}
+	s.auditLog = log
+	return log, nil
+}
+
+// Close closes the log file
+func (log *AuditLog) Close() error {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	return log.file.Close()
+}
+
+func (log *AuditLog) open() error {
+	f, err := os.OpenFile(log.config.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	log.file, log.size = f, info.Size()
+	return nil
+}
+
+// files returns the paths of the log files from the oldest to the current
+func (log *AuditLog) files() []string {
+	paths := []string{}
+	for i := log.config.MaxFiles; i > 0; i-- {
+		path := log.config.Path + "." + strconv.Itoa(i)
+		if _, err := os.Stat(path); err == nil {
+			paths = append(paths, path)
+		}
+	}
+	return append(paths, log.config.Path)
+}
+
+// rotate moves the current file to .1, shifting older files up and
+// removing the oldest
+func (log *AuditLog) rotate() error {
+	if err := log.file.Close(); err != nil {
+		return err
+	}
+	if log.config.MaxFiles == 0 {
+		os.Remove(log.config.Path)
+	}
+	for i := log.config.MaxFiles; i > 0; i-- {
+		from := log.config.Path
+		if i > 1 {
+			from += "." + strconv.Itoa(i-1)
+		}
+		if err := os.Rename(from, log.config.Path+"."+strconv.Itoa(i)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return log.open()
+}
+
+func (log *AuditLog) record(entry AuditEntry) error {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	entry.Revision = log.revision + 1
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if log.size > 0 && log.size+int64(len(line)) > log.config.MaxSize {
+		if err = log.rotate(); err != nil {
+			return err
+		}
+	}
+	if _, err = log.file.Write(line); err != nil {
+		return err
+	}
+	log.size += int64(len(line))
+	log.revision = entry.Revision
+	return log.file.Sync()
+}
+
+// Query returns the last limit entries for keys below prefix changed
+// between since and until, zero times leave the range open
+func (log *AuditLog) Query(prefix string, since, until time.Time, limit int) ([]AuditEntry, error) {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	result := []AuditEntry{}
+	for _, path := range log.files() {
+		entries, err := readAuditFile(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if matchesPrefix(entry.Key, prefix) && (since.IsZero() || !entry.Time.Before(since)) && (until.IsZero() || entry.Time.Before(until)) {
+				result = append(result, entry)
+			}
+		}
+	}
+	if limit > 0 && len(result) > limit {
+		result = result[len(result)-limit:]
+	}
+	return result, nil
+}
+
+func readAuditFile(path string) ([]AuditEntry, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []AuditEntry{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry AuditEntry
+		// a line cut short by a crash is skipped
+		if json.Unmarshal(scanner.Bytes(), &entry) == nil {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+func hashValue(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+// auditHash returns the hash of the value at key for the audit log, empty
+// for missing keys and namespaces
+func (s *Server) auditHash(key, keyPath string) string {
+	unlock := rlockPath(keyPath)
+	defer unlock()
+	return s.auditHashLocked(key, keyPath)
+}
+
+// auditHashLocked is auditHash for callers already holding the lock of keyPath
+func (s *Server) auditHashLocked(key, keyPath string) string {
+	if s.auditLog == nil {
+		return ""
+	}
+	entry, err := readKeyLocked(keyPath, isExemptFromCache(key, s.cacheExemptionList))
+	if err != nil || entry.isNamespace {
+		return ""
+	}
+	return hashValue(entry.data[0])
+}
+
+// audit records entry, r is the request that made the change or nil for
+// changes the server made itself. In a cluster the node that proposed a
+// change records it.
+func (s *Server) audit(r *http.Request, entry AuditEntry) {
+	if s.auditLog == nil || effectsOf(r) != allEffects {
+		return
+	}
+	entry.Time = time.Now().UTC()
+	if r != nil {
+		entry.RemoteAddr = r.RemoteAddr
+		entry.Principal = Principal(r)
+	}
+	// a plain hash would let anyone reading the log guess encrypted values
+	if s.secrets.covers(entry.Key) || (s.encryption != nil && s.encryption.covers(entry.Key)) {
+		entry.OldHash, entry.NewHash, entry.Redacted = "", "", true
+	}
+	if err := s.auditLog.record(entry); err != nil {
+		logger().Error("Writing audit entry failed", Fields{"key": entry.Key, "error": err})
+	}
+}
+
+// auditChange records a change made through the key API, oldHash is the
+// hash of key before it and value the value returned to the client
+func (s *Server) auditChange(r *http.Request, change Event, oldHash, value string) {
+	if s.auditLog == nil {
+		return
+	}
+	entry := AuditEntry{Key: change.Key, Action: change.Action, Operation: operation(r)}
+	switch {
+	case entry.Operation == "pop":
+		entry.OldHash = hashValue(value)
+	case entry.Operation == "push":
+		entry.NewHash = hashValue(value)
+	case change.Action == "DELETE":
+		entry.OldHash = oldHash
+	default:
+		entry.OldHash, entry.NewHash = oldHash, hashValue(value)
+	}
+	s.audit(r, entry)
+}
+
+type auditResponse struct {
+	Entries []AuditEntry `json:"entries"`
+	Error   string       `json:"error,omitempty"`
+}
+
+// serveAudit answers GET /_/audit?prefix=<key>&since=<time>&until=<time>
+// with the matching audit entries, times are RFC 3339. 'limit' bounds the
+// number of entries, the newest are returned.
+func (s *Server) serveAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeJSON(w, http.StatusMethodNotAllowed, auditResponse{Error: "Only GET is allowed."})
+		return
+	}
+	if s.auditLog == nil {
+		writeJSON(w, http.StatusNotFound, auditResponse{Error: "The audit log is not enabled."})
+		return
+	}
+	query := r.URL.Query()
+	var since, until time.Time
+	var err error
+	if query.Get("since") != "" {
+		if since, err = time.Parse(time.RFC3339, query.Get("since")); err != nil {
+			writeJSON(w, http.StatusBadRequest, auditResponse{Error: "Parameter 'since' is not an RFC 3339 time."})
+			return
+		}
+	}
+	if query.Get("until") != "" {
+		if until, err = time.Parse(time.RFC3339, query.Get("until")); err != nil {
+			writeJSON(w, http.StatusBadRequest, auditResponse{Error: "Parameter 'until' is not an RFC 3339 time."})
+			return
+		}
+	}
+	limit := auditQueryLimit
+	if query.Get("limit") != "" {
+		if limit, err = strconv.Atoi(query.Get("limit")); err != nil || limit <= 0 {
+			writeJSON(w, http.StatusBadRequest, auditResponse{Error: "Parameter 'limit' is not a positive number."})
+			return
+		}
+	}
+
+	entries, err := s.auditLog.Query(strings.Trim(query.Get("prefix"), "/"), since, until, limit)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, auditResponse{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, auditResponse{Entries: entries})
+}
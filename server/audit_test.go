@@ -0,0 +1,144 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func auditEntries(t *testing.T, s *Server, query url.Values) []AuditEntry {
+	w := sendAs(s, "", "GET", "_/audit", query)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response auditResponse
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &response))
+	return response.Entries
+}
+
+func TestAuditRecordsChanges(t *testing.T) {
+	cleanData()
+	dir, err := ioutil.TempDir("", "audit")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := NewServer(testDataPath, nil, nil)
+	assert.Equal(t, http.StatusNotFound, sendRequest(s.ServeHTTP, "GET", "_/audit", nil))
+	_, err = s.EnableAudit(AuditConfig{Path: filepath.Join(dir, "audit.log"), MaxSize: 1 << 20, MaxFiles: 2})
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusOK, sendAs(s, "app", "PUT", "config/a", url.Values{"value": {"1"}}).Code)
+	assert.Equal(t, http.StatusOK, sendAs(s, "app", "PUT", "config/a", url.Values{"value": {"2"}}).Code)
+	assert.Equal(t, http.StatusOK, sendAs(s, "ops", "DELETE", "config/a", nil).Code)
+	assert.Equal(t, http.StatusOK, sendAs(s, "app", "PUT", "_/secrets/creds", nil).Code)
+	assert.Equal(t, http.StatusOK, sendAs(s, "app", "PUT", "creds/db", url.Values{"value": {"hunter2"}}).Code)
+	assert.Equal(t, http.StatusOK, sendAs(s, "app", "PUT", "session", url.Values{"value": {"x"}, "ttl": {"0.1"}}).Code)
+	waitFor(t, func() bool { return sendRequest(s.ServeHTTP, "GET", "session", nil) == http.StatusNotFound })
+	waitFor(t, func() bool { return len(auditEntries(t, s, nil)) == 6 })
+
+	entries := auditEntries(t, s, nil)
+	assert.Len(t, entries, 6)
+	for i, entry := range entries {
+		assert.Equal(t, uint64(i+1), entry.Revision)
+	}
+	assert.Equal(t, "config/a", entries[0].Key)
+	assert.Equal(t, "PUT", entries[0].Action)
+	assert.Equal(t, "app", entries[0].Principal)
+	assert.Equal(t, "", entries[0].OldHash)
+	assert.Equal(t, hashValue("1"), entries[0].NewHash)
+	assert.Equal(t, hashValue("1"), entries[1].OldHash)
+	assert.Equal(t, hashValue("2"), entries[1].NewHash)
+	assert.Equal(t, "DELETE", entries[2].Action)
+	assert.Equal(t, "ops", entries[2].Principal)
+	assert.Equal(t, hashValue("2"), entries[2].OldHash)
+	assert.Equal(t, "", entries[2].NewHash)
+
+	// secret values are not hashed
+	assert.Equal(t, "creds/db", entries[3].Key)
+	assert.True(t, entries[3].Redacted)
+	assert.Equal(t, "", entries[3].NewHash)
+
+	assert.Equal(t, "EXPIRE", entries[5].Action)
+	assert.Equal(t, hashValue("x"), entries[5].OldHash)
+
+	// queries by prefix and time
+	entries = auditEntries(t, s, url.Values{"prefix": {"config"}})
+	assert.Len(t, entries, 3)
+	entries = auditEntries(t, s, url.Values{"prefix": {"config"}, "limit": {"1"}})
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "DELETE", entries[0].Action)
+	entries = auditEntries(t, s, url.Values{"since": {time.Now().Add(time.Hour).Format(time.RFC3339)}})
+	assert.Len(t, entries, 0)
+	entries = auditEntries(t, s, url.Values{"until": {time.Now().Add(time.Hour).Format(time.RFC3339)}})
+	assert.Len(t, entries, 6)
+	assert.Equal(t, http.StatusBadRequest, sendRequest(s.ServeHTTP, "GET", "_/audit", url.Values{"since": {"yesterday"}}))
+	assert.Equal(t, http.StatusMethodNotAllowed, sendRequest(s.ServeHTTP, "DELETE", "_/audit", nil))
+}
+
+func TestAuditLeavesOutHashesOfEncryptedKeys(t *testing.T) {
+	dataPath, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dataPath)
+	keyFile := filepath.Join(dataPath, "keys")
+	assert.Nil(t, ioutil.WriteFile(keyFile, []byte(encryptionKeyLine("k1")), 0600))
+	s := NewServer(dataPath, nil, nil)
+	_, err = s.EncryptAtRest(EncryptionConfig{KeyFile: keyFile, Prefixes: []string{"vault"}})
+	assert.Nil(t, err)
+	_, err = s.EnableAudit(AuditConfig{Path: filepath.Join(dataPath, "audit.log"), MaxSize: 1 << 20})
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusOK, sendAs(s, "app", "PUT", "vault/pin", url.Values{"value": {"1234"}}).Code)
+	assert.Equal(t, http.StatusOK, sendAs(s, "app", "PUT", "vault/pin", url.Values{"value": {"4321"}}).Code)
+	assert.Equal(t, http.StatusOK, sendAs(s, "app", "PUT", "plain", url.Values{"value": {"1234"}}).Code)
+
+	entries := auditEntries(t, s, nil)
+	assert.Len(t, entries, 3)
+	for _, entry := range entries[:2] {
+		assert.True(t, entry.Redacted)
+		assert.Equal(t, "", entry.OldHash)
+		assert.Equal(t, "", entry.NewHash)
+	}
+	assert.False(t, entries[2].Redacted)
+	assert.Equal(t, hashValue("1234"), entries[2].NewHash)
+}
+
+func TestAuditRotation(t *testing.T) {
+	cleanData()
+	dir, err := ioutil.TempDir("", "audit")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+	s := NewServer(testDataPath, nil, nil)
+	log, err := s.EnableAudit(AuditConfig{Path: path, MaxSize: 400, MaxFiles: 2})
+	assert.Nil(t, err)
+	for i := 0; i < 20; i++ {
+		assert.Equal(t, http.StatusOK, sendRequest(s.ServeHTTP, "PUT", "key", url.Values{"value": {"v"}}))
+	}
+	assert.Nil(t, log.Close())
+
+	_, err = os.Stat(path + ".2")
+	assert.Nil(t, err)
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+	for _, file := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(file)
+		assert.Nil(t, err)
+		assert.True(t, info.Size() <= 400)
+	}
+
+	// the oldest entries are gone, revisions continue after a restart
+	s = NewServer(testDataPath, nil, nil)
+	_, err = s.EnableAudit(AuditConfig{Path: path, MaxSize: 400, MaxFiles: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, sendRequest(s.ServeHTTP, "DELETE", "key", nil))
+	entries := auditEntries(t, s, nil)
+	assert.True(t, len(entries) < 21)
+	assert.Equal(t, uint64(21), entries[len(entries)-1].Revision)
+	for i := 1; i < len(entries); i++ {
+		assert.Equal(t, entries[i-1].Revision+1, entries[i].Revision)
+	}
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+type contextKey int
+
+const principalContextKey contextKey = 0
+
+// Principal returns the name the request was authenticated as, or an empty
+// string for unauthenticated requests
+func Principal(r *http.Request) string {
+	principal, _ := r.Context().Value(principalContextKey).(string)
+	return principal
+}
+
+func withPrincipal(r *http.Request, principal string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), principalContextKey, principal))
+}
+
+// HashToken returns the hex encoded SHA-256 hash of token, the form tokens
+// are stored in
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+type tokenEntry struct {
+	principal string
+	hash      []byte
+}
+
+// TokenStore authenticates bearer tokens. Tokens are read from a file, or
+// from all files in a directory, with one 'principal:sha256-of-token' per
+// line. Empty lines and lines starting with '#' are ignored.
+type TokenStore struct {
+	path   string
+	mutex  sync.RWMutex
+	tokens []tokenEntry
+}
+
+// LoadTokenStore reads the tokens at path
+func LoadTokenStore(path string) (*TokenStore, error) {
+	store := &TokenStore{path: path}
+	return store, store.Reload()
+}
+
+// Reload reads the tokens again, on failure the previous tokens are kept
+func (store *TokenStore) Reload() error {
+	files := []string{store.path}
+	if info, err := os.Stat(store.path); err != nil {
+		return err
+	} else if info.IsDir() {
+		if files, err = filepath.Glob(filepath.Join(store.path, "*")); err != nil {
+			return err
+		}
+	}
+
+	var tokens []tokenEntry
+	for _, file := range files {
+		entries, err := readTokenFile(file)
+		if err != nil {
+			return err
+		}
+		tokens = append(tokens, entries...)
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.tokens = tokens
+	return nil
+}
+
+func readTokenFile(path string) ([]tokenEntry, error) {
+	if info, err := os.Stat(path); err != nil || info.IsDir() {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var tokens []tokenEntry
+	scanner := bufio.NewScanner(f)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("%s:%d: expected 'principal:sha256'", path, number)
+		}
+		hash, err := hex.DecodeString(strings.TrimSpace(parts[1]))
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("%s:%d: not a hex encoded SHA-256 hash", path, number)
+		}
+		tokens = append(tokens, tokenEntry{principal: strings.TrimSpace(parts[0]), hash: hash})
+	}
+	return tokens, scanner.Err()
+}
+
+// Authenticate returns the principal token belongs to
+func (store *TokenStore) Authenticate(token string) (string, bool) {
+	sum := sha256.Sum256([]byte(token))
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	principal, found := "", false
+	for _, entry := range store.tokens {
+		if subtle.ConstantTimeCompare(sum[:], entry.hash) == 1 && !found {
+			principal, found = entry.principal, true
+		}
+	}
+	return principal, found
+}
+
+// authenticate checks the bearer token of a request and returns the
+// request carrying the principal
+func (store *TokenStore) authenticate(r *http.Request) (*http.Request, bool) {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return r, false
+	}
+	principal, ok := store.Authenticate(strings.TrimSpace(header[7:]))
+	if !ok {
+		return r, false
+	}
+	return withPrincipal(r, principal), true
+}
+
+// RequireTokens makes the server reject requests without a bearer token
+// known to store, unless they come with a verified client certificate or
+// over a unix socket
+func (s *Server) RequireTokens(store *TokenStore) {
+	s.tokens = store
+}
+
+func writeUnauthorized(w http.ResponseWriter, key string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="skvs"`)
+	writeResponse(w, ResponseData{StatusCode: http.StatusUnauthorized, Key: key, Error: "A valid bearer token is required."})
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTokenFile(t *testing.T, path string, tokens map[string]string) {
+	content := "# principal:sha256\n\n"
+	for principal, token := range tokens {
+		content += principal + ":" + HashToken(token) + "\n"
+	}
+	assert.Nil(t, ioutil.WriteFile(path, []byte(content), 0600))
+}
+
+func TestTokenStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	writeTokenFile(t, filepath.Join(dir, "a"), map[string]string{"alice": "secret-a"})
+	writeTokenFile(t, filepath.Join(dir, "b"), map[string]string{"bob": "secret-b"})
+
+	store, err := LoadTokenStore(dir)
+	assert.Nil(t, err)
+	principal, ok := store.Authenticate("secret-a")
+	assert.True(t, ok)
+	assert.Equal(t, "alice", principal)
+	principal, ok = store.Authenticate("secret-b")
+	assert.True(t, ok)
+	assert.Equal(t, "bob", principal)
+	_, ok = store.Authenticate("secret-c")
+	assert.False(t, ok)
+
+	// revoking and adding tokens takes effect on reload
+	writeTokenFile(t, filepath.Join(dir, "b"), map[string]string{"carol": "secret-c"})
+	assert.Nil(t, store.Reload())
+	_, ok = store.Authenticate("secret-b")
+	assert.False(t, ok)
+	_, ok = store.Authenticate("secret-c")
+	assert.True(t, ok)
+
+	// a broken file keeps the previous tokens
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "b"), []byte("carol:plaintext\n"), 0600))
+	assert.NotNil(t, store.Reload())
+	_, ok = store.Authenticate("secret-c")
+	assert.True(t, ok)
+}
+
+func TestHTTPRequiresToken(t *testing.T) {
+	cleanData()
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	writeTokenFile(t, filepath.Join(dir, "tokens"), map[string]string{"alice": "secret-a"})
+	store, err := LoadTokenStore(filepath.Join(dir, "tokens"))
+	assert.Nil(t, err)
+
+	s := NewServer(testDataPath, nil, nil)
+	s.RequireTokens(store)
+	var principal string
+	s.HandleSystem("whoami", func(w http.ResponseWriter, r *http.Request) {
+		principal = Principal(r)
+	})
+
+	for _, header := range []string{"", "Bearer wrong", "Basic secret-a"} {
+		req, _ := http.NewRequest("GET", "http://localhost/foo", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Equal(t, `Bearer realm="skvs"`, w.Header().Get("WWW-Authenticate"))
+	}
+
+	req, _ := http.NewRequest("GET", "http://localhost/foo", nil)
+	req.Header.Set("Authorization", "Bearer secret-a")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	req, _ = http.NewRequest("GET", "http://localhost/_/whoami", nil)
+	req.Header.Set("Authorization", "Bearer secret-a")
+	s.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "alice", principal)
+}
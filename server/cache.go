@@ -0,0 +1,148 @@
+package server
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+type Entry struct {
+	data        []string
+	isNamespace bool
+}
+
+// skvsCache holds entries already read from disk, it is guarded by
+// skvsCacheMutex
+var skvsCache map[string]Entry = make(map[string]Entry)
+var skvsCacheMutex sync.RWMutex
+
+// skvsCacheGeneration is incremented on every invalidation. An entry read
+// from disk is only stored if no invalidation happened while reading it,
+// otherwise a slow reader could put back data a writer just replaced.
+var skvsCacheGeneration uint64
+
+// return a cached entry and whether it was found
+func cacheLookup(path string) (Entry, bool) {
+	skvsCacheMutex.RLock()
+	defer skvsCacheMutex.RUnlock()
+	entry, ok := skvsCache[path]
+	return entry, ok
+}
+
+// return the number of cached entries
+func cacheSize() int {
+	skvsCacheMutex.RLock()
+	defer skvsCacheMutex.RUnlock()
+	return len(skvsCache)
+}
+
+// return the current generation, to be passed to cacheStoreRead
+func cacheGeneration() uint64 {
+	skvsCacheMutex.RLock()
+	defer skvsCacheMutex.RUnlock()
+	return skvsCacheGeneration
+}
+
+// store an entry read from disk unless the cache was invalidated since
+// generation was taken
+func cacheStoreRead(path string, entry Entry, generation uint64) {
+	skvsCacheMutex.Lock()
+	defer skvsCacheMutex.Unlock()
+	if generation == skvsCacheGeneration {
+		skvsCache[path] = entry
+	}
+}
+
+// replace the entry for path and invalidate all related entries
+func cacheStoreWrite(path string, entry Entry) {
+	skvsCacheMutex.Lock()
+	defer skvsCacheMutex.Unlock()
+	invalidateCacheLocked(path)
+	skvsCache[path] = entry
+}
+
+// removes cache entries for the given path and all its parents and/or children
+func invalidateCache(path string) {
+	skvsCacheMutex.Lock()
+	defer skvsCacheMutex.Unlock()
+	invalidateCacheLocked(path)
+}
+
+// drop all cache entries
+func flushCache() {
+	skvsCacheMutex.Lock()
+	defer skvsCacheMutex.Unlock()
+	skvsCache = make(map[string]Entry)
+	skvsCacheGeneration++
+}
+
+func invalidateCacheLocked(path string) {
+	skvsCacheGeneration++
+
+	prefix := path + "/"
+	for cached := range skvsCache {
+		if strings.HasPrefix(cached, prefix) {
+			delete(skvsCache, cached)
+		}
+	}
+
+	for {
+		delete(skvsCache, path)
+		parent := filepath.Dir(path)
+		if parent == path {
+			break
+		}
+		path = parent
+	}
+}
+
+// pathLock is a reader/writer lock for a single path, it is removed from
+// the registry as soon as nobody holds or waits for it
+type pathLock struct {
+	sync.RWMutex
+	refs int
+}
+
+var pathLocks = make(map[string]*pathLock)
+var pathLocksMutex sync.Mutex
+
+func acquirePathLock(path string) *pathLock {
+	pathLocksMutex.Lock()
+	defer pathLocksMutex.Unlock()
+	l, ok := pathLocks[path]
+	if !ok {
+		l = &pathLock{}
+		pathLocks[path] = l
+	}
+	l.refs++
+	return l
+}
+
+func releasePathLock(path string, l *pathLock) {
+	pathLocksMutex.Lock()
+	defer pathLocksMutex.Unlock()
+	l.refs--
+	if l.refs == 0 {
+		delete(pathLocks, path)
+	}
+}
+
+// lockPath locks path for writing and returns the function to unlock it
+func lockPath(path string) func() {
+	l := acquirePathLock(path)
+	l.Lock()
+	return func() {
+		l.Unlock()
+		releasePathLock(path, l)
+	}
+}
+
+// rlockPath locks path for reading and returns the function to unlock it
+func rlockPath(path string) func() {
+	l := acquirePathLock(path)
+	l.RLock()
+	return func() {
+		l.RUnlock()
+		releasePathLock(path, l)
+	}
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInvalidateCacheRemovesParentsAndChildren(t *testing.T) {
+	cleanData()
+	cacheStoreWrite("/data/foo", Entry{data: []string{"bar"}, isNamespace: true})
+	cacheStoreWrite("/data/foo/bar/zero", Entry{data: []string{"0"}})
+	cacheStoreWrite("/data/foobar", Entry{data: []string{"foobar"}})
+
+	invalidateCache("/data/foo/bar")
+
+	_, ok := cacheLookup("/data/foo")
+	assert.False(t, ok)
+	_, ok = cacheLookup("/data/foo/bar/zero")
+	assert.False(t, ok)
+	_, ok = cacheLookup("/data/foobar")
+	assert.True(t, ok)
+}
+
+func TestStaleReadIsNotCached(t *testing.T) {
+	cleanData()
+	testPath := expandPath("foo")
+	generation := cacheGeneration()
+	invalidateCache(testPath)
+	cacheStoreRead(testPath, Entry{data: []string{"stale"}}, generation)
+
+	_, ok := cacheLookup(testPath)
+	assert.False(t, ok)
+}
+
+// Many writers and readers work on overlapping keys. Every writer must be
+// able to read its own writes, readers of a single key must never see it
+// going back in time and in the end the cache has to agree with the disk.
+func TestConcurrentAccess(t *testing.T) {
+	cleanData()
+	const workers = 8
+	const iterations = 200
+	handler := NewServerHandler(testDataPath, nil, nil)
+	counterPath := expandPath("stress/counter")
+	var wg sync.WaitGroup
+
+	request := func(method, key, value string) *httptest.ResponseRecorder {
+		var req *http.Request
+		if value != "" {
+			req, _ = http.NewRequest(method, "http://localhost/"+key, strings.NewReader(url.Values{"value": {value}}.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			req, _ = http.NewRequest(method, "http://localhost/"+key, nil)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+
+	// read-your-writes on private keys, sharing a namespace
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			path := expandPath(fmt.Sprintf("stress/ns/worker%d", worker))
+			for j := 0; j < iterations; j++ {
+				value := strconv.Itoa(j)
+				if err := putKey(path, false, value); err != nil {
+					t.Error(err)
+					return
+				}
+				entry, err := readKey(path, false)
+				if err != nil || len(entry.data) != 1 || entry.data[0] != value {
+					t.Errorf("Worker %d wrote '%s' but read %+v (%v)", worker, value, entry.data, err)
+					return
+				}
+				if j%10 == 0 {
+					if err := deleteKey(path); err != nil {
+						t.Error(err)
+						return
+					}
+					if _, err := readKey(path, false); err == nil {
+						t.Errorf("Worker %d deleted its key, but it still exists", worker)
+						return
+					}
+				}
+			}
+		}(i)
+	}
+
+	// namespace listings racing with the writers above
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				w := request("GET", "stress/ns", "")
+				if w.Code != http.StatusOK && w.Code != http.StatusNotFound {
+					t.Errorf("Unexpected status %d", w.Code)
+					return
+				}
+			}
+		}()
+	}
+
+	// a single writer incrementing a shared key, readers must never see it
+	// decrease
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 1; j <= iterations; j++ {
+			if w := request("PUT", "stress/counter", strconv.Itoa(j)); w.Code != http.StatusOK {
+				t.Errorf("Unexpected status %d", w.Code)
+				return
+			}
+		}
+	}()
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			last := 0
+			for j := 0; j < iterations; j++ {
+				entry, err := readKey(counterPath, false)
+				if err != nil {
+					continue
+				}
+				current, _ := strconv.Atoi(entry.data[0])
+				if current < last {
+					t.Errorf("Read %d after %d", current, last)
+					return
+				}
+				last = current
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	entry, err := readKey(expandPath("stress/ns"), false)
+	assert.Nil(t, err)
+	files, err := ioutil.ReadDir(expandPath("stress/ns"))
+	assert.Nil(t, err)
+	assert.Equal(t, len(files), len(entry.data))
+	for i := 0; i < workers; i++ {
+		path := expandPath(fmt.Sprintf("stress/ns/worker%d", i))
+		cached, cacheErr := readKey(path, false)
+		content, diskErr := ioutil.ReadFile(path)
+		if os.IsNotExist(diskErr) {
+			assert.NotNil(t, cacheErr)
+		} else {
+			assert.Nil(t, cacheErr)
+			assert.Equal(t, string(content), cached.data[0])
+		}
+	}
+}
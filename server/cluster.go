@@ -0,0 +1,542 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	commandContextKey contextKey = 2
+	effectsContextKey contextKey = 4
+
+	// forwardedHeader marks requests a node forwarded to the leader
+	forwardedHeader = "X-SKVS-Forwarded-By"
+)
+
+// ClusterConfig configures a node of a Raft cluster
+type ClusterConfig struct {
+	// ID is the URL the other members reach this node at
+	ID string
+	// Peers are the URLs of all initial members including this node, they
+	// are only used on the first start
+	Peers []string
+	// Token authenticates the node at its peers
+	Token string
+	// Client sends the requests to the peers, by default one with a
+	// timeout of a second
+	Client *http.Client
+	// LinearizableReads makes all reads go through the leader, otherwise
+	// only those with 'consistent=true' do
+	LinearizableReads bool
+	// ElectionTimeout and HeartbeatInterval default to 500ms and 100ms
+	ElectionTimeout   time.Duration
+	HeartbeatInterval time.Duration
+	// CommitTimeout bounds the wait of the leader for a majority to commit
+	// a change or confirm a read, by default 10 election timeouts
+	CommitTimeout time.Duration
+}
+
+// ClusterStatus describes a node's view of the cluster
+type ClusterStatus struct {
+	ID          string   `json:"id"`
+	Role        string   `json:"role"`
+	Term        uint64   `json:"term"`
+	Leader      string   `json:"leader"`
+	Members     []string `json:"members"`
+	CommitIndex uint64   `json:"commitIndex"`
+	Applied     uint64   `json:"applied"`
+	Error       string   `json:"error,omitempty"`
+}
+
+// clusterCommand is a change agreed on by the cluster and applied by every
+// node: a request to a key or the schemas, or the expiry of a key
+type clusterCommand struct {
+	Method string    `json:"method"`
+	Path   string    `json:"path"`
+	Query  string    `json:"query,omitempty"`
+	Body   string    `json:"body,omitempty"`
+	Time   time.Time `json:"time"`
+	// Principal and RemoteAddr of the request, for the audit log
+	Principal  string `json:"principal,omitempty"`
+	RemoteAddr string `json:"remoteAddr,omitempty"`
+	RequestID  string `json:"requestId,omitempty"`
+	// Proposer is the node that calls the web hooks and audits the change
+	Proposer string `json:"proposer,omitempty"`
+	// Sealed commands carry Query and Body encrypted, for encrypted keys
+	Sealed bool `json:"sealed,omitempty"`
+}
+
+// seal encrypts the parameters of a command to a key below an encrypted
+// prefix, so its value is not kept in plaintext in the Raft log
+func (command *clusterCommand) seal(dataPath string) error {
+	encryption, key := encryptionFor(filepath.Join(dataPath, command.Path))
+	if encryption == nil {
+		return nil
+	}
+	var err error
+	if command.Query, err = encryption.seal(key, command.Query); err != nil {
+		return err
+	}
+	if command.Body, err = encryption.seal(key, command.Body); err != nil {
+		return err
+	}
+	command.Sealed = true
+	return nil
+}
+
+// open returns the query and body of a command sealed or not
+func (command *clusterCommand) open(dataPath string) (string, string, error) {
+	if !command.Sealed {
+		return command.Query, command.Body, nil
+	}
+	encryption, key := encryptionFor(filepath.Join(dataPath, command.Path))
+	if encryption == nil {
+		return "", "", &requestError{http.StatusInternalServerError, "The command for '" + command.Path + "' is encrypted but encryption is not enabled."}
+	}
+	query, err := encryption.open(key, command.Query)
+	if err != nil {
+		return "", "", err
+	}
+	body, err := encryption.open(key, command.Body)
+	return query, body, err
+}
+
+// effects selects what applying a change notifies besides the data
+type effects int
+
+const (
+	// allEffects calls web hooks, publishes events and writes the audit log
+	allEffects effects = iota
+	// localEffects only publishes the change to this node's subscribers,
+	// the proposer of a command covers the rest
+	localEffects
+	// noEffects applies a change that was applied and notified before
+	noEffects
+)
+
+// effectsOf returns the effects of the change made by r, all of them for
+// changes the server makes itself
+func effectsOf(r *http.Request) effects {
+	if r == nil {
+		return allEffects
+	}
+	e, _ := r.Context().Value(effectsContextKey).(effects)
+	return e
+}
+
+// recordedResponse keeps the response of a command applied on the leader
+// until it is sent to the client
+type recordedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newRecordedResponse() *recordedResponse {
+	return &recordedResponse{header: make(http.Header), status: http.StatusOK}
+}
+
+func (r *recordedResponse) Header() http.Header {
+	return r.header
+}
+
+func (r *recordedResponse) Write(data []byte) (int, error) {
+	return r.body.Write(data)
+}
+
+func (r *recordedResponse) WriteHeader(status int) {
+	r.status = status
+}
+
+func (r *recordedResponse) writeTo(w http.ResponseWriter) {
+	for name, values := range r.header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(r.status)
+	w.Write(r.body.Bytes())
+}
+
+// requestTime returns the time a replicated command was proposed at, so
+// every node computes the same TTL deadlines, or the current time
+func requestTime(r *http.Request) time.Time {
+	if t, ok := r.Context().Value(commandContextKey).(time.Time); ok {
+		return t
+	}
+	return time.Now()
+}
+
+// isCommand reports whether r is a command applied on behalf of the
+// cluster, which was authorized when it was proposed
+func isCommand(r *http.Request) bool {
+	_, ok := r.Context().Value(commandContextKey).(time.Time)
+	return ok
+}
+
+// Cluster replicates all changes of a server through Raft. Changes are
+// sent to the leader, which commits them on a majority of nodes before
+// every node applies them in the same order.
+type Cluster struct {
+	server *Server
+	node   *raftNode
+	config ClusterConfig
+	// replayed is the last entry applied again after an interrupted apply
+	replayed uint64
+}
+
+// JoinCluster makes the server a node of a Raft cluster. Its state is
+// kept below _/system/raft, so a restarted node rejoins with its previous
+// membership.
+func (s *Server) JoinCluster(config ClusterConfig) (*Cluster, error) {
+	if config.Client == nil {
+		config.Client = &http.Client{Timeout: time.Second}
+	}
+	if config.ElectionTimeout == 0 {
+		config.ElectionTimeout = 500 * time.Millisecond
+	}
+	if config.HeartbeatInterval == 0 {
+		config.HeartbeatInterval = 100 * time.Millisecond
+	}
+	if config.CommitTimeout == 0 {
+		config.CommitTimeout = 10 * config.ElectionTimeout
+	}
+
+	node, err := newRaftNode(config.ID, s.systemPath("raft"), config.Peers)
+	if err != nil {
+		return nil, err
+	}
+	var replayed uint64
+	if node.interrupted() {
+		// the entry may have been applied already, so like a new node
+		// rebuild the keys from the full log instead of applying it twice
+		logger().Warn("Applying the Raft log was interrupted, replaying it", Fields{"index": node.state.Applying})
+		replayed = node.lastIndex()
+		if err = s.resetReplicatedKeys(); err == nil {
+			err = node.replayLog()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	c := &Cluster{server: s, node: node, config: config, replayed: replayed}
+	node.transport = c.rpc
+	node.apply = c.apply
+	node.electionTimeout = config.ElectionTimeout
+	node.heartbeatInterval = config.HeartbeatInterval
+
+	s.cluster = c
+	s.HandleSystem("raft", c.serveRaft)
+	node.start()
+	return c, nil
+}
+
+// resetReplicatedKeys removes all keys and queue sequences, the state that
+// replaying the Raft log changes other than by setting it
+func (s *Server) resetReplicatedKeys() error {
+	files, err := ioutil.ReadDir(s.dataPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, file := range files {
+		if !isReservedKey(file.Name()) {
+			if err = deleteKey(filepath.Join(s.dataPath, file.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return os.RemoveAll(s.systemPath("sequences"))
+}
+
+// Stop ends the node's participation in the cluster
+func (c *Cluster) Stop() {
+	c.node.shutdown()
+}
+
+// Status returns the node's view of the cluster
+func (c *Cluster) Status() ClusterStatus {
+	return c.node.status()
+}
+
+// AddMember adds a node to the cluster, it has to be called on the leader
+func (c *Cluster) AddMember(ctx context.Context, id string) error {
+	return c.node.changeMembers(ctx, id, true)
+}
+
+// RemoveMember removes a node from the cluster, it has to be called on the
+// leader
+func (c *Cluster) RemoveMember(ctx context.Context, id string) error {
+	return c.node.changeMembers(ctx, id, false)
+}
+
+// rpc sends a Raft request to a peer
+func (c *Cluster) rpc(peer, name string, request, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", strings.TrimSuffix(peer, "/")+"/_/raft/"+name, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.config.Token)
+	}
+
+	resp, err := c.config.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responded with %s", peer, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+// serveRaft handles the requests of the other nodes: POST /_/raft/vote and
+// POST /_/raft/append
+func (c *Cluster) serveRaft(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeJSON(w, http.StatusMethodNotAllowed, ClusterStatus{Error: "Only POST is allowed."})
+		return
+	}
+	decoder := json.NewDecoder(r.Body)
+	switch strings.Trim(strings.TrimPrefix(r.URL.Path, "/_/raft"), "/") {
+	case "vote":
+		var request raftVoteRequest
+		if err := decoder.Decode(&request); err != nil {
+			writeJSON(w, http.StatusBadRequest, ClusterStatus{Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, c.node.handleVote(request))
+	case "append":
+		var request raftAppendRequest
+		if err := decoder.Decode(&request); err != nil {
+			writeJSON(w, http.StatusBadRequest, ClusterStatus{Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, c.node.handleAppend(request))
+	default:
+		writeJSON(w, http.StatusNotFound, ClusterStatus{Error: "Unknown Raft request."})
+	}
+}
+
+// apply executes a committed command on this node. Only the proposer calls
+// web hooks and writes the audit log, and entries replayed after an
+// interrupted apply notify nothing.
+func (c *Cluster) apply(entry raftEntry) *recordedResponse {
+	command := entry.Command
+	w := newRecordedResponse()
+	query, body, err := command.open(c.server.dataPath)
+	if err != nil {
+		logger().Error("Opening a Raft command failed", Fields{"index": entry.Index, "key": command.Path, "error": err})
+		writeResponse(w, errorResponse(command.Path, err, http.StatusInternalServerError))
+		return w
+	}
+	requestURL := "/" + command.Path
+	if query != "" {
+		requestURL += "?" + query
+	}
+	r, err := http.NewRequest(command.Method, requestURL, strings.NewReader(body))
+	if err != nil {
+		writeResponse(w, ResponseData{StatusCode: http.StatusBadRequest, Key: command.Path, Error: err.Error()})
+		return w
+	}
+	if body != "" {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	e := allEffects
+	if entry.Index <= c.replayed {
+		e = noEffects
+	} else if command.Proposer != c.config.ID {
+		e = localEffects
+	}
+	ctx := context.WithValue(r.Context(), commandContextKey, command.Time)
+	r = r.WithContext(context.WithValue(ctx, effectsContextKey, e))
+	r.RemoteAddr = command.RemoteAddr
+	r = withRequestID(r, command.RequestID)
+	if command.Principal != "" {
+		r = withPrincipal(r, command.Principal)
+	}
+
+	if command.Method == "EXPIRE" {
+		c.server.removeExpired(r, command.Path, command.Time)
+	} else if isReservedKey(command.Path) {
+		c.server.serveSystem(w, r, command.Path)
+	} else {
+		c.server.serveKey(w, r, command.Path)
+	}
+	return w
+}
+
+// replicated reports whether requests to path change state kept by every
+// node, as opposed to state only the leader holds
+func replicated(path string) bool {
+	return !isReservedKey(path) || strings.HasPrefix(path, reservedPrefix+"schemas") || strings.HasPrefix(path, reservedPrefix+"secrets")
+}
+
+// leaderOnly reports whether requests to path have to be served by the
+// leader: changes, the locks and semaphores held in its memory and
+// membership changes
+func (c *Cluster) leaderOnly(r *http.Request, path string) bool {
+	changes := r.Method != "GET" && r.Method != "HEAD"
+	switch {
+	case strings.HasPrefix(path, reservedPrefix+"raft"), path == reservedPrefix+"admin/read-only":
+		return false
+	case strings.HasPrefix(path, reservedPrefix+"locks"), strings.HasPrefix(path, reservedPrefix+"semaphores"):
+		return true
+	case strings.HasPrefix(path, reservedPrefix+"admin/cluster"):
+		return changes
+	case replicated(path):
+		return changes || (!isReservedKey(path) && (c.config.LinearizableReads || r.URL.Query().Get("consistent") == "true"))
+	}
+	return false
+}
+
+// serve routes r through the cluster and reports whether it was answered.
+// Requests for the leader are forwarded to it, changes are proposed there
+// and reads wait for the changes committed before them.
+func (c *Cluster) serve(w http.ResponseWriter, r *http.Request, path string) bool {
+	if !c.leaderOnly(r, path) {
+		return false
+	}
+
+	leader := c.node.currentLeader()
+	if leader != c.config.ID {
+		c.forward(w, r, path, leader)
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), c.config.CommitTimeout)
+	defer cancel()
+	if r.Method == "GET" || r.Method == "HEAD" {
+		if err := c.node.readBarrier(ctx); err != nil {
+			writeResponse(w, errorResponse(path, commitError(err), http.StatusServiceUnavailable))
+			return true
+		}
+		return false
+	}
+	if !replicated(path) {
+		return false
+	}
+
+	r.ParseForm()
+	if !isReservedKey(path) {
+		err := c.server.authorizeChange(r, path)
+		if err == nil {
+			err = c.server.authorizeReveal(r, path)
+		}
+		if err != nil {
+			writeResponse(w, errorResponse(path, err, http.StatusForbidden))
+			return true
+		}
+	}
+	command := &clusterCommand{
+		Method:     r.Method,
+		Path:       path,
+		Query:      r.URL.RawQuery,
+		Body:       r.PostForm.Encode(),
+		Time:       time.Now(),
+		Principal:  Principal(r),
+		RemoteAddr: r.RemoteAddr,
+		RequestID:  RequestID(r),
+		Proposer:   c.config.ID,
+	}
+	if err := command.seal(c.server.dataPath); err != nil {
+		writeResponse(w, errorResponse(path, err, http.StatusInternalServerError))
+		return true
+	}
+	response, err := c.node.propose(ctx, command, nil)
+	if err != nil {
+		writeResponse(w, errorResponse(path, commitError(err), http.StatusServiceUnavailable))
+		return true
+	}
+	response.writeTo(w)
+	return true
+}
+
+// forward passes r on to the leader
+func (c *Cluster) forward(w http.ResponseWriter, r *http.Request, path, leader string) {
+	if leader == "" || r.Header.Get(forwardedHeader) != "" {
+		writeResponse(w, ResponseData{StatusCode: http.StatusServiceUnavailable, Key: path, Error: "No cluster leader elected."})
+		return
+	}
+	target, err := url.Parse(leader)
+	if err != nil {
+		writeResponse(w, ResponseData{StatusCode: http.StatusInternalServerError, Key: path, Error: err.Error()})
+		return
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = c.config.Client.Transport
+	proxy.FlushInterval = -1
+	r.Header.Set(forwardedHeader, c.config.ID)
+	// the leader answers with the same request ID
+	r.Header.Set(RequestIDHeader, RequestID(r))
+	w.Header().Del(RequestIDHeader)
+	proxy.ServeHTTP(w, r)
+}
+
+// commitError explains the end of the commit timeout to the client
+func commitError(err error) error {
+	if err == context.DeadlineExceeded {
+		return errCommitTimeout
+	}
+	return err
+}
+
+// expire proposes the expiry of key, nodes other than the leader check
+// again later in case they become the leader
+func (c *Cluster) expire(key string, deadline time.Time) {
+	command := &clusterCommand{Method: "EXPIRE", Path: key, Time: deadline, Proposer: c.config.ID}
+	ctx, cancel := context.WithTimeout(context.Background(), c.config.CommitTimeout)
+	defer cancel()
+	if _, err := c.node.propose(ctx, command, nil); err == nil {
+		return
+	}
+	time.AfterFunc(c.config.ElectionTimeout, func() {
+		if c.server.expiries.pending(key, deadline) {
+			c.expire(key, deadline)
+		}
+	})
+}
+
+// serveCluster handles /_/admin/cluster: GET shows the cluster status, POST
+// /_/admin/cluster/members with 'id' adds a member and DELETE removes it
+func (c *Cluster) serveCluster(w http.ResponseWriter, r *http.Request, path string) {
+	if path == "cluster" && r.Method == "GET" {
+		writeJSON(w, http.StatusOK, c.Status())
+		return
+	}
+	if path != "cluster/members" || (r.Method != "POST" && r.Method != "PUT" && r.Method != "DELETE") {
+		writeJSON(w, http.StatusMethodNotAllowed, ClusterStatus{Error: "Method not allowed."})
+		return
+	}
+
+	id := r.Form.Get("id")
+	if _, err := url.Parse(id); err != nil || id == "" {
+		writeJSON(w, http.StatusBadRequest, ClusterStatus{Error: "Parameter 'id' must be the URL of the member."})
+		return
+	}
+	var err error
+	if r.Method == "DELETE" {
+		err = c.RemoveMember(r.Context(), id)
+	} else {
+		err = c.AddMember(r.Context(), id)
+	}
+	if err != nil {
+		responseData := errorResponse("", err, http.StatusInternalServerError)
+		writeJSON(w, responseData.StatusCode, ClusterStatus{Error: responseData.Error})
+		return
+	}
+	writeJSON(w, http.StatusOK, c.Status())
+}
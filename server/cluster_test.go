@@ -0,0 +1,416 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testNode struct {
+	dir     string
+	id      string
+	server  *Server
+	cluster *Cluster
+	http    *httptest.Server
+}
+
+// startTestNode runs a cluster node on a loopback port, reusing the
+// address and directory of node if given
+func startTestNode(t *testing.T, node *testNode) *testNode {
+	if node == nil {
+		dir, err := ioutil.TempDir("", "")
+		assert.Nil(t, err)
+		node = &testNode{dir: dir}
+		node.http = httptest.NewUnstartedServer(nil)
+		node.id = "http://" + node.http.Listener.Addr().String()
+	} else {
+		listener, err := listenAgain(node.id)
+		assert.Nil(t, err)
+		node.http = httptest.NewUnstartedServer(nil)
+		node.http.Listener.Close()
+		node.http.Listener = listener
+	}
+	node.server = NewServer(node.dir, nil, nil)
+	node.http.Config.Handler = node.server
+	return node
+}
+
+func (node *testNode) join(t *testing.T, peers []string) {
+	var err error
+	node.cluster, err = node.server.JoinCluster(ClusterConfig{
+		ID:                node.id,
+		Peers:             peers,
+		ElectionTimeout:   150 * time.Millisecond,
+		HeartbeatInterval: 30 * time.Millisecond,
+	})
+	assert.Nil(t, err)
+	node.http.Start()
+}
+
+func (node *testNode) stop() {
+	node.cluster.Stop()
+	node.http.Close()
+}
+
+func (node *testNode) send(method, key string, vals url.Values) (int, ResponseData) {
+	var req *http.Request
+	if method == "PUT" || method == "POST" {
+		req, _ = http.NewRequest(method, node.id+"/"+key, strings.NewReader(vals.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		req, _ = http.NewRequest(method, node.id+"/"+key+"?"+vals.Encode(), nil)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, ResponseData{}
+	}
+	defer resp.Body.Close()
+	var data ResponseData
+	json.NewDecoder(resp.Body).Decode(&data)
+	return resp.StatusCode, data
+}
+
+func startTestCluster(t *testing.T, size int) []*testNode {
+	nodes := []*testNode{}
+	peers := []string{}
+	for i := 0; i < size; i++ {
+		node := startTestNode(t, nil)
+		nodes = append(nodes, node)
+		peers = append(peers, node.id)
+	}
+	for _, node := range nodes {
+		node.join(t, peers)
+	}
+	return nodes
+}
+
+func clusterLeader(t *testing.T, nodes []*testNode) *testNode {
+	var leader *testNode
+	waitFor(t, func() bool {
+		leader = nil
+		for _, node := range nodes {
+			if node.cluster.Status().Role == raftLeader {
+				leader = node
+			}
+		}
+		if leader == nil {
+			return false
+		}
+		for _, node := range nodes {
+			if node.cluster.Status().Leader != leader.id {
+				return false
+			}
+		}
+		return true
+	})
+	return leader
+}
+
+func followers(nodes []*testNode, leader *testNode) []*testNode {
+	result := []*testNode{}
+	for _, node := range nodes {
+		if node != leader {
+			result = append(result, node)
+		}
+	}
+	return result
+}
+
+func localValue(node *testNode, key string) string {
+	entry, err := readKey(node.dir+"/"+key, false)
+	if err != nil || entry.isNamespace {
+		return ""
+	}
+	return entry.data[0]
+}
+
+func TestClusterReplicatesWrites(t *testing.T) {
+	nodes := startTestCluster(t, 3)
+	for _, node := range nodes {
+		defer os.RemoveAll(node.dir)
+		defer node.stop()
+	}
+	leader := clusterLeader(t, nodes)
+	follower := followers(nodes, leader)[0]
+
+	// changes sent to a follower are forwarded to the leader
+	status, data := follower.send("PUT", "config/a", url.Values{"value": {"1"}})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "config/a", data.Key)
+	status, _ = follower.send("PUT", "config/a", url.Values{"value": {"2"}, "prevValue": {"0"}})
+	assert.Equal(t, http.StatusPreconditionFailed, status)
+	status, data = follower.send("POST", "counter", url.Values{"op": {"incr"}, "init": {"10"}})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "11", data.Value)
+	status, _ = leader.send("PUT", "_/schemas/ports", url.Values{"rule": {`{"type":"int"}`}})
+	assert.Equal(t, http.StatusOK, status)
+
+	for _, node := range nodes {
+		waitFor(t, func() bool { return localValue(node, "config/a") == "1" && localValue(node, "counter") == "11" })
+		status, _ = node.send("PUT", "ports/http", url.Values{"value": {"eighty"}})
+		assert.Equal(t, http.StatusUnprocessableEntity, status)
+	}
+
+	// consistent reads go through the leader
+	status, data = follower.send("GET", "config/a", url.Values{"consistent": {"true"}})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "1", data.Value)
+
+	// keys expire on all nodes
+	status, _ = follower.send("PUT", "session", url.Values{"value": {"x"}, "ttl": {"0.2"}})
+	assert.Equal(t, http.StatusOK, status)
+	for _, node := range nodes {
+		waitFor(t, func() bool { return localValue(node, "session") == "" })
+	}
+}
+
+func TestClusterFailoverAndRejoin(t *testing.T) {
+	nodes := startTestCluster(t, 3)
+	for _, node := range nodes {
+		defer os.RemoveAll(node.dir)
+	}
+	leader := clusterLeader(t, nodes)
+	status, _ := leader.send("PUT", "a", url.Values{"value": {"1"}})
+	assert.Equal(t, http.StatusOK, status)
+
+	leader.stop()
+	rest := followers(nodes, leader)
+	newLeader := clusterLeader(t, rest)
+	status, _ = rest[0].send("PUT", "b", url.Values{"value": {"2"}})
+	assert.Equal(t, http.StatusOK, status)
+
+	// the old leader restarts with its directory and catches up
+	restarted := startTestNode(t, leader)
+	restarted.join(t, nil)
+	nodes = append(rest, restarted)
+	defer func() {
+		for _, node := range nodes {
+			node.stop()
+		}
+	}()
+	waitFor(t, func() bool { return localValue(restarted, "b") == "2" })
+	assert.Equal(t, newLeader.id, clusterLeader(t, nodes).id)
+}
+
+func TestClusterMembership(t *testing.T) {
+	nodes := startTestCluster(t, 3)
+	for _, node := range nodes {
+		defer os.RemoveAll(node.dir)
+	}
+	defer func() {
+		for _, node := range nodes {
+			node.stop()
+		}
+	}()
+	leader := clusterLeader(t, nodes)
+	status, _ := leader.send("PUT", "a", url.Values{"value": {"1"}})
+	assert.Equal(t, http.StatusOK, status)
+
+	joining := startTestNode(t, nil)
+	defer os.RemoveAll(joining.dir)
+	joining.join(t, nil)
+	nodes = append(nodes, joining)
+	status, _ = followers(nodes, leader)[0].send("POST", "_/admin/cluster/members", url.Values{"id": {joining.id}})
+	assert.Equal(t, http.StatusOK, status)
+	waitFor(t, func() bool { return localValue(joining, "a") == "1" })
+	assert.Equal(t, 4, len(joining.cluster.Status().Members))
+
+	status, _ = joining.send("DELETE", "_/admin/cluster/members", url.Values{"id": {joining.id}})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 3, len(leader.cluster.Status().Members))
+}
+
+func listenAgain(id string) (net.Listener, error) {
+	return net.Listen("tcp", strings.TrimPrefix(id, "http://"))
+}
+
+func TestClusterRecoversInterruptedApply(t *testing.T) {
+	node := startTestCluster(t, 1)[0]
+	defer os.RemoveAll(node.dir)
+	clusterLeader(t, []*testNode{node})
+	for i := 0; i < 2; i++ {
+		status, _ := node.send("POST", "n", url.Values{"op": {"incr"}})
+		assert.Equal(t, http.StatusOK, status)
+	}
+	status, _ := node.send("POST", "q", url.Values{"op": {"push"}, "value": {"x"}})
+	assert.Equal(t, http.StatusOK, status)
+	node.stop()
+
+	// pretend the node crashed after applying the push, before saving it
+	statePath := node.server.systemPath("raft/state.json")
+	var state raftState
+	content, err := ioutil.ReadFile(statePath)
+	assert.Nil(t, err)
+	assert.Nil(t, json.Unmarshal(content, &state))
+	state.Applying = state.Applied
+	state.Applied--
+	content, _ = json.Marshal(state)
+	assert.Nil(t, ioutil.WriteFile(statePath, content, 0644))
+
+	restarted := startTestNode(t, node)
+	restarted.join(t, nil)
+	defer restarted.stop()
+	waitFor(t, func() bool {
+		status := restarted.cluster.Status()
+		return status.Applied == status.CommitIndex && status.Applied > state.Applied
+	})
+	assert.Equal(t, "2", localValue(restarted, "n"))
+	files, err := ioutil.ReadDir(node.dir + "/q")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(files))
+}
+
+func TestClusterNotifiesChangesOnce(t *testing.T) {
+	var calls int32
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	}))
+	defer hook.Close()
+	notifying := func(node *testNode) *testNode {
+		node.server.webHookURLs = []string{hook.URL}
+		_, err := node.server.EnableAudit(AuditConfig{Path: node.dir + ".audit", MaxSize: 1 << 20})
+		assert.Nil(t, err)
+		return node
+	}
+	audited := func(node *testNode) int {
+		entries, err := readAuditFile(node.dir + ".audit")
+		assert.Nil(t, err)
+		return len(entries)
+	}
+	caughtUp := func(nodes []*testNode) func() bool {
+		return func() bool {
+			for _, node := range nodes {
+				status := node.cluster.Status()
+				if status.CommitIndex == 0 || status.Applied < status.CommitIndex {
+					return false
+				}
+			}
+			return pendingHookCount() == 0
+		}
+	}
+
+	nodes := []*testNode{}
+	peers := []string{}
+	for i := 0; i < 3; i++ {
+		node := notifying(startTestNode(t, nil))
+		defer os.RemoveAll(node.dir)
+		defer os.Remove(node.dir + ".audit")
+		nodes = append(nodes, node)
+		peers = append(peers, node.id)
+	}
+	for _, node := range nodes {
+		node.join(t, peers)
+	}
+	leader := clusterLeader(t, nodes)
+	status, _ := leader.send("PUT", "k", url.Values{"value": {"v"}})
+	assert.Equal(t, http.StatusOK, status)
+	waitFor(t, func() bool {
+		for _, node := range nodes {
+			if localValue(node, "k") != "v" {
+				return false
+			}
+		}
+		return caughtUp(nodes)()
+	})
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	assert.Equal(t, []int{1, 0, 0}, []int{audited(leader), audited(followers(nodes, leader)[0]), audited(followers(nodes, leader)[1])})
+
+	// replaying the log after an interrupted apply notifies nothing again
+	leader.stop()
+	statePath := leader.server.systemPath("raft/state.json")
+	var state raftState
+	content, err := ioutil.ReadFile(statePath)
+	assert.Nil(t, err)
+	assert.Nil(t, json.Unmarshal(content, &state))
+	state.Applying = state.Applied
+	state.Applied--
+	content, _ = json.Marshal(state)
+	assert.Nil(t, ioutil.WriteFile(statePath, content, 0644))
+
+	restarted := notifying(startTestNode(t, leader))
+	restarted.join(t, nil)
+	nodes = append(followers(nodes, leader), restarted)
+	for _, node := range nodes {
+		defer node.stop()
+	}
+	waitFor(t, caughtUp(nodes))
+	assert.Equal(t, "v", localValue(restarted, "k"))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	assert.Equal(t, 1, audited(restarted))
+}
+
+func TestClusterAnswersWithoutMajority(t *testing.T) {
+	nodes := startTestCluster(t, 3)
+	for _, node := range nodes {
+		defer os.RemoveAll(node.dir)
+	}
+	leader := clusterLeader(t, nodes)
+	defer leader.stop()
+	for _, node := range followers(nodes, leader) {
+		node.stop()
+	}
+
+	start := time.Now()
+	status, data := leader.send("PUT", "k", url.Values{"value": {"v"}})
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, errCommitTimeout.message, data.Error)
+	assert.True(t, time.Since(start) < 3*time.Second)
+}
+
+func TestClusterKeepsEncryptedValuesOutOfTheLog(t *testing.T) {
+	keyDir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(keyDir)
+	keyFile := keyDir + "/keys"
+	assert.Nil(t, ioutil.WriteFile(keyFile, []byte(encryptionKeyLine("k1")), 0600))
+
+	nodes := []*testNode{}
+	peers := []string{}
+	for i := 0; i < 3; i++ {
+		node := startTestNode(t, nil)
+		defer os.RemoveAll(node.dir)
+		_, err = node.server.EncryptAtRest(EncryptionConfig{KeyFile: keyFile, Prefixes: []string{"secrets"}})
+		assert.Nil(t, err)
+		nodes = append(nodes, node)
+		peers = append(peers, node.id)
+	}
+	for _, node := range nodes {
+		node.join(t, peers)
+		defer node.stop()
+	}
+	leader := clusterLeader(t, nodes)
+	status, _ := leader.send("PUT", "secrets/pw", url.Values{"value": {"plain-password"}})
+	assert.Equal(t, http.StatusOK, status)
+	status, _ = leader.send("POST", "secrets/q", url.Values{"op": {"push"}, "value": {"plain-item"}})
+	assert.Equal(t, http.StatusOK, status)
+	status, _ = leader.send("DELETE", "secrets/pw", url.Values{"prevValue": {"plain-password"}})
+	assert.Equal(t, http.StatusOK, status)
+
+	for _, node := range nodes {
+		var items []os.FileInfo
+		waitFor(t, func() bool {
+			items, _ = ioutil.ReadDir(node.dir + "/secrets/q")
+			code, _ := getValue(node.server, "secrets/pw")
+			return len(items) == 1 && code == http.StatusNotFound
+		})
+		if len(items) == 1 {
+			_, value := getValue(node.server, "secrets/q/"+items[0].Name())
+			assert.Equal(t, "plain-item", value)
+		}
+		log, err := ioutil.ReadFile(node.server.systemPath("raft/log.jsonl"))
+		assert.Nil(t, err)
+		assert.Contains(t, string(log), `"sealed":true`)
+		assert.NotContains(t, string(log), "plain-password")
+		assert.NotContains(t, string(log), "plain-item")
+	}
+}
@@ -0,0 +1,13 @@
+package server
+
+import "syscall"
+
+// freeBytes returns the bytes available to unprivileged users on the file
+// system holding path
+func freeBytes(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import "errors"
+
+func freeBytes(path string) (uint64, error) {
+	return 0, errors.New("checking free disk space is only supported on linux")
+}
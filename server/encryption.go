@@ -0,0 +1,361 @@
+package server
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// sealedPrefix starts every encrypted value on disk, followed by the id of
+// the key and the base64 encoded nonce and ciphertext
+const sealedPrefix = "skvs:enc:v1:"
+
+// encryptions holds the encryption of each data path, files are encrypted
+// and decrypted wherever they are read or written
+var encryptions = make(map[string]*Encryption)
+var encryptionsMutex sync.RWMutex
+
+// EncryptionConfig configures encryption at rest
+type EncryptionConfig struct {
+	// KeyFile has one '<id>:<base64 of 32 bytes>' per line, the last key
+	// encrypts and all of them decrypt
+	KeyFile string
+	// Prefixes are the namespaces or keys whose values are encrypted
+	Prefixes []string
+	// CachePlaintext allows the cache to keep decrypted values, otherwise
+	// encrypted keys are not cached
+	CachePlaintext bool
+}
+
+// EncryptionStatus shows the key values are encrypted with and whether
+// values are being re-encrypted
+type EncryptionStatus struct {
+	Key          string   `json:"key"`
+	Prefixes     []string `json:"prefixes"`
+	Reencrypting bool     `json:"reencrypting"`
+	Reencrypted  int      `json:"reencrypted"`
+	Error        string   `json:"error,omitempty"`
+}
+
+// Encryption encrypts the values below configured prefixes with AES-GCM.
+// After the current key changed, values are re-encrypted in the background.
+type Encryption struct {
+	server         *Server
+	keyFile        string
+	prefixes       []string
+	cachePlaintext bool
+	wake           chan struct{}
+
+	mutex       sync.RWMutex
+	keys        map[string]cipher.AEAD
+	current     string
+	requested   int
+	done        int
+	reencrypted int
+	lastError   error
+}
+
+// EncryptAtRest encrypts the values below config.Prefixes. Values stored
+// in plaintext before are encrypted in the background.
+func (s *Server) EncryptAtRest(config EncryptionConfig) (*Encryption, error) {
+	e := &Encryption{
+		server:         s,
+		keyFile:        config.KeyFile,
+		cachePlaintext: config.CachePlaintext,
+		wake:           make(chan struct{}, 1),
+	}
+	for _, prefix := range config.Prefixes {
+		e.prefixes = append(e.prefixes, strings.Trim(prefix, "/"))
+	}
+	if err := e.loadKeys(); err != nil {
+		return nil, err
+	}
+
+	encryptionsMutex.Lock()
+	encryptions[filepath.Clean(s.dataPath)] = e
+	encryptionsMutex.Unlock()
+	s.encryption = e
+	for _, prefix := range e.prefixes {
+		invalidateCache(filepath.Join(s.dataPath, prefix))
+	}
+
+	go e.reencryptOnRequest()
+	e.requestReencryption()
+	return e, nil
+}
+
+// Reload reads the key file again, on failure the previous keys are kept.
+// If the last key changed, all values are re-encrypted with it.
+func (e *Encryption) Reload() error {
+	e.mutex.RLock()
+	previous := e.current
+	e.mutex.RUnlock()
+	if err := e.loadKeys(); err != nil {
+		return err
+	}
+	e.mutex.RLock()
+	rotated := e.current != previous
+	e.mutex.RUnlock()
+	if rotated {
+		e.requestReencryption()
+	}
+	return nil
+}
+
+func (e *Encryption) loadKeys() error {
+	f, err := os.Open(e.keyFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	keys := map[string]cipher.AEAD{}
+	current := ""
+	scanner := bufio.NewScanner(f)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("%s:%d: expected 'id:base64-key'", e.keyFile, number)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(parts[1]))
+		if err != nil || len(key) != 32 {
+			return fmt.Errorf("%s:%d: not a base64 encoded 256 bit key", e.keyFile, number)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return err
+		}
+		current = strings.TrimSpace(parts[0])
+		if keys[current], err = cipher.NewGCM(block); err != nil {
+			return err
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	if current == "" {
+		return fmt.Errorf("%s: no key", e.keyFile)
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.keys = keys
+	e.current = current
+	return nil
+}
+
+// Status reports the current key and the progress of re-encryption
+func (e *Encryption) Status() EncryptionStatus {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	status := EncryptionStatus{
+		Key:          e.current,
+		Prefixes:     e.prefixes,
+		Reencrypting: e.done < e.requested,
+		Reencrypted:  e.reencrypted,
+	}
+	if e.lastError != nil {
+		status.Error = e.lastError.Error()
+	}
+	return status
+}
+
+// covers reports whether the value of key is encrypted
+func (e *Encryption) covers(key string) bool {
+	for _, prefix := range e.prefixes {
+		if matchesPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// encryptionFor returns the encryption covering the file at path and the
+// key of the file
+func encryptionFor(path string) (*Encryption, string) {
+	encryptionsMutex.RLock()
+	defer encryptionsMutex.RUnlock()
+	if len(encryptions) == 0 {
+		return nil, ""
+	}
+	for root, e := range encryptions {
+		if key, err := filepath.Rel(root, path); err == nil && !strings.HasPrefix(key, "..") {
+			key = filepath.ToSlash(key)
+			if e.covers(key) {
+				return e, key
+			}
+			return nil, ""
+		}
+	}
+	return nil, ""
+}
+
+// seal encrypts value with the current key. The key name is authenticated
+// along with it, so values cannot be moved to other keys.
+func (e *Encryption) seal(key, value string) (string, error) {
+	e.mutex.RLock()
+	id, aead := e.current, e.keys[e.current]
+	e.mutex.RUnlock()
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(value), []byte(key))
+	return sealedPrefix + id + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// open decrypts content if it is sealed and returns it unchanged otherwise
+func (e *Encryption) open(key, content string) (string, error) {
+	id, ok := sealedWith(content)
+	if !ok {
+		return content, nil
+	}
+	e.mutex.RLock()
+	aead, known := e.keys[id]
+	e.mutex.RUnlock()
+	if !known {
+		return "", &requestError{http.StatusInternalServerError, "'" + key + "' is encrypted with the unknown key '" + id + "'."}
+	}
+	sealed, err := base64.StdEncoding.DecodeString(content[len(sealedPrefix)+len(id)+1:])
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", &requestError{http.StatusInternalServerError, "'" + key + "' is not a valid encrypted value."}
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(key))
+	if err != nil {
+		return "", &requestError{http.StatusInternalServerError, "Decrypting '" + key + "' failed."}
+	}
+	return string(plaintext), nil
+}
+
+// sealedWith returns the id of the key content was sealed with
+func sealedWith(content string) (string, bool) {
+	if !strings.HasPrefix(content, sealedPrefix) {
+		return "", false
+	}
+	parts := strings.SplitN(content[len(sealedPrefix):], ":", 2)
+	return parts[0], len(parts) == 2
+}
+
+// prepare returns what to write to disk for value and its plaintext. Values
+// already sealed, e.g. replicated from a primary, are written unchanged.
+func (e *Encryption) prepare(key, value string) (string, string, error) {
+	if _, ok := sealedWith(value); ok {
+		plaintext, err := e.open(key, value)
+		return value, plaintext, err
+	}
+	content, err := e.seal(key, value)
+	return content, value, err
+}
+
+func (e *Encryption) requestReencryption() {
+	e.mutex.Lock()
+	e.requested++
+	e.mutex.Unlock()
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (e *Encryption) reencryptOnRequest() {
+	for range e.wake {
+		e.mutex.Lock()
+		requested := e.requested
+		e.mutex.Unlock()
+
+		count, err := e.reencrypt()
+		if err == errReadOnly {
+			// continued once the server accepts changes again
+			e.mutex.Lock()
+			e.reencrypted += count
+			e.mutex.Unlock()
+			continue
+		}
+		if err != nil {
+			logger().Error("Re-encrypting failed", Fields{"error": err})
+		}
+		e.mutex.Lock()
+		e.done = requested
+		e.reencrypted += count
+		e.lastError = err
+		e.mutex.Unlock()
+	}
+}
+
+// reencrypt seals all values below the prefixes that are in plaintext or
+// sealed with another than the current key. It stops with errReadOnly
+// when the server becomes read-only.
+func (e *Encryption) reencrypt() (int, error) {
+	count := 0
+	var failed error
+	for _, prefix := range e.prefixes {
+		err := filepath.Walk(filepath.Join(e.server.dataPath, prefix), func(path string, info os.FileInfo, err error) error {
+			if e.server.ReadOnly() {
+				return errReadOnly
+			}
+			if err != nil || info.IsDir() {
+				return nil
+			}
+			key, _ := filepath.Rel(e.server.dataPath, path)
+			key = filepath.ToSlash(key)
+			if isReservedKey(key) {
+				return nil
+			}
+			changed, err := e.reencryptFile(key, path)
+			if err != nil {
+				failed = err
+			} else if changed {
+				count++
+			}
+			return nil
+		})
+		if err == errReadOnly {
+			return count, err
+		}
+	}
+	return count, failed
+}
+
+func (e *Encryption) reencryptFile(key, path string) (bool, error) {
+	defer e.server.changing()()
+	unlock := lockPath(path)
+	defer unlock()
+
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	e.mutex.RLock()
+	current := e.current
+	e.mutex.RUnlock()
+	if id, ok := sealedWith(string(content)); ok && id == current {
+		return false, nil
+	}
+
+	plaintext, err := e.open(key, string(content))
+	if err != nil {
+		return false, err
+	}
+	sealed, err := e.seal(key, plaintext)
+	if err != nil {
+		return false, err
+	}
+	err = writeFileAtomic(path, []byte(sealed))
+	invalidateCache(path)
+	return err == nil, err
+}
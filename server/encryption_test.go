@@ -0,0 +1,123 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func encryptionKeyLine(id string) string {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return id + ":" + base64.StdEncoding.EncodeToString(key) + "\n"
+}
+
+func getValue(s *Server, key string) (int, string) {
+	req, _ := http.NewRequest("GET", "http://localhost/"+key, nil)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	var data ResponseData
+	json.Unmarshal(w.Body.Bytes(), &data)
+	return w.Code, data.Value
+}
+
+func rawValue(t *testing.T, dataPath, key string) string {
+	content, err := ioutil.ReadFile(filepath.Join(dataPath, key))
+	assert.Nil(t, err)
+	return string(content)
+}
+
+func TestEncryptionAtRest(t *testing.T) {
+	dataPath, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dataPath)
+	keyFile := filepath.Join(dataPath, "keys")
+	assert.Nil(t, ioutil.WriteFile(keyFile, []byte("# keys\n"+encryptionKeyLine("k1")), 0600))
+	assert.Nil(t, putKey(filepath.Join(dataPath, "secrets/old"), false, "p0"))
+
+	s := NewServer(dataPath, nil, nil)
+	_, err = s.EncryptAtRest(EncryptionConfig{KeyFile: filepath.Join(dataPath, "missing")})
+	assert.NotNil(t, err)
+	encryption, err := s.EncryptAtRest(EncryptionConfig{KeyFile: keyFile, Prefixes: []string{"/secrets/"}})
+	assert.Nil(t, err)
+
+	// values stored before are encrypted in the background
+	waitFor(t, func() bool { return !encryption.Status().Reencrypting })
+	assert.Equal(t, 1, encryption.Status().Reencrypted)
+	assert.True(t, strings.HasPrefix(rawValue(t, dataPath, "secrets/old"), sealedPrefix+"k1:"))
+	status, value := getValue(s, "secrets/old")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "p0", value)
+
+	assert.Equal(t, http.StatusOK, sendRequest(s.ServeHTTP, "PUT", "secrets/db", url.Values{"value": {"password"}}))
+	assert.Equal(t, http.StatusOK, sendRequest(s.ServeHTTP, "PUT", "plain", url.Values{"value": {"password"}}))
+	assert.NotContains(t, rawValue(t, dataPath, "secrets/db"), "password")
+	assert.Equal(t, "password", rawValue(t, dataPath, "plain"))
+	_, value = getValue(s, "secrets/db")
+	assert.Equal(t, "password", value)
+	_, cached := cacheLookup(filepath.Join(dataPath, "secrets/db"))
+	assert.False(t, cached)
+
+	// operations see the plaintext
+	assert.Equal(t, http.StatusOK, sendRequest(s.ServeHTTP, "PUT", "secrets/db", url.Values{"value": {"new"}, "prevValue": {"password"}}))
+	assert.Equal(t, http.StatusOK, sendRequest(s.ServeHTTP, "POST", "secrets/n", url.Values{"op": {"incr"}, "init": {"41"}}))
+	_, value = getValue(s, "secrets/n")
+	assert.Equal(t, "42", value)
+
+	// a value moved to another key does not decrypt
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dataPath, "secrets/moved"), []byte(rawValue(t, dataPath, "secrets/db")), 0644))
+	status, _ = getValue(s, "secrets/moved")
+	assert.Equal(t, http.StatusInternalServerError, status)
+	os.Remove(filepath.Join(dataPath, "secrets/moved"))
+
+	// rotating re-encrypts all values with the new key
+	f, _ := os.OpenFile(keyFile, os.O_APPEND|os.O_WRONLY, 0600)
+	f.WriteString(encryptionKeyLine("k2"))
+	f.Close()
+	assert.Nil(t, encryption.Reload())
+	waitFor(t, func() bool { return !encryption.Status().Reencrypting })
+	assert.Equal(t, "k2", encryption.Status().Key)
+	for _, key := range []string{"secrets/old", "secrets/db", "secrets/n"} {
+		assert.True(t, strings.HasPrefix(rawValue(t, dataPath, key), sealedPrefix+"k2:"))
+	}
+	_, value = getValue(s, "secrets/db")
+	assert.Equal(t, "new", value)
+
+	req, _ := http.NewRequest("GET", "http://localhost/_/admin/encryption", nil)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"key":"k2"`)
+}
+
+func TestEncryptionPassesSealedValues(t *testing.T) {
+	dataPath, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dataPath)
+	keyFile := filepath.Join(dataPath, "keys")
+	assert.Nil(t, ioutil.WriteFile(keyFile, []byte(encryptionKeyLine("k1")), 0600))
+
+	s := NewServer(dataPath, nil, nil)
+	encryption, err := s.EncryptAtRest(EncryptionConfig{KeyFile: keyFile, Prefixes: []string{"secrets"}, CachePlaintext: true})
+	assert.Nil(t, err)
+	sealed, err := encryption.seal("secrets/a", "x")
+	assert.Nil(t, err)
+
+	// a replicated value is stored as it is
+	keyPath := filepath.Join(dataPath, "secrets/a")
+	assert.Nil(t, putKey(keyPath, false, sealed))
+	assert.Equal(t, sealed, rawValue(t, dataPath, "secrets/a"))
+	entry, cached := cacheLookup(keyPath)
+	assert.True(t, cached)
+	assert.Equal(t, []string{"x"}, entry.data)
+}
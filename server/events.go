@@ -0,0 +1,135 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// number of events buffered per subscriber, a subscriber falling further
+// behind is dropped
+const subscriberBacklog = 256
+
+// Event describes a change of a key
+type Event struct {
+	Key    string `json:"key"`
+	Action string `json:"action"`
+}
+
+type subscription struct {
+	prefix string
+	events chan Event
+}
+
+// changeFeed distributes the changes of one data path to its subscribers
+type changeFeed struct {
+	mutex       sync.Mutex
+	subscribers map[*subscription]struct{}
+}
+
+var changeFeeds = make(map[string]*changeFeed)
+var changeFeedsMutex sync.Mutex
+
+func feedFor(dataPath string) *changeFeed {
+	changeFeedsMutex.Lock()
+	defer changeFeedsMutex.Unlock()
+	feed, ok := changeFeeds[dataPath]
+	if !ok {
+		feed = &changeFeed{subscribers: make(map[*subscription]struct{})}
+		changeFeeds[dataPath] = feed
+	}
+	return feed
+}
+
+// size returns the number of subscribers
+func (feed *changeFeed) size() int {
+	feed.mutex.Lock()
+	defer feed.mutex.Unlock()
+	return len(feed.subscribers)
+}
+
+// report whether key is prefix or lies below it
+func matchesPrefix(key, prefix string) bool {
+	return prefix == "" || key == prefix || strings.HasPrefix(key, prefix+"/")
+}
+
+// send an event to all subscribers of dataPath interested in key
+func publishChange(dataPath, key, action string) {
+	feed := feedFor(dataPath)
+	feed.mutex.Lock()
+	defer feed.mutex.Unlock()
+
+	event := Event{Key: key, Action: action}
+	for sub := range feed.subscribers {
+		if !matchesPrefix(key, sub.prefix) {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			delete(feed.subscribers, sub)
+			close(sub.events)
+		}
+	}
+}
+
+// subscribe to the changes of all keys below prefix, the events channel is
+// closed when the subscriber falls behind or unsubscribes
+func subscribeChanges(dataPath, prefix string) *subscription {
+	feed := feedFor(dataPath)
+	feed.mutex.Lock()
+	defer feed.mutex.Unlock()
+	sub := &subscription{prefix: prefix, events: make(chan Event, subscriberBacklog)}
+	feed.subscribers[sub] = struct{}{}
+	return sub
+}
+
+func unsubscribeChanges(dataPath string, sub *subscription) {
+	feed := feedFor(dataPath)
+	feed.mutex.Lock()
+	defer feed.mutex.Unlock()
+	if _, ok := feed.subscribers[sub]; ok {
+		delete(feed.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+// serveEvents streams changes below the 'prefix' parameter as one JSON
+// object per line until the client goes away
+func (s *Server) serveEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeResponse(w, ResponseData{StatusCode: http.StatusMethodNotAllowed, Key: r.URL.Path[1:], Error: "Only GET is allowed."})
+		return
+	}
+
+	sub := subscribeChanges(s.dataPath, strings.Trim(r.URL.Query().Get("prefix"), "/"))
+	defer unsubscribeChanges(s.dataPath, sub)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case event, ok := <-sub.events:
+			if !ok {
+				return
+			}
+			if err := encoder.Encode(event); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-r.Context().Done():
+			return
+		case <-s.draining:
+			return
+		}
+	}
+}
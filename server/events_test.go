@@ -0,0 +1,61 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublishChangeMatchesPrefix(t *testing.T) {
+	sub := subscribeChanges(testDataPath, "foo")
+	defer unsubscribeChanges(testDataPath, sub)
+
+	publishChange(testDataPath, "foobar", "PUT")
+	publishChange(testDataPath, "foo/bar", "PUT")
+	publishChange(testDataPath, "foo", "DELETE")
+	publishChange("/elsewhere", "foo", "PUT")
+
+	assert.Equal(t, Event{Key: "foo/bar", Action: "PUT"}, <-sub.events)
+	assert.Equal(t, Event{Key: "foo", Action: "DELETE"}, <-sub.events)
+	assert.Len(t, sub.events, 0)
+}
+
+func TestSlowSubscriberIsDropped(t *testing.T) {
+	sub := subscribeChanges(testDataPath, "")
+	for i := 0; i <= subscriberBacklog; i++ {
+		publishChange(testDataPath, "foo", "PUT")
+	}
+	for i := 0; i < subscriberBacklog; i++ {
+		<-sub.events
+	}
+	_, ok := <-sub.events
+	assert.False(t, ok)
+	unsubscribeChanges(testDataPath, sub)
+}
+
+func TestHTTPEvents(t *testing.T) {
+	cleanData()
+	srv := httptest.NewServer(NewServerHandler(testDataPath, nil, nil))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/_/events?prefix=foo")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	_, err = http.PostForm(srv.URL+"/other", url.Values{"value": {"x"}})
+	assert.Nil(t, err)
+	_, err = http.PostForm(srv.URL+"/foo/bar", url.Values{"value": {"x"}})
+	assert.Nil(t, err)
+
+	var event Event
+	line, err := bufio.NewReader(resp.Body).ReadBytes('\n')
+	assert.Nil(t, err)
+	assert.Nil(t, json.Unmarshal(line, &event))
+	assert.Equal(t, Event{Key: "foo/bar", Action: "POST"}, event)
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// expiryRegistry removes keys written with a TTL once it has passed. The
+// deadlines are persisted, so keys also expire across restarts.
+type expiryRegistry struct {
+	mutex     sync.Mutex
+	path      string
+	deadlines map[string]time.Time
+	timers    map[string]*time.Timer
+	expire    func(key string, deadline time.Time)
+}
+
+func loadExpiryRegistry(path string, expire func(key string, deadline time.Time)) (*expiryRegistry, error) {
+	registry := &expiryRegistry{
+		path:      path,
+		deadlines: make(map[string]time.Time),
+		timers:    make(map[string]*time.Timer),
+		expire:    expire,
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return registry, nil
+	} else if err != nil {
+		return registry, err
+	}
+	err = json.Unmarshal(content, &registry.deadlines)
+	return registry, err
+}
+
+// start schedules the expiries loaded from disk
+func (registry *expiryRegistry) start() {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	for key, deadline := range registry.deadlines {
+		registry.schedule(key, deadline)
+	}
+}
+
+// schedule must be called with the mutex held
+func (registry *expiryRegistry) schedule(key string, deadline time.Time) {
+	if timer, ok := registry.timers[key]; ok {
+		timer.Stop()
+	}
+	registry.deadlines[key] = deadline
+	registry.timers[key] = time.AfterFunc(deadline.Sub(time.Now()), func() {
+		registry.expire(key, deadline)
+	})
+}
+
+// save must be called with the mutex held
+func (registry *expiryRegistry) save() error {
+	content, err := json.Marshal(registry.deadlines)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(registry.path, content)
+}
+
+// set lets key expire at deadline, a zero deadline removes the expiry. The
+// caller has to hold the lock of the key's path.
+func (registry *expiryRegistry) set(key string, deadline time.Time) error {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	if !deadline.IsZero() {
+		registry.schedule(key, deadline)
+		return registry.save()
+	}
+
+	if _, ok := registry.deadlines[key]; !ok {
+		return nil
+	}
+	registry.timers[key].Stop()
+	delete(registry.timers, key)
+	delete(registry.deadlines, key)
+	return registry.save()
+}
+
+// stopTimers stops removing expired keys, the deadlines are kept for the
+// next start
+func (registry *expiryRegistry) stopTimers() {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	for k, timer := range registry.timers {
+		timer.Stop()
+		delete(registry.timers, k)
+	}
+}
+
+// clear removes the expiries of key and all keys below it. The caller has
+// to hold the lock of the key's path.
+func (registry *expiryRegistry) clear(key string) error {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	changed := false
+	for k, timer := range registry.timers {
+		if matchesPrefix(k, key) {
+			timer.Stop()
+			delete(registry.timers, k)
+			delete(registry.deadlines, k)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return registry.save()
+}
+
+// due reports whether key is still set to expire at deadline and forgets
+// it if so. The caller has to hold the lock of the key's path.
+func (registry *expiryRegistry) due(key string, deadline time.Time) bool {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	if current, ok := registry.deadlines[key]; !ok || !current.Equal(deadline) {
+		return false
+	}
+	delete(registry.timers, key)
+	delete(registry.deadlines, key)
+	if err := registry.save(); err != nil {
+		logger().Error("Saving expiries failed", Fields{"error": err})
+	}
+	return true
+}
+
+// pending reports whether key is still set to expire at deadline
+func (registry *expiryRegistry) pending(key string, deadline time.Time) bool {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	current, ok := registry.deadlines[key]
+	return ok && current.Equal(deadline)
+}
+
+// expireKey removes key if its TTL has not been renewed since deadline was
+// set. In a cluster the leader proposes the removal to all nodes. While the
+// server is read-only the key is kept, it expires once changes are
+// accepted again.
+func (s *Server) expireKey(key string, deadline time.Time) {
+	if s.ReadOnly() {
+		return
+	}
+	if s.cluster != nil {
+		s.cluster.expire(key, deadline)
+		return
+	}
+	s.removeExpired(nil, key, deadline)
+}
+
+// removeExpired deletes key if deadline is still its expiry, r is the
+// cluster command that expires it or nil
+func (s *Server) removeExpired(r *http.Request, key string, deadline time.Time) {
+	defer s.changing()()
+	keyPath := filepath.Join(s.dataPath, key)
+	unlock := lockPath(keyPath)
+	if !s.expiries.due(key, deadline) {
+		unlock()
+		return
+	}
+	oldHash := s.auditHashLocked(key, keyPath)
+	err := deleteKeyLocked(keyPath)
+	unlock()
+
+	if err != nil {
+		logger().Error("Expiring failed", Fields{"key": key, "error": err})
+		return
+	}
+	s.audit(r, AuditEntry{Key: key, Action: "EXPIRE", OldHash: oldHash})
+	s.notifyChange(r, key, "EXPIRE")
+}
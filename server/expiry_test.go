@@ -0,0 +1,79 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func sendRequest(handler http.HandlerFunc, method, key string, vals url.Values) int {
+	var req *http.Request
+	if method == "PUT" || method == "POST" {
+		req, _ = http.NewRequest(method, "http://localhost/"+key, strings.NewReader(vals.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		req, _ = http.NewRequest(method, "http://localhost/"+key+"?"+vals.Encode(), nil)
+	}
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w.Code
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	cleanData()
+	handler := NewServerHandler(testDataPath, nil, nil)
+
+	assert.Equal(t, http.StatusOK, sendRequest(handler, "PUT", "leader", url.Values{"value": {"a"}, "prevExist": {"false"}}))
+	assert.Equal(t, http.StatusPreconditionFailed, sendRequest(handler, "PUT", "leader", url.Values{"value": {"b"}, "prevExist": {"false"}}))
+	assert.Equal(t, http.StatusPreconditionFailed, sendRequest(handler, "PUT", "leader", url.Values{"value": {"b"}, "prevValue": {"b"}}))
+	assert.Equal(t, http.StatusOK, sendRequest(handler, "PUT", "leader", url.Values{"value": {"b"}, "prevValue": {"a"}}))
+	assert.Equal(t, http.StatusOK, sendRequest(handler, "PUT", "leader", url.Values{"value": {"c"}, "prevExist": {"true"}}))
+	assert.Equal(t, http.StatusPreconditionFailed, sendRequest(handler, "PUT", "other", url.Values{"value": {"c"}, "prevExist": {"true"}}))
+
+	assert.Equal(t, http.StatusPreconditionFailed, sendRequest(handler, "DELETE", "leader", url.Values{"prevValue": {"a"}}))
+	assert.Equal(t, http.StatusOK, sendRequest(handler, "DELETE", "leader", url.Values{"prevValue": {"c"}}))
+	assert.Equal(t, http.StatusNotFound, sendRequest(handler, "GET", "leader", url.Values{}))
+}
+
+func TestKeyExpires(t *testing.T) {
+	cleanData()
+	handler := NewServerHandler(testDataPath, nil, nil)
+
+	assert.Equal(t, http.StatusOK, sendRequest(handler, "PUT", "session", url.Values{"value": {"a"}, "ttl": {"0.1"}}))
+	assert.Equal(t, http.StatusOK, sendRequest(handler, "PUT", "permanent", url.Values{"value": {"a"}, "ttl": {"0.1"}}))
+	assert.Equal(t, http.StatusOK, sendRequest(handler, "PUT", "permanent", url.Values{"value": {"a"}}))
+	assert.Equal(t, http.StatusOK, sendRequest(handler, "GET", "session", url.Values{}))
+
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, http.StatusNotFound, sendRequest(handler, "GET", "session", url.Values{}))
+	assert.Equal(t, http.StatusOK, sendRequest(handler, "GET", "permanent", url.Values{}))
+	assert.Equal(t, http.StatusBadRequest, sendRequest(handler, "PUT", "session", url.Values{"value": {"a"}, "ttl": {"soon"}}))
+}
+
+func TestKeyExpiresAfterRestart(t *testing.T) {
+	cleanData()
+	first := NewServer(testDataPath, nil, nil)
+	assert.Equal(t, http.StatusOK, sendRequest(first.ServeHTTP, "PUT", "session", url.Values{"value": {"a"}, "ttl": {"0.2"}}))
+
+	// the first server goes away, the second one has to expire the key
+	first.expiries.mutex.Lock()
+	first.expiries.timers["session"].Stop()
+	first.expiries.mutex.Unlock()
+	handler := NewServerHandler(testDataPath, nil, nil)
+
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, http.StatusNotFound, sendRequest(handler, "GET", "session", url.Values{}))
+}
+
+func TestDeleteClearsExpiry(t *testing.T) {
+	cleanData()
+	s := NewServer(testDataPath, nil, nil)
+	assert.Equal(t, http.StatusOK, sendRequest(s.ServeHTTP, "PUT", "ns/session", url.Values{"value": {"a"}, "ttl": {"60"}}))
+	assert.Equal(t, http.StatusOK, sendRequest(s.ServeHTTP, "DELETE", "ns", url.Values{}))
+	assert.Len(t, s.expiries.deadlines, 0)
+}
@@ -0,0 +1,323 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errResync = errors.New("the primary no longer has the mutations, resyncing")
+
+// FollowerConfig configures how a server follows a primary
+type FollowerConfig struct {
+	// Primary is the URL of the server to replicate
+	Primary string
+	// Token authenticates the follower at the primary
+	Token string
+	// Client sends the requests to the primary, http.DefaultClient if nil
+	Client *http.Client
+	// RejectWrites answers changes with 503 instead of redirecting them to
+	// the primary
+	RejectWrites bool
+}
+
+type followerPosition struct {
+	Epoch string `json:"epoch"`
+	Seq   uint64 `json:"seq"`
+}
+
+// Follower replicates the keys of a primary. It bootstraps from a snapshot
+// and then applies the primary's mutations in order. Its position is
+// persisted, so after a disconnect or restart it resumes where it stopped.
+type Follower struct {
+	server *Server
+	config FollowerConfig
+	path   string
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mutex       sync.Mutex
+	position    followerPosition
+	primarySeq  uint64
+	connected   bool
+	lastContact time.Time
+	caughtUp    time.Time
+	lastError   error
+}
+
+// Follow makes the server replicate config.Primary. Changes are no longer
+// accepted locally but redirected or rejected.
+func (s *Server) Follow(config FollowerConfig) *Follower {
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &Follower{
+		server:   s,
+		config:   config,
+		path:     s.systemPath("replication.json"),
+		cancel:   cancel,
+		done:     make(chan struct{}),
+		caughtUp: time.Now(),
+	}
+	if content, err := ioutil.ReadFile(f.path); err == nil {
+		json.Unmarshal(content, &f.position)
+	}
+	s.follower = f
+	go f.run(ctx)
+	return f
+}
+
+// Stop ends replication
+func (f *Follower) Stop() {
+	f.cancel()
+	<-f.done
+}
+
+// Status reports the replication position and lag
+func (f *Follower) Status() ReplicationStatus {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	status := ReplicationStatus{
+		Role:       "follower",
+		Primary:    f.config.Primary,
+		Epoch:      f.position.Epoch,
+		Seq:        f.position.Seq,
+		PrimarySeq: f.primarySeq,
+		Connected:  f.connected,
+	}
+	if f.primarySeq > f.position.Seq {
+		status.Lag = f.primarySeq - f.position.Seq
+	}
+	if status.Lag > 0 || !f.connected {
+		status.LagSeconds = time.Since(f.caughtUp).Seconds()
+	}
+	if !f.lastContact.IsZero() {
+		lastContact := f.lastContact
+		status.LastContact = &lastContact
+	}
+	if f.lastError != nil {
+		status.Error = f.lastError.Error()
+	}
+	return status
+}
+
+func (f *Follower) run(ctx context.Context) {
+	defer close(f.done)
+	for ctx.Err() == nil {
+		var err error
+		if f.currentPosition().Epoch == "" {
+			err = f.bootstrap(ctx)
+		}
+		if err == nil {
+			err = f.stream(ctx)
+		}
+
+		f.mutex.Lock()
+		f.connected = false
+		f.lastError = err
+		f.mutex.Unlock()
+		if err == errResync {
+			f.setPosition(followerPosition{})
+			continue
+		}
+		if err != nil && ctx.Err() == nil {
+			logger().Warn("Replicating failed", Fields{"primary": f.config.Primary, "error": err})
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (f *Follower) currentPosition() followerPosition {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.position
+}
+
+func (f *Follower) setPosition(position followerPosition) {
+	f.mutex.Lock()
+	f.position = position
+	if f.primarySeq <= position.Seq {
+		f.primarySeq = position.Seq
+		f.caughtUp = time.Now()
+	}
+	f.mutex.Unlock()
+
+	content, _ := json.Marshal(position)
+	if err := writeFileAtomic(f.path, content); err != nil {
+		logger().Error("Saving replication position failed", Fields{"error": err})
+	}
+}
+
+func (f *Follower) contact(primarySeq uint64) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.connected = true
+	f.lastContact = time.Now()
+	f.lastError = nil
+	if primarySeq > f.primarySeq {
+		f.primarySeq = primarySeq
+	}
+	if f.primarySeq <= f.position.Seq {
+		f.caughtUp = time.Now()
+	}
+}
+
+func (f *Follower) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	requestURL, err := url.Parse(f.config.Primary)
+	if err != nil {
+		return nil, err
+	}
+	requestURL.Path = strings.TrimSuffix(requestURL.Path, "/") + "/" + path
+	requestURL.RawQuery = query.Encode()
+	req, err := http.NewRequest("GET", requestURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if f.config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+f.config.Token)
+	}
+	return f.config.Client.Do(req.WithContext(ctx))
+}
+
+// bootstrap replaces all local keys with a snapshot of the primary
+func (f *Follower) bootstrap(ctx context.Context) error {
+	resp, err := f.get(ctx, "_/replication/snapshot", url.Values{"reveal": {"true"}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("snapshot: primary responded with %s", resp.Status)
+	}
+	var snapshot ReplicationSnapshot
+	if err = json.NewDecoder(resp.Body).Decode(&snapshot); err != nil {
+		return err
+	}
+
+	files, err := ioutil.ReadDir(f.server.dataPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, file := range files {
+		if !isReservedKey(file.Name()) {
+			if err = f.apply(Mutation{Op: "delete", Key: file.Name()}); err != nil {
+				return err
+			}
+		}
+	}
+	for _, m := range snapshot.Mutations {
+		if err = f.apply(m); err != nil {
+			return err
+		}
+	}
+	f.setPosition(followerPosition{Epoch: snapshot.Epoch, Seq: snapshot.Seq})
+	f.contact(snapshot.Seq)
+	return nil
+}
+
+// stream applies the primary's mutations until the connection ends
+func (f *Follower) stream(ctx context.Context) error {
+	position := f.currentPosition()
+	resp, err := f.get(ctx, "_/replication/stream", url.Values{
+		"epoch":  {position.Epoch},
+		"after":  {strconv.FormatUint(position.Seq, 10)},
+		"reveal": {"true"},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		return errResync
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("stream: primary responded with %s", resp.Status)
+	}
+	f.contact(0)
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var m Mutation
+		if err := decoder.Decode(&m); err != nil {
+			return err
+		}
+		if m.Op == "heartbeat" {
+			f.contact(m.Seq)
+			continue
+		}
+		if m.Seq <= position.Seq {
+			continue
+		}
+		if err := f.apply(m); err != nil {
+			return err
+		}
+		position.Seq = m.Seq
+		f.setPosition(position)
+		f.contact(m.Seq)
+	}
+}
+
+// apply changes a local key like the primary did
+func (f *Follower) apply(m Mutation) error {
+	if !validKey.MatchString(m.Key) || isReservedKey(m.Key) {
+		return fmt.Errorf("invalid key '%s' replicated", m.Key)
+	}
+	keyPath := filepath.Join(f.server.dataPath, m.Key)
+	defer f.server.changing()()
+	switch m.Op {
+	case "set":
+		unlock := lockPath(keyPath)
+		oldHash := f.server.auditHashLocked(m.Key, keyPath)
+		err := putKeyLocked(keyPath, isExemptFromCache(m.Key, f.server.cacheExemptionList), m.Value)
+		// the value may arrive encrypted, the hash is of the plaintext
+		newHash := f.server.auditHashLocked(m.Key, keyPath)
+		unlock()
+		if err != nil {
+			return err
+		}
+		f.server.audit(nil, AuditEntry{Key: m.Key, Action: "IMPORT", Principal: "primary:" + f.config.Primary, OldHash: oldHash, NewHash: newHash})
+		f.server.notifyChange(nil, m.Key, "PUT")
+	case "delete":
+		if _, err := os.Stat(keyPath); os.IsNotExist(err) {
+			return nil
+		}
+		oldHash := f.server.auditHash(m.Key, keyPath)
+		if err := deleteKey(keyPath); err != nil {
+			return err
+		}
+		f.server.audit(nil, AuditEntry{Key: m.Key, Action: "DELETE", Principal: "primary:" + f.config.Primary, OldHash: oldHash})
+		f.server.notifyChange(nil, m.Key, "DELETE")
+	default:
+		return fmt.Errorf("unknown replication operation '%s'", m.Op)
+	}
+	return nil
+}
+
+// handlesChange redirects changes to the primary or rejects them, it
+// reports whether r was answered
+func (f *Follower) handlesChange(w http.ResponseWriter, r *http.Request, key string) bool {
+	if r.Method == "GET" || r.Method == "HEAD" || strings.HasPrefix(key, reservedPrefix+"admin") {
+		return false
+	}
+	if f.config.RejectWrites {
+		writeResponse(w, ResponseData{StatusCode: http.StatusServiceUnavailable, Key: key, Error: "This server follows " + f.config.Primary + ", send changes there."})
+		return true
+	}
+	http.Redirect(w, r, strings.TrimSuffix(f.config.Primary, "/")+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	return true
+}
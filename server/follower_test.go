@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFollower(t *testing.T) {
+	cleanData()
+	primary := NewServer(testDataPath, nil, nil)
+	srv := httptest.NewServer(primary)
+	defer srv.Close()
+	assert.Equal(t, http.StatusOK, sendRequest(primary.ServeHTTP, "PUT", "a/b", url.Values{"value": {"1"}}))
+	assert.Equal(t, http.StatusOK, sendRequest(primary.ServeHTTP, "PUT", "c", url.Values{"value": {"2"}}))
+
+	followerPath, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(followerPath)
+	assert.Nil(t, putKey(filepath.Join(followerPath, "stale"), false, "x"))
+	value := func(key string) string {
+		entry, err := readKey(filepath.Join(followerPath, key), false)
+		if err != nil || entry.isNamespace {
+			return ""
+		}
+		return entry.data[0]
+	}
+
+	follower := NewServer(followerPath, nil, nil)
+	f := follower.Follow(FollowerConfig{Primary: srv.URL})
+	waitFor(t, func() bool { return value("a/b") == "1" && value("c") == "2" })
+	assert.Equal(t, "", value("stale"))
+
+	assert.Equal(t, http.StatusOK, sendRequest(primary.ServeHTTP, "PUT", "a/b", url.Values{"value": {"3"}}))
+	assert.Equal(t, http.StatusOK, sendRequest(primary.ServeHTTP, "DELETE", "c", url.Values{}))
+	assert.Equal(t, http.StatusOK, sendRequest(primary.ServeHTTP, "POST", "n", url.Values{"op": {"incr"}, "init": {"0"}}))
+	waitFor(t, func() bool { return value("a/b") == "3" && value("c") == "" && value("n") == "1" })
+
+	_, primarySeq := primary.replication.position()
+	waitFor(t, func() bool {
+		status := f.Status()
+		return status.Connected && status.Seq == primarySeq && status.Lag == 0
+	})
+
+	req, _ := http.NewRequest("PUT", "http://localhost/a/b?value=4", nil)
+	w := httptest.NewRecorder()
+	follower.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusTemporaryRedirect, w.Code)
+	assert.Equal(t, srv.URL+"/a/b?value=4", w.Header().Get("Location"))
+
+	// a restarted follower resumes instead of resyncing, which would
+	// remove the local marker
+	f.Stop()
+	assert.Nil(t, putKey(filepath.Join(followerPath, "marker"), false, "x"))
+	assert.Equal(t, http.StatusOK, sendRequest(primary.ServeHTTP, "PUT", "d", url.Values{"value": {"5"}}))
+	follower = NewServer(followerPath, nil, nil)
+	f = follower.Follow(FollowerConfig{Primary: srv.URL, RejectWrites: true})
+	defer f.Stop()
+	waitFor(t, func() bool { return value("d") == "5" })
+	assert.Equal(t, "x", value("marker"))
+	assert.Equal(t, http.StatusServiceUnavailable, sendRequest(follower.ServeHTTP, "PUT", "a/b", url.Values{"value": {"4"}}))
+}
+
+func TestFollowerAfterPrimaryRestart(t *testing.T) {
+	cleanData()
+	var mutex sync.Mutex
+	primary := NewServer(testDataPath, nil, nil)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		current := primary
+		mutex.Unlock()
+		current.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	assert.Equal(t, http.StatusOK, sendRequest(primary.ServeHTTP, "PUT", "a", url.Values{"value": {"1"}}))
+
+	followerPath, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(followerPath)
+	f := NewServer(followerPath, nil, nil).Follow(FollowerConfig{Primary: srv.URL})
+	defer f.Stop()
+	waitFor(t, func() bool { return f.Status().Connected })
+	epoch := f.Status().Epoch
+	restart := func() {
+		mutex.Lock()
+		primary = NewServer(testDataPath, nil, nil)
+		mutex.Unlock()
+		srv.CloseClientConnections()
+	}
+
+	// a primary shut down cleanly resumes its epoch, the follower keeps
+	// its local marker as it does not resync
+	assert.Nil(t, primary.Shutdown(context.Background()))
+	assert.Nil(t, putKey(filepath.Join(followerPath, "marker"), false, "x"))
+	restart()
+	assert.Equal(t, http.StatusOK, sendRequest(primary.ServeHTTP, "PUT", "b", url.Values{"value": {"2"}}))
+	waitFor(t, func() bool { return fileExists(filepath.Join(followerPath, "b")) == nil })
+	assert.Equal(t, epoch, f.Status().Epoch)
+	assert.Nil(t, fileExists(filepath.Join(followerPath, "marker")))
+
+	// after a crash the primary has a new epoch, so the follower resyncs
+	restart()
+	waitFor(t, func() bool { status := f.Status(); return status.Connected && status.Epoch != epoch })
+	assert.Nil(t, fileExists(filepath.Join(followerPath, "a")))
+	assert.NotNil(t, fileExists(filepath.Join(followerPath, "marker")))
+}
+
+func TestFollowerOfSecrets(t *testing.T) {
+	cleanData()
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	writeTokenFile(t, filepath.Join(dir, "tokens"), map[string]string{"full": "secret-f", "plain": "secret-p"})
+	store, err := LoadTokenStore(filepath.Join(dir, "tokens"))
+	assert.Nil(t, err)
+	acl := &ACL{rules: []ACLRule{
+		{Principal: "*", Prefix: "", Permissions: []string{"read", "list"}},
+		{Principal: "full", Prefix: "secrets", Permissions: []string{"reveal"}},
+	}}
+
+	primary := NewServer(testDataPath, nil, nil)
+	primary.RequireTokens(store)
+	primary.EnforceACL(acl)
+	assert.Nil(t, primary.MarkSecret("secrets"))
+	srv := httptest.NewServer(primary)
+	defer srv.Close()
+	assert.Nil(t, putKey(filepath.Join(testDataPath, "secrets", "db"), false, "hunter2"))
+	assert.Nil(t, putKey(filepath.Join(testDataPath, "plain"), false, "1"))
+
+	follow := func(token string) string {
+		path, err := ioutil.TempDir("", "")
+		assert.Nil(t, err)
+		f := NewServer(path, nil, nil).Follow(FollowerConfig{Primary: srv.URL, Token: token})
+		defer f.Stop()
+		waitFor(t, func() bool { return f.Status().Connected })
+		assert.Nil(t, fileExists(filepath.Join(path, "plain")))
+		return path
+	}
+	withheld := follow("secret-p")
+	defer os.RemoveAll(withheld)
+	revealed := follow("secret-f")
+	defer os.RemoveAll(revealed)
+	assert.NotNil(t, fileExists(filepath.Join(withheld, "secrets", "db")))
+	entry, err := readKey(filepath.Join(revealed, "secrets", "db"), false)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"hunter2"}, entry.data)
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// ReadinessConfig sets the limits of the readiness checks
+type ReadinessConfig struct {
+	// MinFreeBytes is the free disk space below which the server is not
+	// ready, 0 only reports it
+	MinFreeBytes uint64
+	// MaxReplicationLag is the number of mutations a follower or cluster
+	// member may be behind and still be ready
+	MaxReplicationLag uint64
+}
+
+// ReadinessCheck is the result of one readiness check
+type ReadinessCheck struct {
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+// Readiness reports whether the server is ready and the result of every
+// check: writable, disk, recovery and replication
+type Readiness struct {
+	Ready  bool                      `json:"ready"`
+	Checks map[string]ReadinessCheck `json:"checks"`
+}
+
+type healthResponse struct {
+	Status        string  `json:"status"`
+	UptimeSeconds float64 `json:"uptimeSeconds"`
+}
+
+// isProbe reports whether path is one of the probes answered without
+// authentication
+func isProbe(path string) bool {
+	return path == reservedPrefix+"health" || path == reservedPrefix+"ready"
+}
+
+// ConfigureReadiness sets the limits of the readiness checks
+func (s *Server) ConfigureReadiness(config ReadinessConfig) {
+	s.readiness = config
+}
+
+// StartupComplete marks the server as recovered, until then it is not
+// ready. It is called once everything configured is running.
+func (s *Server) StartupComplete() {
+	atomic.StoreInt32(&s.startupComplete, 1)
+}
+
+// Ready runs the readiness checks
+func (s *Server) Ready() Readiness {
+	readiness := Readiness{Ready: true, Checks: map[string]ReadinessCheck{
+		"writable":    s.checkWritable(),
+		"disk":        s.checkDisk(),
+		"recovery":    s.checkRecovery(),
+		"replication": s.checkReplication(),
+	}}
+	for _, check := range readiness.Checks {
+		readiness.Ready = readiness.Ready && check.OK
+	}
+	return readiness
+}
+
+// checkWritable writes, syncs and removes a file in the system directory
+func (s *Server) checkWritable() ReadinessCheck {
+	path := s.systemPath("ready-probe")
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err == nil {
+		var f *os.File
+		if f, err = os.Create(path); err == nil {
+			_, err = f.WriteString(time.Now().UTC().Format(time.RFC3339Nano))
+			if err == nil {
+				err = f.Sync()
+			}
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if removeErr := os.Remove(path); err == nil {
+				err = removeErr
+			}
+		}
+	}
+	if err != nil {
+		return ReadinessCheck{Message: "Writing to the data path failed: " + err.Error()}
+	}
+	return ReadinessCheck{OK: true}
+}
+
+func (s *Server) checkDisk() ReadinessCheck {
+	free, err := freeBytes(s.dataPath)
+	if err != nil {
+		return ReadinessCheck{OK: s.readiness.MinFreeBytes == 0, Message: err.Error()}
+	}
+	message := fmt.Sprintf("%d bytes free", free)
+	if free < s.readiness.MinFreeBytes {
+		return ReadinessCheck{Message: fmt.Sprintf("%s, less than %d", message, s.readiness.MinFreeBytes)}
+	}
+	return ReadinessCheck{OK: true, Message: message}
+}
+
+// checkRecovery passes once startup is complete and a cluster member has
+// applied its log, until the server shuts down
+func (s *Server) checkRecovery() ReadinessCheck {
+	if s.isDraining() {
+		return ReadinessCheck{Message: "Shutting down."}
+	}
+	if atomic.LoadInt32(&s.startupComplete) == 0 {
+		return ReadinessCheck{Message: "Starting."}
+	}
+	if s.cluster != nil {
+		status := s.cluster.Status()
+		if status.Applied < status.CommitIndex {
+			return ReadinessCheck{Message: fmt.Sprintf("Applied %d of %d committed cluster log entries.", status.Applied, status.CommitIndex)}
+		}
+	}
+	return ReadinessCheck{OK: true}
+}
+
+// checkReplication passes for followers connected to the primary and cluster
+// members that know the leader, both at most MaxReplicationLag behind
+func (s *Server) checkReplication() ReadinessCheck {
+	switch {
+	case s.follower != nil:
+		status := s.follower.Status()
+		if !status.Connected {
+			message := "Not connected to the primary."
+			if status.Error != "" {
+				message = "Not connected to the primary: " + status.Error
+			}
+			return ReadinessCheck{Message: message}
+		}
+		if status.Lag > s.readiness.MaxReplicationLag {
+			return ReadinessCheck{Message: fmt.Sprintf("%d mutations behind the primary.", status.Lag)}
+		}
+		return ReadinessCheck{OK: true, Message: fmt.Sprintf("%d mutations behind the primary.", status.Lag)}
+	case s.cluster != nil:
+		status := s.cluster.Status()
+		if status.Leader == "" {
+			return ReadinessCheck{Message: "No cluster leader elected."}
+		}
+		if status.CommitIndex-status.Applied > s.readiness.MaxReplicationLag {
+			return ReadinessCheck{Message: fmt.Sprintf("%d cluster log entries behind.", status.CommitIndex-status.Applied)}
+		}
+		return ReadinessCheck{OK: true, Message: "Leader is " + status.Leader + "."}
+	}
+	return ReadinessCheck{OK: true, Message: "Not replicated."}
+}
+
+// serveHealth answers GET /_/health as long as the server can answer at all
+func (s *Server) serveHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		writeResponse(w, ResponseData{StatusCode: http.StatusMethodNotAllowed, Key: r.URL.Path[1:], Error: "Only GET is allowed."})
+		return
+	}
+	writeJSON(w, http.StatusOK, healthResponse{Status: "ok", UptimeSeconds: time.Since(s.started).Seconds()})
+}
+
+// serveReady answers GET /_/ready with the readiness checks, 503 if one of
+// them failed
+func (s *Server) serveReady(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		writeResponse(w, ResponseData{StatusCode: http.StatusMethodNotAllowed, Key: r.URL.Path[1:], Error: "Only GET is allowed."})
+		return
+	}
+	readiness := s.Ready()
+	status := http.StatusOK
+	if !readiness.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, readiness)
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func probe(s *Server, path string) (int, Readiness) {
+	req, _ := http.NewRequest("GET", "http://localhost/"+path, nil)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	var readiness Readiness
+	json.Unmarshal(w.Body.Bytes(), &readiness)
+	return w.Code, readiness
+}
+
+func TestReadiness(t *testing.T) {
+	cleanData()
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	writeTokenFile(t, filepath.Join(dir, "tokens"), map[string]string{"alice": "secret-a"})
+	store, err := LoadTokenStore(filepath.Join(dir, "tokens"))
+	assert.Nil(t, err)
+
+	s := NewServer(testDataPath, nil, nil)
+	s.RequireTokens(store)
+
+	// the probes need no token
+	status, _ := probe(s, "_/health")
+	assert.Equal(t, http.StatusOK, status)
+	status, readiness := probe(s, "_/ready")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.False(t, readiness.Ready)
+	assert.False(t, readiness.Checks["recovery"].OK)
+	assert.True(t, readiness.Checks["writable"].OK)
+	assert.True(t, readiness.Checks["replication"].OK)
+
+	s.StartupComplete()
+	status, readiness = probe(s, "_/ready")
+	assert.Equal(t, http.StatusOK, status)
+	assert.True(t, readiness.Ready)
+	assert.Len(t, readiness.Checks, 4)
+	_, err = os.Stat(s.systemPath("ready-probe"))
+	assert.True(t, os.IsNotExist(err))
+
+	s.ConfigureReadiness(ReadinessConfig{MinFreeBytes: 1 << 62})
+	status, readiness = probe(s, "_/ready")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.False(t, readiness.Checks["disk"].OK)
+	s.ConfigureReadiness(ReadinessConfig{})
+
+	// the system directory cannot be created where a file is
+	os.RemoveAll(filepath.Join(testDataPath, reservedPrefix+"system"))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(testDataPath, reservedPrefix+"system"), nil, 0644))
+	status, readiness = probe(s, "_/ready")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.False(t, readiness.Checks["writable"].OK)
+	assert.Contains(t, readiness.Checks["writable"].Message, "Writing to the data path failed")
+}
+
+func TestReadinessOfFollower(t *testing.T) {
+	cleanData()
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer primary.Close()
+	followerPath, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(followerPath)
+
+	follower := NewServer(followerPath, nil, nil)
+	f := follower.Follow(FollowerConfig{Primary: primary.URL})
+	defer f.Stop()
+	follower.StartupComplete()
+	status, readiness := probe(follower, "_/ready")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.False(t, readiness.Checks["replication"].OK)
+	assert.Contains(t, readiness.Checks["replication"].Message, "Not connected to the primary")
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// hookDelivery is a web hook call, it is pending until the hook answered
+type hookDelivery struct {
+	URL       string `json:"url"`
+	Key       string `json:"key"`
+	Action    string `json:"action"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+var pendingHooks = make(map[*hookDelivery]struct{})
+var pendingHooksMutex sync.Mutex
+
+func pendingHookCount() int {
+	pendingHooksMutex.Lock()
+	defer pendingHooksMutex.Unlock()
+	return len(pendingHooks)
+}
+
+// deliverHook calls the hook in the background, failures are logged and
+// counted
+func deliverHook(delivery *hookDelivery) {
+	pendingHooksMutex.Lock()
+	pendingHooks[delivery] = struct{}{}
+	pendingHooksMutex.Unlock()
+
+	go func() {
+		defer func() {
+			pendingHooksMutex.Lock()
+			delete(pendingHooks, delivery)
+			pendingHooksMutex.Unlock()
+		}()
+
+		fields := Fields{"url": delivery.URL, "key": delivery.Key, "action": delivery.Action, "requestId": delivery.RequestID}
+		hookData := url.Values{"key": {delivery.Key}, "action": {delivery.Action}}
+		req, err := http.NewRequest("POST", delivery.URL, strings.NewReader(hookData.Encode()))
+		if err != nil {
+			atomic.AddUint64(&hooksFailed, 1)
+			logger().Warn("WebHook Post failed", fields, Fields{"error": err})
+			return
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if delivery.RequestID != "" {
+			req.Header.Set(RequestIDHeader, delivery.RequestID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			atomic.AddUint64(&hooksFailed, 1)
+			logger().Warn("WebHook Post failed", fields, Fields{"error": err})
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			atomic.AddUint64(&hooksRejected, 1)
+			logger().Warn("WebHook rejected the call", fields, Fields{"status": resp.StatusCode})
+			return
+		}
+		atomic.AddUint64(&hooksDelivered, 1)
+		logger().Debug("Called WebHook", fields, Fields{"status": resp.StatusCode})
+	}()
+}
+
+// waitForHooks waits until all pending hook calls were answered or ctx is
+// done and returns the calls still pending then
+func waitForHooks(ctx context.Context) []hookDelivery {
+	for {
+		pendingHooksMutex.Lock()
+		pending := []hookDelivery{}
+		for delivery := range pendingHooks {
+			pending = append(pending, *delivery)
+		}
+		pendingHooksMutex.Unlock()
+		if len(pending) == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return pending
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// persistHooks saves hook calls that were not answered before shutdown,
+// they are made again on the next start
+func (s *Server) persistHooks(pending []hookDelivery) error {
+	content, err := json.MarshalIndent(pending, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(s.systemPath(""), os.ModePerm); err != nil {
+		return err
+	}
+	return writeFileAtomic(s.systemPath("webhooks.json"), content)
+}
+
+// resumeHooks makes the hook calls saved by persistHooks, as far as the
+// hooks are still configured
+func (s *Server) resumeHooks() {
+	path := s.systemPath("webhooks.json")
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	var pending []hookDelivery
+	if err == nil {
+		err = json.Unmarshal(content, &pending)
+	}
+	if err != nil {
+		logger().Error("Loading pending web hooks failed", Fields{"error": err})
+		return
+	}
+	if err = os.Remove(path); err != nil {
+		logger().Error("Removing pending web hooks failed", Fields{"error": err})
+		return
+	}
+	resumed := 0
+	for i := range pending {
+		for _, hookUrl := range s.webHookURLs {
+			if pending[i].URL == hookUrl {
+				deliverHook(&pending[i])
+				resumed++
+				break
+			}
+		}
+	}
+	logger().Info("Resumed web hooks", Fields{"count": resumed, "dropped": len(pending) - resumed})
+}
@@ -0,0 +1,249 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultLockTTL = 30 * time.Second
+
+// LockInfo describes a held lock
+type LockInfo struct {
+	Name    string    `json:"name"`
+	Owner   string    `json:"owner"`
+	Expires time.Time `json:"expires"`
+}
+
+type lockResponse struct {
+	Lock  *LockInfo  `json:"lock,omitempty"`
+	Locks []LockInfo `json:"locks,omitempty"`
+	Error string     `json:"error,omitempty"`
+}
+
+// lockManager holds named locks with an owner and a TTL, a lock whose owner
+// does not renew it in time is released automatically
+type lockManager struct {
+	mutex sync.Mutex
+	locks map[string]*LockInfo
+	// closed and replaced whenever a lock may have become available
+	released chan struct{}
+}
+
+func newLockManager() *lockManager {
+	return &lockManager{locks: make(map[string]*LockInfo), released: make(chan struct{})}
+}
+
+// wake all waiters, must be called with the mutex held
+func (m *lockManager) signal() {
+	close(m.released)
+	m.released = make(chan struct{})
+}
+
+// current returns the lock if it is held and not expired, must be called
+// with the mutex held
+func (m *lockManager) current(name string) *LockInfo {
+	lock, ok := m.locks[name]
+	if ok && !time.Now().Before(lock.Expires) {
+		delete(m.locks, name)
+		return nil
+	}
+	return lock
+}
+
+// acquire takes the lock for owner, waiting up to wait for it to become
+// available or until cancel is closed. Acquiring a lock already held by
+// owner renews it.
+func (m *lockManager) acquire(name, owner string, ttl, wait time.Duration, cancel <-chan struct{}) (LockInfo, error) {
+	deadline := time.Now().Add(wait)
+	for {
+		m.mutex.Lock()
+		lock := m.current(name)
+		if lock == nil || lock.Owner == owner {
+			lock = &LockInfo{Name: name, Owner: owner, Expires: time.Now().Add(ttl)}
+			m.locks[name] = lock
+			m.mutex.Unlock()
+			m.wakeOnExpiry(lock)
+			return *lock, nil
+		}
+		holder := *lock
+		released := m.released
+		m.mutex.Unlock()
+
+		remaining := deadline.Sub(time.Now())
+		if remaining <= 0 {
+			return holder, &requestError{http.StatusConflict, "Lock '" + name + "' is held by '" + holder.Owner + "'."}
+		}
+		// wake up at the latest when the current holder expires
+		if untilExpiry := holder.Expires.Sub(time.Now()); untilExpiry < remaining {
+			remaining = untilExpiry
+		}
+		select {
+		case <-released:
+		case <-time.After(remaining):
+		case <-cancel:
+			return holder, &requestError{http.StatusConflict, "Waiting for lock '" + name + "' was canceled."}
+		}
+	}
+}
+
+// wakeOnExpiry wakes waiters once lock expires unless it was renewed or
+// released before
+func (m *lockManager) wakeOnExpiry(lock *LockInfo) {
+	time.AfterFunc(lock.Expires.Sub(time.Now()), func() {
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		if m.locks[lock.Name] == lock {
+			delete(m.locks, lock.Name)
+			m.signal()
+		}
+	})
+}
+
+// renew extends the TTL of a lock held by owner
+func (m *lockManager) renew(name, owner string, ttl time.Duration) (LockInfo, error) {
+	m.mutex.Lock()
+	lock := m.current(name)
+	if lock == nil {
+		m.mutex.Unlock()
+		return LockInfo{}, &requestError{http.StatusNotFound, "Lock '" + name + "' is not held."}
+	}
+	if lock.Owner != owner {
+		m.mutex.Unlock()
+		return *lock, &requestError{http.StatusConflict, "Lock '" + name + "' is held by '" + lock.Owner + "'."}
+	}
+	lock = &LockInfo{Name: name, Owner: owner, Expires: time.Now().Add(ttl)}
+	m.locks[name] = lock
+	m.mutex.Unlock()
+	m.wakeOnExpiry(lock)
+	return *lock, nil
+}
+
+// release frees a lock held by owner
+func (m *lockManager) release(name, owner string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	lock := m.current(name)
+	if lock == nil {
+		return &requestError{http.StatusNotFound, "Lock '" + name + "' is not held."}
+	}
+	if lock.Owner != owner {
+		return &requestError{http.StatusConflict, "Lock '" + name + "' is held by '" + lock.Owner + "'."}
+	}
+	delete(m.locks, name)
+	m.signal()
+	return nil
+}
+
+func (m *lockManager) get(name string) (LockInfo, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if lock := m.current(name); lock != nil {
+		return *lock, true
+	}
+	return LockInfo{}, false
+}
+
+func (m *lockManager) list() []LockInfo {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	locks := []LockInfo{}
+	for name := range m.locks {
+		if lock := m.current(name); lock != nil {
+			locks = append(locks, *lock)
+		}
+	}
+	sort.Slice(locks, func(i, j int) bool { return locks[i].Name < locks[j].Name })
+	return locks
+}
+
+// parseDuration reads a duration like '1m30s' or a number of seconds, an
+// empty string yields def
+func parseDuration(s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	return time.ParseDuration(s)
+}
+
+// durationParams reads the 'ttl' and 'wait' parameters of a request
+func durationParams(form url.Values) (ttl, wait time.Duration, err error) {
+	if ttl, err = parseDuration(form.Get("ttl"), defaultLockTTL); err != nil || ttl <= 0 {
+		return 0, 0, &requestError{http.StatusBadRequest, "Parameter 'ttl' is not a positive duration."}
+	}
+	if wait, err = parseDuration(form.Get("wait"), 0); err != nil || wait < 0 {
+		return 0, 0, &requestError{http.StatusBadRequest, "Parameter 'wait' is not a duration."}
+	}
+	return ttl, wait, nil
+}
+
+// serveLocks handles /_/locks/<name>: POST acquires the lock for 'owner',
+// waiting up to 'wait' for it, PUT renews it for another 'ttl', DELETE
+// releases it and GET shows the current holder
+func (s *Server) serveLocks(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/_/locks"), "/")
+	if name == "" {
+		if r.Method != "GET" {
+			writeJSON(w, http.StatusMethodNotAllowed, lockResponse{Error: "A lock name is required."})
+			return
+		}
+		writeJSON(w, http.StatusOK, lockResponse{Locks: s.locks.list()})
+		return
+	}
+	if !validKey.MatchString(name) {
+		writeJSON(w, http.StatusBadRequest, lockResponse{Error: "Invalid lock name. Only " + validKey.String() + " allowed!"})
+		return
+	}
+
+	if r.Method == "GET" {
+		if lock, ok := s.locks.get(name); ok {
+			writeJSON(w, http.StatusOK, lockResponse{Lock: &lock})
+		} else {
+			writeJSON(w, http.StatusNotFound, lockResponse{Error: "Lock '" + name + "' is not held."})
+		}
+		return
+	}
+
+	owner := r.Form.Get("owner")
+	if owner == "" {
+		writeJSON(w, http.StatusBadRequest, lockResponse{Error: "Parameter 'owner' is required."})
+		return
+	}
+	ttl, wait, err := durationParams(r.Form)
+	if err != nil {
+		writeLockError(w, err)
+		return
+	}
+
+	var lock LockInfo
+	switch r.Method {
+	case "POST":
+		lock, err = s.locks.acquire(name, owner, ttl, wait, r.Context().Done())
+	case "PUT":
+		lock, err = s.locks.renew(name, owner, ttl)
+	case "DELETE":
+		err = s.locks.release(name, owner)
+		lock = LockInfo{Name: name, Owner: owner}
+	default:
+		err = &requestError{http.StatusMethodNotAllowed, "Method not allowed."}
+	}
+
+	if err != nil {
+		writeLockError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, lockResponse{Lock: &lock})
+}
+
+func writeLockError(w http.ResponseWriter, err error) {
+	responseData := errorResponse("", err, http.StatusInternalServerError)
+	writeJSON(w, responseData.StatusCode, lockResponse{Error: responseData.Error})
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLockAcquireRelease(t *testing.T) {
+	m := newLockManager()
+	lock, err := m.acquire("migration", "a", time.Minute, 0, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "a", lock.Owner)
+
+	_, err = m.acquire("migration", "b", time.Minute, 0, nil)
+	assert.NotNil(t, err)
+
+	// re-acquiring renews
+	_, err = m.acquire("migration", "a", time.Minute, 0, nil)
+	assert.Nil(t, err)
+
+	assert.NotNil(t, m.release("migration", "b"))
+	assert.Nil(t, m.release("migration", "a"))
+	assert.NotNil(t, m.release("migration", "a"))
+
+	lock, err = m.acquire("migration", "b", time.Minute, 0, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "b", lock.Owner)
+}
+
+func TestLockExpires(t *testing.T) {
+	m := newLockManager()
+	_, err := m.acquire("migration", "a", 50*time.Millisecond, 0, nil)
+	assert.Nil(t, err)
+
+	// renewing keeps it alive
+	time.Sleep(30 * time.Millisecond)
+	_, err = m.renew("migration", "a", 50*time.Millisecond)
+	assert.Nil(t, err)
+	time.Sleep(30 * time.Millisecond)
+	_, ok := m.get("migration")
+	assert.True(t, ok)
+
+	time.Sleep(50 * time.Millisecond)
+	_, ok = m.get("migration")
+	assert.False(t, ok)
+	_, err = m.renew("migration", "a", time.Minute)
+	assert.NotNil(t, err)
+}
+
+func TestLockWaitsForRelease(t *testing.T) {
+	m := newLockManager()
+	_, err := m.acquire("migration", "a", time.Minute, 0, nil)
+	assert.Nil(t, err)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		m.release("migration", "a")
+	}()
+
+	start := time.Now()
+	lock, err := m.acquire("migration", "b", time.Minute, time.Second, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "b", lock.Owner)
+	assert.True(t, time.Since(start) < time.Second)
+
+	// waiting for an expiring lock
+	lock, err = m.acquire("other", "a", 50*time.Millisecond, 0, nil)
+	assert.Nil(t, err)
+	lock, err = m.acquire("other", "b", time.Minute, time.Second, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "b", lock.Owner)
+
+	// timing out
+	_, err = m.acquire("other", "c", time.Minute, 50*time.Millisecond, nil)
+	assert.NotNil(t, err)
+}
+
+func TestHTTPLocks(t *testing.T) {
+	handler := NewServerHandler(testDataPath, nil, nil)
+	request := func(method, path string, vals url.Values) int {
+		req, _ := http.NewRequest(method, "http://localhost/_/locks/"+path+"?"+vals.Encode(), nil)
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusBadRequest, request("POST", "migration", url.Values{}))
+	assert.Equal(t, http.StatusOK, request("POST", "migration", url.Values{"owner": {"a"}, "ttl": {"10"}}))
+	assert.Equal(t, http.StatusConflict, request("POST", "migration", url.Values{"owner": {"b"}, "wait": {"10ms"}}))
+	assert.Equal(t, http.StatusOK, request("GET", "migration", url.Values{}))
+	assert.Equal(t, http.StatusOK, request("PUT", "migration", url.Values{"owner": {"a"}, "ttl": {"1m"}}))
+	assert.Equal(t, http.StatusConflict, request("DELETE", "migration", url.Values{"owner": {"b"}}))
+	assert.Equal(t, http.StatusOK, request("DELETE", "migration", url.Values{"owner": {"a"}}))
+	assert.Equal(t, http.StatusNotFound, request("GET", "migration", url.Values{}))
+	assert.Equal(t, http.StatusBadRequest, request("POST", "migration", url.Values{"owner": {"a"}, "ttl": {"-1"}}))
+}
@@ -0,0 +1,265 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RequestIDHeader carries the ID of a request, it is taken from the request
+// if valid and sent back in the response and with web hooks
+const RequestIDHeader = "X-Request-ID"
+
+const requestIDContextKey contextKey = 3
+
+var validRequestID = regexp.MustCompile(`^[\w.:-]{1,128}$`)
+
+// Level is the severity of a log message
+type Level int
+
+// The levels in increasing severity
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (level Level) String() string {
+	if level < LevelDebug || level > LevelError {
+		return strconv.Itoa(int(level))
+	}
+	return levelNames[level]
+}
+
+// ParseLevel returns the level called name
+func ParseLevel(name string) (Level, error) {
+	for level, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return Level(level), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level '%s', expected one of %s", name, strings.Join(levelNames, ", "))
+}
+
+// Fields are the structured data of a log message
+type Fields map[string]interface{}
+
+// Logger writes messages at or above its level as lines of text or JSON
+type Logger struct {
+	mutex  *sync.Mutex
+	out    io.Writer
+	level  Level
+	json   bool
+	fields Fields
+}
+
+// NewLogger returns a logger writing to out in format 'text' or 'json'
+func NewLogger(out io.Writer, level Level, format string) (*Logger, error) {
+	if format != "text" && format != "json" {
+		return nil, fmt.Errorf("unknown log format '%s', expected text or json", format)
+	}
+	return &Logger{mutex: &sync.Mutex{}, out: out, level: level, json: format == "json"}, nil
+}
+
+var currentLogger atomic.Value
+
+func init() {
+	currentLogger.Store(&Logger{mutex: &sync.Mutex{}, out: os.Stdout, level: LevelInfo})
+}
+
+// SetLogger makes the server log through l
+func SetLogger(l *Logger) {
+	currentLogger.Store(l)
+}
+
+func logger() *Logger {
+	return currentLogger.Load().(*Logger)
+}
+
+// With returns a logger adding fields to every message
+func (l *Logger) With(fields Fields) *Logger {
+	merged := Fields{}
+	for name, value := range l.fields {
+		merged[name] = value
+	}
+	for name, value := range fields {
+		merged[name] = value
+	}
+	derived := *l
+	derived.fields = merged
+	return &derived
+}
+
+// Enabled reports whether messages at level are written
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.level
+}
+
+// Debug logs details only needed to trace a problem
+func (l *Logger) Debug(message string, fields ...Fields) {
+	l.Log(LevelDebug, message, fields...)
+}
+
+// Info logs regular operation
+func (l *Logger) Info(message string, fields ...Fields) {
+	l.Log(LevelInfo, message, fields...)
+}
+
+// Warn logs problems the server recovers from
+func (l *Logger) Warn(message string, fields ...Fields) {
+	l.Log(LevelWarn, message, fields...)
+}
+
+// Error logs failures
+func (l *Logger) Error(message string, fields ...Fields) {
+	l.Log(LevelError, message, fields...)
+}
+
+// Log writes message with the fields of the logger and fields
+func (l *Logger) Log(level Level, message string, fields ...Fields) {
+	if !l.Enabled(level) {
+		return
+	}
+	all := Fields{}
+	for name, value := range l.fields {
+		all[name] = value
+	}
+	for _, f := range fields {
+		for name, value := range f {
+			if err, ok := value.(error); ok {
+				value = err.Error()
+			}
+			all[name] = value
+		}
+	}
+	now := time.Now().UTC()
+
+	var line []byte
+	if l.json {
+		all["time"], all["level"], all["msg"] = now, level.String(), message
+		var err error
+		if line, err = json.Marshal(all); err != nil {
+			line, _ = json.Marshal(Fields{"time": now, "level": level.String(), "msg": message, "error": err.Error()})
+		}
+	} else {
+		line = []byte(now.Format(time.RFC3339Nano) + " " + strings.ToUpper(level.String()) + " " + message)
+		names := make([]string, 0, len(all))
+		for name := range all {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			line = append(line, " "+name+"="+textValue(all[name])...)
+		}
+	}
+	line = append(line, '\n')
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.out.Write(line)
+}
+
+// textValue formats value for the text format, quoting it where needed
+func textValue(value interface{}) string {
+	var text string
+	switch v := value.(type) {
+	case string:
+		text = v
+	case time.Time:
+		text = v.Format(time.RFC3339Nano)
+	default:
+		text = fmt.Sprint(v)
+	}
+	if text == "" || strings.ContainsAny(text, " \"=\t\r\n") {
+		return strconv.Quote(text)
+	}
+	return text
+}
+
+// RequestID returns the ID of r, set when the server received it
+func RequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey).(string)
+	return id
+}
+
+func withRequestID(r *http.Request, id string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestIDContextKey, id))
+}
+
+// newRequestID takes the ID of r from its header or generates one
+func newRequestID(r *http.Request) string {
+	if id := r.Header.Get(RequestIDHeader); validRequestID.MatchString(id) {
+		return id
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// statusRecorder remembers the status of a response for the request log
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// code returns the status sent, net/http sends 200 if the handler did not
+// write anything
+func (w *statusRecorder) code() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// Flush keeps event and replication streams working through the recorder
+func (w *statusRecorder) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// logRequest logs a request once it was answered
+func logRequest(r *http.Request, status int, latency time.Duration) {
+	level := LevelInfo
+	if status >= http.StatusInternalServerError {
+		level = LevelError
+	}
+	logger().Log(level, "request", Fields{
+		"requestId":  RequestID(r),
+		"method":     r.Method,
+		"key":        r.URL.Path[1:],
+		"status":     status,
+		"latencyMs":  float64(latency.Nanoseconds()) / 1e6,
+		"principal":  Principal(r),
+		"remoteAddr": r.RemoteAddr,
+	})
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoggerFormats(t *testing.T) {
+	_, err := ParseLevel("verbose")
+	assert.NotNil(t, err)
+	level, err := ParseLevel("WARN")
+	assert.Nil(t, err)
+	assert.Equal(t, LevelWarn, level)
+	_, err = NewLogger(&bytes.Buffer{}, LevelInfo, "xml")
+	assert.NotNil(t, err)
+
+	var out bytes.Buffer
+	l, err := NewLogger(&out, LevelWarn, "text")
+	assert.Nil(t, err)
+	l.Info("skipped")
+	l.With(Fields{"key": "a/b"}).Warn("Expiring failed", Fields{"error": errors.New("disk full")})
+	assert.NotContains(t, out.String(), "skipped")
+	assert.Contains(t, out.String(), ` WARN Expiring failed error="disk full" key=a/b`+"\n")
+
+	out.Reset()
+	l, _ = NewLogger(&out, LevelDebug, "json")
+	l.Debug("request", Fields{"status": 200, "error": errors.New("none")})
+	var line map[string]interface{}
+	assert.Nil(t, json.Unmarshal(out.Bytes(), &line))
+	assert.Equal(t, "debug", line["level"])
+	assert.Equal(t, "request", line["msg"])
+	assert.Equal(t, float64(200), line["status"])
+	assert.Equal(t, "none", line["error"])
+	assert.NotNil(t, line["time"])
+}
+
+func TestRequestID(t *testing.T) {
+	cleanData()
+	ids := make(chan string, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("key") == "a/b" {
+			ids <- r.Header.Get(RequestIDHeader)
+		}
+	}))
+	defer hook.Close()
+	s := NewServer(testDataPath, nil, []string{hook.URL})
+
+	req, _ := http.NewRequest("PUT", "http://localhost/a/b", strings.NewReader(url.Values{"value": {"1"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set(RequestIDHeader, "deploy-42")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "deploy-42", w.Header().Get(RequestIDHeader))
+	assert.Equal(t, "deploy-42", <-ids)
+
+	// missing or invalid IDs are replaced
+	req, _ = http.NewRequest("GET", "http://localhost/a/b", nil)
+	req.Header.Set(RequestIDHeader, "not valid")
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	assert.Len(t, w.Header().Get(RequestIDHeader), 32)
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// storageStatsMaxAge is how long the storage counts are reused, so
+// frequent scrapes do not walk the data path every time
+const storageStatsMaxAge = 10 * time.Second
+
+// latencyBuckets are the upper bounds of the request latency histogram in
+// seconds
+var latencyBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// counters updated without locks wherever the events happen
+var (
+	cacheHits      uint64
+	cacheMisses    uint64
+	hooksDelivered uint64
+	hooksRejected  uint64
+	hooksFailed    uint64
+)
+
+// requestSeries counts the requests of one method and status
+type requestSeries struct {
+	count   uint64
+	nanos   uint64
+	buckets []uint64
+}
+
+// requestMetrics counts requests by method and status. A series is only
+// created once, afterwards requests just add to its counters.
+type requestMetrics struct {
+	mutex  sync.RWMutex
+	series map[string]*requestSeries
+}
+
+func newRequestMetrics() *requestMetrics {
+	return &requestMetrics{series: make(map[string]*requestSeries)}
+}
+
+// metricMethod limits the methods in labels to the known ones
+func metricMethod(method string) string {
+	switch method {
+	case "GET", "HEAD", "PUT", "POST", "DELETE", "OPTIONS", "PATCH":
+		return method
+	}
+	return "OTHER"
+}
+
+func (m *requestMetrics) observe(method string, status int, latency time.Duration) {
+	name := metricMethod(method) + " " + strconv.Itoa(status)
+	m.mutex.RLock()
+	series, ok := m.series[name]
+	m.mutex.RUnlock()
+	if !ok {
+		m.mutex.Lock()
+		if series, ok = m.series[name]; !ok {
+			series = &requestSeries{buckets: make([]uint64, len(latencyBuckets))}
+			m.series[name] = series
+		}
+		m.mutex.Unlock()
+	}
+
+	seconds := latency.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			atomic.AddUint64(&series.buckets[i], 1)
+			break
+		}
+	}
+	atomic.AddUint64(&series.nanos, uint64(latency.Nanoseconds()))
+	atomic.AddUint64(&series.count, 1)
+}
+
+// writeTo writes the request counters and latency histograms
+func (m *requestMetrics) writeTo(out *bytes.Buffer) {
+	m.mutex.RLock()
+	names := make([]string, 0, len(m.series))
+	series := make(map[string]*requestSeries, len(m.series))
+	for name, s := range m.series {
+		names = append(names, name)
+		series[name] = s
+	}
+	m.mutex.RUnlock()
+	sort.Strings(names)
+
+	writeMetricHeader(out, "skvs_requests_total", "counter", "Requests answered, by method and status.")
+	for _, name := range names {
+		method, status := splitSeriesName(name)
+		fmt.Fprintf(out, "skvs_requests_total{method=%q,status=%q} %d\n", method, status, atomic.LoadUint64(&series[name].count))
+	}
+
+	writeMetricHeader(out, "skvs_request_duration_seconds", "histogram", "Time taken to answer requests, by method and status.")
+	for _, name := range names {
+		method, status := splitSeriesName(name)
+		s := series[name]
+		count := atomic.LoadUint64(&s.count)
+		var cumulative uint64
+		for i, bound := range latencyBuckets {
+			cumulative += atomic.LoadUint64(&s.buckets[i])
+			if cumulative > count {
+				// the count is added last, don't report more than it
+				cumulative = count
+			}
+			fmt.Fprintf(out, "skvs_request_duration_seconds_bucket{method=%q,status=%q,le=%q} %d\n", method, status, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(out, "skvs_request_duration_seconds_bucket{method=%q,status=%q,le=\"+Inf\"} %d\n", method, status, count)
+		fmt.Fprintf(out, "skvs_request_duration_seconds_sum{method=%q,status=%q} %g\n", method, status, float64(atomic.LoadUint64(&s.nanos))/1e9)
+		fmt.Fprintf(out, "skvs_request_duration_seconds_count{method=%q,status=%q} %d\n", method, status, count)
+	}
+}
+
+func splitSeriesName(name string) (string, string) {
+	parts := strings.SplitN(name, " ", 2)
+	return parts[0], parts[1]
+}
+
+func writeMetricHeader(out *bytes.Buffer, name, kind, help string) {
+	fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeMetric(out *bytes.Buffer, name, kind, help string, value interface{}) {
+	writeMetricHeader(out, name, kind, help)
+	fmt.Fprintf(out, "%s %v\n", name, value)
+}
+
+// storageCounts keeps the last result of countStorage
+type storageCounts struct {
+	mutex      sync.Mutex
+	counted    time.Time
+	keys       int64
+	namespaces int64
+	size       int64
+}
+
+// storageStats returns the counts of countStorage, at most
+// storageStatsMaxAge old
+func (s *Server) storageStats() (keys, namespaces, size int64) {
+	counts := &s.storageCounts
+	counts.mutex.Lock()
+	defer counts.mutex.Unlock()
+	if time.Since(counts.counted) >= storageStatsMaxAge {
+		counts.keys, counts.namespaces, counts.size = s.countStorage()
+		counts.counted = time.Now()
+	}
+	return counts.keys, counts.namespaces, counts.size
+}
+
+// countStorage counts the keys and namespaces and the bytes of all files
+// below the data path, including the system files
+func (s *Server) countStorage() (keys, namespaces, size int64) {
+	filepath.Walk(s.dataPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		key, _ := filepath.Rel(s.dataPath, path)
+		key = filepath.ToSlash(key)
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		switch {
+		case key == "." || isReservedKey(key):
+		case info.IsDir():
+			namespaces++
+		default:
+			keys++
+		}
+		return nil
+	})
+	return
+}
+
+// serveMetrics answers GET /_/metrics in the Prometheus text format
+func (s *Server) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeResponse(w, ResponseData{StatusCode: http.StatusMethodNotAllowed, Key: r.URL.Path[1:], Error: "Only GET is allowed."})
+		return
+	}
+
+	var out bytes.Buffer
+	s.requestMetrics.writeTo(&out)
+	writeMetric(&out, "skvs_cache_hits_total", "counter", "Reads answered from the cache.", atomic.LoadUint64(&cacheHits))
+	writeMetric(&out, "skvs_cache_misses_total", "counter", "Reads of cacheable keys that went to disk.", atomic.LoadUint64(&cacheMisses))
+	writeMetric(&out, "skvs_cache_entries", "gauge", "Keys and namespaces in the cache.", cacheSize())
+	keys, namespaces, size := s.storageStats()
+	writeMetric(&out, "skvs_keys", "gauge", "Keys stored.", keys)
+	writeMetric(&out, "skvs_namespaces", "gauge", "Namespaces stored.", namespaces)
+	writeMetric(&out, "skvs_disk_bytes", "gauge", "Bytes of all files in the data path.", size)
+	writeMetricHeader(&out, "skvs_webhook_deliveries_total", "counter", "Web hook calls by outcome: delivered, rejected with an error status or failed.")
+	fmt.Fprintf(&out, "skvs_webhook_deliveries_total{outcome=\"delivered\"} %d\n", atomic.LoadUint64(&hooksDelivered))
+	fmt.Fprintf(&out, "skvs_webhook_deliveries_total{outcome=\"rejected\"} %d\n", atomic.LoadUint64(&hooksRejected))
+	fmt.Fprintf(&out, "skvs_webhook_deliveries_total{outcome=\"failed\"} %d\n", atomic.LoadUint64(&hooksFailed))
+	writeMetric(&out, "skvs_webhook_queue_depth", "gauge", "Web hook calls waiting for an answer.", pendingHookCount())
+	writeMetric(&out, "skvs_watchers", "gauge", "Clients streaming /_/events.", feedFor(s.dataPath).size())
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	w.Write(out.Bytes())
+}
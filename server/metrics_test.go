@@ -0,0 +1,80 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func scrape(t *testing.T, s *Server) string {
+	w := sendAs(s, "", "GET", "_/metrics", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain"))
+	return w.Body.String()
+}
+
+func TestMetrics(t *testing.T) {
+	cleanData()
+	delivered := atomic.LoadUint64(&hooksDelivered)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer hook.Close()
+	s := NewServer(testDataPath, nil, []string{hook.URL})
+
+	assert.Equal(t, http.StatusOK, sendRequest(s.ServeHTTP, "PUT", "ns/a", url.Values{"value": {"12345"}}))
+	assert.Equal(t, http.StatusOK, sendRequest(s.ServeHTTP, "PUT", "b", url.Values{"value": {"1"}}))
+	assert.Equal(t, http.StatusOK, sendRequest(s.ServeHTTP, "GET", "b", nil))
+	assert.Equal(t, http.StatusOK, sendRequest(s.ServeHTTP, "GET", "b", nil))
+	assert.Equal(t, http.StatusNotFound, sendRequest(s.ServeHTTP, "GET", "missing", nil))
+	// the hooks for ns, ns/a and b
+	waitFor(t, func() bool { return atomic.LoadUint64(&hooksDelivered) >= delivered+3 })
+
+	sub := subscribeChanges(testDataPath, "")
+	defer unsubscribeChanges(testDataPath, sub)
+
+	metrics := scrape(t, s)
+	assert.Contains(t, metrics, "# TYPE skvs_requests_total counter\n")
+	assert.Contains(t, metrics, `skvs_requests_total{method="PUT",status="200"} 2`+"\n")
+	assert.Contains(t, metrics, `skvs_requests_total{method="GET",status="200"} 2`+"\n")
+	assert.Contains(t, metrics, `skvs_requests_total{method="GET",status="404"} 1`+"\n")
+	assert.Contains(t, metrics, `skvs_request_duration_seconds_bucket{method="PUT",status="200",le="+Inf"} 2`+"\n")
+	assert.Contains(t, metrics, `skvs_request_duration_seconds_count{method="GET",status="404"} 1`+"\n")
+	assert.Contains(t, metrics, "skvs_keys 2\n")
+	assert.Contains(t, metrics, "skvs_namespaces 1\n")
+	assert.Contains(t, metrics, "skvs_disk_bytes 6\n")
+	assert.Contains(t, metrics, "skvs_watchers 1\n")
+	assert.Contains(t, metrics, "skvs_webhook_queue_depth 0\n")
+	assert.Contains(t, metrics, "skvs_cache_hits_total ")
+	assert.Contains(t, metrics, `skvs_webhook_deliveries_total{outcome="delivered"} `)
+
+	// the scrape itself is counted by the next one
+	assert.Contains(t, scrape(t, s), `skvs_requests_total{method="GET",status="200"} 3`+"\n")
+	assert.Equal(t, http.StatusMethodNotAllowed, sendRequest(s.ServeHTTP, "POST", "_/metrics", nil))
+
+	// the data path is walked again once the counts are too old
+	assert.Equal(t, http.StatusOK, sendRequest(s.ServeHTTP, "PUT", "c", url.Values{"value": {"1"}}))
+	assert.Contains(t, scrape(t, s), "skvs_keys 2\n")
+	s.storageCounts.counted = time.Now().Add(-storageStatsMaxAge)
+	assert.Contains(t, scrape(t, s), "skvs_keys 3\n")
+}
+
+func TestRequestMetricsBuckets(t *testing.T) {
+	m := newRequestMetrics()
+	m.observe("GET", 200, 3*time.Millisecond)
+	m.observe("GET", 200, 20*time.Second)
+	m.observe("BREW", 418, time.Millisecond)
+	var out bytes.Buffer
+	m.writeTo(&out)
+	assert.Contains(t, out.String(), `skvs_request_duration_seconds_bucket{method="GET",status="200",le="0.001"} 0`+"\n")
+	assert.Contains(t, out.String(), `skvs_request_duration_seconds_bucket{method="GET",status="200",le="0.005"} 1`+"\n")
+	assert.Contains(t, out.String(), `skvs_request_duration_seconds_bucket{method="GET",status="200",le="10"} 1`+"\n")
+	assert.Contains(t, out.String(), `skvs_request_duration_seconds_bucket{method="GET",status="200",le="+Inf"} 2`+"\n")
+	assert.Contains(t, out.String(), `skvs_request_duration_seconds_sum{method="GET",status="200"} 20.003`+"\n")
+	assert.Contains(t, out.String(), `skvs_requests_total{method="OTHER",status="418"} 1`+"\n")
+}
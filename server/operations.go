@@ -0,0 +1,74 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// applyOperation executes a POST request with an 'op' parameter on key and
+// returns the change it made and the resulting value
+func (s *Server) applyOperation(op, key, keyPath string, exempt bool, form url.Values) (Event, string, error) {
+	change := Event{Key: key, Action: "POST"}
+	var value string
+	var err error
+
+	switch op {
+	case "incr", "decr":
+		value, err = s.applyCounter(op, key, keyPath, exempt, form)
+	case "push":
+		change.Key, value, err = s.applyPush(key, keyPath, form.Get("value"))
+	case "pop":
+		change.Key, value, err = s.applyPop(key, keyPath)
+		change.Action = "DELETE"
+	default:
+		err = &requestError{http.StatusBadRequest, "Unknown operation '" + op + "'."}
+	}
+	return change, value, err
+}
+
+// applyCounter adds ('incr') or subtracts ('decr') the 'by' parameter,
+// default 1, to the integer stored at key. A missing key starts at the
+// 'init' parameter, default 0.
+func (s *Server) applyCounter(op, key, keyPath string, exempt bool, form url.Values) (string, error) {
+	by := int64(1)
+	if form.Get("by") != "" {
+		var err error
+		if by, err = strconv.ParseInt(form.Get("by"), 10, 64); err != nil {
+			return "", &requestError{http.StatusBadRequest, "Parameter 'by' is not an integer."}
+		}
+	}
+	start := int64(0)
+	if form.Get("init") != "" {
+		var err error
+		if start, err = strconv.ParseInt(form.Get("init"), 10, 64); err != nil {
+			return "", &requestError{http.StatusBadRequest, "Parameter 'init' is not an integer."}
+		}
+	}
+	if op == "decr" {
+		if by == math.MinInt64 {
+			return "", &requestError{http.StatusBadRequest, "Parameter 'by' is out of range."}
+		}
+		by = -by
+	}
+
+	return updateKey(keyPath, exempt, func(value string, exists bool) (string, error) {
+		if !exists {
+			value = strconv.FormatInt(start, 10)
+		}
+
+		current, err := strconv.ParseInt(value, 10, 64)
+		if err != nil && s.secrets.covers(key) {
+			return "", &requestError{http.StatusUnprocessableEntity, "The value is not an integer."}
+		} else if err != nil {
+			return "", &requestError{http.StatusUnprocessableEntity, "Value '" + value + "' is not an integer."}
+		}
+		if (by > 0 && current > math.MaxInt64-by) || (by < 0 && current < math.MinInt64-by) {
+			return "", &requestError{http.StatusUnprocessableEntity, "Counter would overflow."}
+		}
+
+		next := strconv.FormatInt(current+by, 10)
+		return next, s.validate(key, next)
+	})
+}
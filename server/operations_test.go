@@ -0,0 +1,109 @@
+package server
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func postOperation(handler http.HandlerFunc, key, query string) (int, ResponseData) {
+	req, _ := http.NewRequest("POST", "http://localhost/"+key+"?"+query, nil)
+	w := httptest.NewRecorder()
+	handler(w, req)
+	var responseData ResponseData
+	json.Unmarshal(w.Body.Bytes(), &responseData)
+	return w.Code, responseData
+}
+
+func TestCounter(t *testing.T) {
+	cleanData()
+	handler := NewServerHandler(testDataPath, nil, nil)
+
+	code, responseData := postOperation(handler, "zero", "op=incr")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "1", responseData.Value)
+	code, responseData = postOperation(handler, "negative", "op=decr&by=2")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "-2", responseData.Value)
+	code, _ = postOperation(handler, "invalid", "op=incr&init=x")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, responseData = postOperation(handler, "counter", "op=incr&init=10")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "11", responseData.Value)
+
+	code, responseData = postOperation(handler, "counter", "op=incr&by=5&init=100")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "16", responseData.Value)
+
+	code, responseData = postOperation(handler, "counter", "op=decr&by=20")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "-4", responseData.Value)
+
+	entry, err := readKey(expandPath("counter"), false)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"-4"}, entry.data)
+
+	code, _ = postOperation(handler, "counter", "op=incr&by=x")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = postOperation(handler, "counter", "op=frobnicate")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestCounterRejectsInvalidValues(t *testing.T) {
+	cleanData()
+	handler := NewServerHandler(testDataPath, nil, nil)
+
+	assert.Nil(t, putKey(expandPath("text"), false, "foobar"))
+	code, _ := postOperation(handler, "text", "op=incr")
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+
+	assert.Nil(t, putKey(expandPath("ns/child"), false, "1"))
+	code, _ = postOperation(handler, "ns", "op=incr")
+	assert.Equal(t, http.StatusConflict, code)
+
+	assert.Nil(t, putKey(expandPath("max"), false, strconv.FormatInt(math.MaxInt64, 10)))
+	code, _ = postOperation(handler, "max", "op=incr")
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+}
+
+func TestCounterIsAtomic(t *testing.T) {
+	cleanData()
+	handler := NewServerHandler(testDataPath, nil, nil)
+	const workers = 8
+	const iterations = 50
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	seen := make(map[string]bool)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				code, responseData := postOperation(handler, "sequence", "op=incr&init=0")
+				if code != http.StatusOK {
+					t.Errorf("Unexpected status %d", code)
+					return
+				}
+				mutex.Lock()
+				if seen[responseData.Value] {
+					t.Errorf("Value %s handed out twice", responseData.Value)
+				}
+				seen[responseData.Value] = true
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	entry, err := readKey(expandPath("sequence"), false)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{strconv.Itoa(workers * iterations)}, entry.data)
+}
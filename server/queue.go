@@ -0,0 +1,116 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// sequential children are named by a zero-padded number of this width, so
+// their names sort like their numbers
+const sequenceDigits = 10
+
+func sequenceName(n uint64) string {
+	return fmt.Sprintf("%0*d", sequenceDigits, n)
+}
+
+// parseSequenceName returns the number of a sequential child
+func parseSequenceName(name string) (uint64, bool) {
+	if len(name) != sequenceDigits {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(name, 10, 64)
+	return n, err == nil
+}
+
+// sequentialChildren returns the names of the sequential children of the
+// namespace at path in ascending order
+func sequentialChildren(path string) ([]string, error) {
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, f := range files {
+		if _, ok := parseSequenceName(f.Name()); ok && !f.IsDir() {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// nextSequence returns the next number for the namespace at path. The last
+// number is kept in the reserved part of the data path, so numbers are
+// never reused, even after all children were popped.
+func (s *Server) nextSequence(key, path string) (uint64, error) {
+	// '.' is not allowed in keys, so this never collides with nested namespaces
+	counterPath := s.systemPath(filepath.Join("sequences", key, ".last"))
+	var last uint64
+	if content, err := ioutil.ReadFile(counterPath); err == nil {
+		if last, err = strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64); err != nil {
+			return 0, err
+		}
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	// children may have been created without SKVS knowing
+	if children, err := sequentialChildren(path); err == nil && len(children) > 0 {
+		if n, _ := parseSequenceName(children[len(children)-1]); n > last {
+			last = n
+		}
+	}
+
+	next := last + 1
+	return next, writeFileAtomic(counterPath, []byte(strconv.FormatUint(next, 10)))
+}
+
+// applyPush creates a sequential child of the namespace key holding value
+// and returns its key
+func (s *Server) applyPush(key, keyPath, value string) (string, string, error) {
+	unlock := lockPath(keyPath)
+	defer unlock()
+
+	if info, err := os.Stat(keyPath); err == nil && !info.IsDir() {
+		return "", "", &requestError{http.StatusConflict, "'" + key + "' is not a namespace."}
+	}
+
+	n, err := s.nextSequence(key, keyPath)
+	if err != nil {
+		return "", "", err
+	}
+	childKey := key + "/" + sequenceName(n)
+	if err = s.validate(childKey, value); err != nil {
+		return "", "", err
+	}
+	childPath := filepath.Join(keyPath, sequenceName(n))
+	return childKey, value, putKey(childPath, isExemptFromCache(childKey, s.cacheExemptionList), value)
+}
+
+// applyPop removes the sequential child of the namespace key with the
+// lowest number and returns its key and value
+func (s *Server) applyPop(key, keyPath string) (string, string, error) {
+	unlock := lockPath(keyPath)
+	defer unlock()
+
+	children, err := sequentialChildren(keyPath)
+	if os.IsNotExist(err) || len(children) == 0 {
+		return "", "", &requestError{http.StatusNotFound, "Queue '" + key + "' is empty."}
+	} else if err != nil {
+		return "", "", err
+	}
+
+	childKey := key + "/" + children[0]
+	childPath := filepath.Join(keyPath, children[0])
+	entry, err := readKey(childPath, true)
+	if err != nil {
+		return "", "", err
+	}
+	return childKey, entry.data[0], deleteKey(childPath)
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSequenceName(t *testing.T) {
+	assert.Equal(t, "0000000042", sequenceName(42))
+	n, ok := parseSequenceName("0000000042")
+	assert.True(t, ok)
+	assert.Equal(t, uint64(42), n)
+	_, ok = parseSequenceName("42")
+	assert.False(t, ok)
+}
+
+func TestPushPop(t *testing.T) {
+	cleanData()
+	handler := NewServerHandler(testDataPath, nil, nil)
+
+	code, _ := postOperation(handler, "jobs", "op=pop")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	for _, job := range []string{"first", "second", "third"} {
+		code, responseData := postOperation(handler, "jobs", "sequential=true&"+url.Values{"value": {job}}.Encode())
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, job, responseData.Value)
+	}
+	entry, err := readKey(expandPath("jobs"), false)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"0000000001", "0000000002", "0000000003"}, entry.data)
+
+	code, responseData := postOperation(handler, "jobs", "op=pop")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "jobs/0000000001", responseData.Key)
+	assert.Equal(t, "first", responseData.Value)
+
+	code, responseData = postOperation(handler, "jobs", "op=pop")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "second", responseData.Value)
+	code, responseData = postOperation(handler, "jobs", "op=pop")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "third", responseData.Value)
+	code, _ = postOperation(handler, "jobs", "op=pop")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	// numbers are not reused once the queue ran empty
+	code, responseData = postOperation(handler, "jobs", "sequential=true&value=fourth")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "jobs/0000000004", responseData.Key)
+}
+
+func TestPushOntoValue(t *testing.T) {
+	cleanData()
+	handler := NewServerHandler(testDataPath, nil, nil)
+	assert.Nil(t, putKey(expandPath("jobs"), false, "foobar"))
+	code, _ := postOperation(handler, "jobs", "sequential=true&value=x")
+	assert.Equal(t, http.StatusConflict, code)
+}
+
+func TestConcurrentPushPop(t *testing.T) {
+	cleanData()
+	handler := NewServerHandler(testDataPath, nil, nil)
+	const workers = 4
+	const jobs = 25
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < jobs; j++ {
+				if code, _ := postOperation(handler, "queue", "sequential=true&value=job"); code != http.StatusOK {
+					t.Errorf("Unexpected status %d", code)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	var mutex sync.Mutex
+	popped := make(map[string]bool)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				code, responseData := postOperation(handler, "queue", "op=pop")
+				if code == http.StatusNotFound {
+					return
+				}
+				mutex.Lock()
+				if popped[responseData.Key] {
+					t.Errorf("'%s' popped twice", responseData.Key)
+				}
+				popped[responseData.Key] = true
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Len(t, popped, workers*jobs)
+}
@@ -0,0 +1,806 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	errNotLeader     = &requestError{http.StatusServiceUnavailable, "This node is not the cluster leader."}
+	errLeaderChanged = &requestError{http.StatusServiceUnavailable, "The cluster leader changed before the change was committed, it may or may not have been applied."}
+	errCommitTimeout = &requestError{http.StatusServiceUnavailable, "No majority of the cluster answered in time, a change may or may not have been applied."}
+)
+
+const (
+	raftFollower  = "follower"
+	raftCandidate = "candidate"
+	raftLeader    = "leader"
+
+	// raftBatchSize limits the entries sent with one append request
+	raftBatchSize = 256
+)
+
+// raftEntry is an entry of the replicated log: a command, a new set of
+// members or, with neither, the no-op a leader starts its term with
+type raftEntry struct {
+	Index   uint64          `json:"index"`
+	Term    uint64          `json:"term"`
+	Command *clusterCommand `json:"command,omitempty"`
+	Members []string        `json:"members,omitempty"`
+}
+
+type raftVoteRequest struct {
+	Term         uint64 `json:"term"`
+	Candidate    string `json:"candidate"`
+	LastLogIndex uint64 `json:"lastLogIndex"`
+	LastLogTerm  uint64 `json:"lastLogTerm"`
+}
+
+type raftVoteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+type raftAppendRequest struct {
+	Term         uint64      `json:"term"`
+	Leader       string      `json:"leader"`
+	PrevLogIndex uint64      `json:"prevLogIndex"`
+	PrevLogTerm  uint64      `json:"prevLogTerm"`
+	Entries      []raftEntry `json:"entries,omitempty"`
+	LeaderCommit uint64      `json:"leaderCommit"`
+}
+
+type raftAppendResponse struct {
+	Term    uint64 `json:"term"`
+	Success bool   `json:"success"`
+	// LastIndex lets the leader skip back to the end of a shorter log
+	LastIndex uint64 `json:"lastIndex"`
+}
+
+// raftState is persisted before answering any request that depends on it.
+// Applying is the entry being applied, if it is still set on start the
+// entry may have been applied without Applied being saved.
+type raftState struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"votedFor"`
+	Applied  uint64 `json:"applied"`
+	Applying uint64 `json:"applying,omitempty"`
+}
+
+type raftResult struct {
+	response *recordedResponse
+	err      error
+}
+
+type raftWaiter struct {
+	term uint64
+	done chan raftResult
+}
+
+// raftNode implements the Raft consensus algorithm: leader election, log
+// replication and single-server membership changes. The log is kept in
+// full, so nodes that join later replay it from the start. It is never
+// compacted: its memory and disk use and the time to replay it grow with
+// every change.
+type raftNode struct {
+	id                string
+	dir               string
+	transport         func(peer, rpc string, request, response interface{}) error
+	apply             func(raftEntry) *recordedResponse
+	electionTimeout   time.Duration
+	heartbeatInterval time.Duration
+
+	mutex       sync.Mutex
+	state       raftState
+	log         []raftEntry
+	members     []string
+	role        string
+	leader      string
+	commitIndex uint64
+	deadline    time.Time
+	nextIndex   map[string]uint64
+	matchIndex  map[string]uint64
+	inFlight    map[string]bool
+	waiters     map[uint64]raftWaiter
+	committed   chan struct{}
+	applied     chan struct{}
+	stop        chan struct{}
+	running     sync.WaitGroup
+}
+
+// newRaftNode loads the node's state from dir. A node without a log starts
+// with peers as members, or waits to be added to a cluster if there are
+// none.
+func newRaftNode(id, dir string, peers []string) (*raftNode, error) {
+	n := &raftNode{
+		id:         id,
+		dir:        dir,
+		role:       raftFollower,
+		nextIndex:  make(map[string]uint64),
+		matchIndex: make(map[string]uint64),
+		inFlight:   make(map[string]bool),
+		waiters:    make(map[uint64]raftWaiter),
+		committed:  make(chan struct{}, 1),
+		applied:    make(chan struct{}),
+		stop:       make(chan struct{}),
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	if content, err := ioutil.ReadFile(n.statePath()); err == nil {
+		if err = json.Unmarshal(content, &n.state); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := n.loadLog(); err != nil {
+		return nil, err
+	}
+
+	if len(n.log) == 0 && len(peers) > 0 {
+		if err := n.appendLog([]raftEntry{{Index: 1, Members: peers}}); err != nil {
+			return nil, err
+		}
+	}
+	n.members = n.latestMembers()
+	n.commitIndex = n.state.Applied
+	return n, nil
+}
+
+// interrupted reports whether the node stopped while applying an entry, so
+// its data may or may not reflect that entry
+func (n *raftNode) interrupted() bool {
+	return n.state.Applying > n.state.Applied
+}
+
+// replayLog makes the node apply its log again from the start, for data
+// that was reset after an interrupted apply
+func (n *raftNode) replayLog() error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.state.Applied, n.state.Applying = 0, 0
+	n.commitIndex = 0
+	return n.persistState()
+}
+
+func (n *raftNode) statePath() string {
+	return filepath.Join(n.dir, "state.json")
+}
+
+func (n *raftNode) logPath() string {
+	return filepath.Join(n.dir, "log.jsonl")
+}
+
+func (n *raftNode) loadLog() error {
+	f, err := os.Open(n.logPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	decoder := json.NewDecoder(bufio.NewReader(f))
+	for decoder.More() {
+		var entry raftEntry
+		if err := decoder.Decode(&entry); err != nil {
+			return err
+		}
+		n.log = append(n.log, entry)
+	}
+	return nil
+}
+
+// persistState must be called with the mutex held
+func (n *raftNode) persistState() error {
+	content, err := json.Marshal(n.state)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(n.statePath(), content)
+}
+
+// appendLog must be called with the mutex held
+func (n *raftNode) appendLog(entries []raftEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	for i := range entries {
+		encoder.Encode(&entries[i])
+	}
+
+	f, err := os.OpenFile(n.logPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err = f.Write(buffer.Bytes()); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	n.log = append(n.log, entries...)
+	return nil
+}
+
+// truncateLog removes the entries from index on, must be called with the
+// mutex held
+func (n *raftNode) truncateLog(index uint64) error {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	for i := range n.log[:index-1] {
+		encoder.Encode(&n.log[i])
+	}
+	if err := writeFileAtomic(n.logPath(), buffer.Bytes()); err != nil {
+		return err
+	}
+	n.log = n.log[:index-1]
+	for i, waiter := range n.waiters {
+		if i >= index {
+			waiter.done <- raftResult{err: errLeaderChanged}
+			delete(n.waiters, i)
+		}
+	}
+	return nil
+}
+
+func (n *raftNode) lastIndex() uint64 {
+	return uint64(len(n.log))
+}
+
+func (n *raftNode) termAt(index uint64) uint64 {
+	if index == 0 || index > n.lastIndex() {
+		return 0
+	}
+	return n.log[index-1].Term
+}
+
+// latestMembers returns the members of the last configuration in the log,
+// committed or not
+func (n *raftNode) latestMembers() []string {
+	for i := len(n.log) - 1; i >= 0; i-- {
+		if n.log[i].Members != nil {
+			return append([]string(nil), n.log[i].Members...)
+		}
+	}
+	return nil
+}
+
+func (n *raftNode) latestConfigIndex() uint64 {
+	for i := len(n.log) - 1; i >= 0; i-- {
+		if n.log[i].Members != nil {
+			return n.log[i].Index
+		}
+	}
+	return 0
+}
+
+func (n *raftNode) isMember(id string) bool {
+	for _, member := range n.members {
+		if member == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *raftNode) quorum() int {
+	return len(n.members)/2 + 1
+}
+
+func (n *raftNode) resetDeadline() {
+	n.deadline = time.Now().Add(n.electionTimeout + time.Duration(rand.Int63n(int64(n.electionTimeout))))
+}
+
+func (n *raftNode) start() {
+	n.mutex.Lock()
+	n.resetDeadline()
+	n.mutex.Unlock()
+	n.running.Add(2)
+	go n.run()
+	go n.applyCommitted()
+}
+
+func (n *raftNode) shutdown() {
+	close(n.stop)
+	n.running.Wait()
+}
+
+func (n *raftNode) run() {
+	defer n.running.Done()
+	ticker := time.NewTicker(n.heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-ticker.C:
+		}
+
+		n.mutex.Lock()
+		if n.role == raftLeader {
+			n.broadcast()
+		} else if time.Now().After(n.deadline) && n.isMember(n.id) {
+			n.startElection()
+		}
+		n.mutex.Unlock()
+	}
+}
+
+// signal wakes up waiters on ch without blocking
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// becomeFollower must be called with the mutex held
+func (n *raftNode) becomeFollower(term uint64) {
+	if term > n.state.Term {
+		n.state.Term = term
+		n.state.VotedFor = ""
+		n.persistState()
+	}
+	if n.role == raftLeader {
+		n.leader = ""
+	}
+	n.role = raftFollower
+}
+
+// startElection must be called with the mutex held
+func (n *raftNode) startElection() {
+	n.state.Term++
+	n.state.VotedFor = n.id
+	if err := n.persistState(); err != nil {
+		return
+	}
+	n.role = raftCandidate
+	n.leader = ""
+	n.resetDeadline()
+
+	votes := 1
+	if votes >= n.quorum() {
+		n.becomeLeader()
+		return
+	}
+	request := raftVoteRequest{Term: n.state.Term, Candidate: n.id, LastLogIndex: n.lastIndex(), LastLogTerm: n.termAt(n.lastIndex())}
+	for _, peer := range n.members {
+		if peer == n.id {
+			continue
+		}
+		go func(peer string) {
+			var response raftVoteResponse
+			if err := n.transport(peer, "vote", request, &response); err != nil {
+				return
+			}
+			n.mutex.Lock()
+			defer n.mutex.Unlock()
+			if response.Term > n.state.Term {
+				n.becomeFollower(response.Term)
+				return
+			}
+			if n.role != raftCandidate || n.state.Term != request.Term || !response.Granted {
+				return
+			}
+			votes++
+			if votes >= n.quorum() {
+				n.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+// becomeLeader must be called with the mutex held
+func (n *raftNode) becomeLeader() {
+	// committing an entry of its own term also commits those of previous
+	// leaders and lets reads know the commit index is current. Without it
+	// the node stays a follower until the next election.
+	if err := n.appendLog([]raftEntry{{Index: n.lastIndex() + 1, Term: n.state.Term}}); err != nil {
+		logger().Error("Becoming the Raft leader failed", Fields{"term": n.state.Term, "error": err})
+		n.role = raftFollower
+		return
+	}
+	n.role = raftLeader
+	n.leader = n.id
+	n.nextIndex = make(map[string]uint64)
+	n.matchIndex = make(map[string]uint64)
+	n.inFlight = make(map[string]bool)
+	n.advanceCommit()
+	n.broadcast()
+}
+
+// broadcast sends the missing entries, or a heartbeat, to every member
+// without a request in flight. It must be called with the mutex held.
+func (n *raftNode) broadcast() {
+	for _, peer := range n.members {
+		if peer != n.id && !n.inFlight[peer] {
+			n.inFlight[peer] = true
+			go n.replicate(peer)
+		}
+	}
+}
+
+// appendRequest must be called with the mutex held
+func (n *raftNode) appendRequest(peer string) raftAppendRequest {
+	next, ok := n.nextIndex[peer]
+	if !ok || next < 1 {
+		next = n.lastIndex() + 1
+		n.nextIndex[peer] = next
+	}
+	end := next - 1 + raftBatchSize
+	if end > n.lastIndex() {
+		end = n.lastIndex()
+	}
+	return raftAppendRequest{
+		Term:         n.state.Term,
+		Leader:       n.id,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  n.termAt(next - 1),
+		Entries:      append([]raftEntry(nil), n.log[next-1:end]...),
+		LeaderCommit: n.commitIndex,
+	}
+}
+
+func (n *raftNode) replicate(peer string) {
+	n.mutex.Lock()
+	if n.role != raftLeader {
+		n.inFlight[peer] = false
+		n.mutex.Unlock()
+		return
+	}
+	request := n.appendRequest(peer)
+	n.mutex.Unlock()
+
+	var response raftAppendResponse
+	err := n.transport(peer, "append", request, &response)
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.inFlight[peer] = false
+	if err != nil {
+		return
+	}
+	if response.Term > n.state.Term {
+		n.becomeFollower(response.Term)
+		return
+	}
+	if n.role != raftLeader || n.state.Term != request.Term {
+		return
+	}
+
+	if response.Success {
+		match := request.PrevLogIndex + uint64(len(request.Entries))
+		if match > n.matchIndex[peer] {
+			n.matchIndex[peer] = match
+		}
+		n.nextIndex[peer] = match + 1
+		n.advanceCommit()
+	} else {
+		next := request.PrevLogIndex
+		if response.LastIndex+1 < next {
+			next = response.LastIndex + 1
+		}
+		if next < 1 {
+			next = 1
+		}
+		n.nextIndex[peer] = next
+	}
+
+	if n.role == raftLeader && n.nextIndex[peer] <= n.lastIndex() && n.isMember(peer) {
+		n.inFlight[peer] = true
+		go n.replicate(peer)
+	}
+}
+
+// advanceCommit commits the entries of the current term stored on a
+// majority of members. It must be called with the mutex held.
+func (n *raftNode) advanceCommit() {
+	for index := n.lastIndex(); index > n.commitIndex && n.termAt(index) == n.state.Term; index-- {
+		count := 0
+		for _, member := range n.members {
+			if member == n.id || n.matchIndex[member] >= index {
+				count++
+			}
+		}
+		if count >= n.quorum() {
+			n.commitIndex = index
+			signal(n.committed)
+			break
+		}
+	}
+
+	// a leader that removed itself steps down once that is committed
+	if n.role == raftLeader && !n.isMember(n.id) && n.commitIndex >= n.latestConfigIndex() {
+		n.role = raftFollower
+		n.leader = ""
+	}
+}
+
+// applyCommitted hands committed entries to apply in log order
+func (n *raftNode) applyCommitted() {
+	defer n.running.Done()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-n.committed:
+		}
+
+		for {
+			n.mutex.Lock()
+			if n.state.Applied >= n.commitIndex {
+				n.mutex.Unlock()
+				break
+			}
+			entry := n.log[n.state.Applied]
+			if entry.Command != nil {
+				// commands like incr or push must not run twice, a crash
+				// while applying is detected on the next start
+				n.state.Applying = entry.Index
+				if err := n.persistState(); err != nil {
+					n.mutex.Unlock()
+					logger().Error("Saving the Raft state failed", Fields{"index": entry.Index, "error": err})
+					break
+				}
+			}
+			n.mutex.Unlock()
+
+			var response *recordedResponse
+			if entry.Command != nil {
+				response = n.apply(entry)
+			}
+
+			n.mutex.Lock()
+			n.state.Applied = entry.Index
+			n.state.Applying = 0
+			n.persistState()
+			waiter, ok := n.waiters[entry.Index]
+			delete(n.waiters, entry.Index)
+			close(n.applied)
+			n.applied = make(chan struct{})
+			n.mutex.Unlock()
+
+			if ok && waiter.term == entry.Term {
+				waiter.done <- raftResult{response: response}
+			} else if ok {
+				waiter.done <- raftResult{err: errLeaderChanged}
+			}
+		}
+	}
+}
+
+// handleVote answers a candidate's request for a vote
+func (n *raftNode) handleVote(request raftVoteRequest) raftVoteResponse {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if request.Term > n.state.Term {
+		n.becomeFollower(request.Term)
+	}
+
+	lastTerm := n.termAt(n.lastIndex())
+	upToDate := request.LastLogTerm > lastTerm || (request.LastLogTerm == lastTerm && request.LastLogIndex >= n.lastIndex())
+	if request.Term == n.state.Term && upToDate && (n.state.VotedFor == "" || n.state.VotedFor == request.Candidate) {
+		n.state.VotedFor = request.Candidate
+		if n.persistState() == nil {
+			n.resetDeadline()
+			return raftVoteResponse{Term: n.state.Term, Granted: true}
+		}
+	}
+	return raftVoteResponse{Term: n.state.Term}
+}
+
+// handleAppend stores the entries sent by the leader
+func (n *raftNode) handleAppend(request raftAppendRequest) raftAppendResponse {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if request.Term < n.state.Term {
+		return raftAppendResponse{Term: n.state.Term, LastIndex: n.lastIndex()}
+	}
+	if request.Term > n.state.Term || n.role != raftFollower {
+		n.becomeFollower(request.Term)
+	}
+	n.leader = request.Leader
+	n.resetDeadline()
+
+	if request.PrevLogIndex > n.lastIndex() {
+		return raftAppendResponse{Term: n.state.Term, LastIndex: n.lastIndex()}
+	}
+	if n.termAt(request.PrevLogIndex) != request.PrevLogTerm {
+		return raftAppendResponse{Term: n.state.Term, LastIndex: request.PrevLogIndex - 1}
+	}
+
+	entries := request.Entries
+	for len(entries) > 0 && entries[0].Index <= n.lastIndex() {
+		if n.termAt(entries[0].Index) != entries[0].Term {
+			if err := n.truncateLog(entries[0].Index); err != nil {
+				return raftAppendResponse{Term: n.state.Term, LastIndex: n.lastIndex()}
+			}
+			break
+		}
+		entries = entries[1:]
+	}
+	if err := n.appendLog(entries); err != nil {
+		return raftAppendResponse{Term: n.state.Term, LastIndex: n.lastIndex()}
+	}
+	n.members = n.latestMembers()
+
+	lastNew := request.PrevLogIndex + uint64(len(request.Entries))
+	if request.LeaderCommit > n.commitIndex {
+		n.commitIndex = request.LeaderCommit
+		if lastNew < n.commitIndex {
+			n.commitIndex = lastNew
+		}
+		signal(n.committed)
+	}
+	return raftAppendResponse{Term: n.state.Term, Success: true, LastIndex: n.lastIndex()}
+}
+
+// propose appends a command or a new set of members to the log and waits
+// until it is applied
+func (n *raftNode) propose(ctx context.Context, command *clusterCommand, members []string) (*recordedResponse, error) {
+	n.mutex.Lock()
+	if n.role != raftLeader {
+		n.mutex.Unlock()
+		return nil, errNotLeader
+	}
+	if members != nil && n.latestConfigIndex() > n.commitIndex {
+		n.mutex.Unlock()
+		return nil, &requestError{http.StatusConflict, "Another membership change is in progress."}
+	}
+
+	entry := raftEntry{Index: n.lastIndex() + 1, Term: n.state.Term, Command: command, Members: members}
+	if err := n.appendLog([]raftEntry{entry}); err != nil {
+		n.mutex.Unlock()
+		return nil, err
+	}
+	if members != nil {
+		n.members = append([]string(nil), members...)
+	}
+	done := make(chan raftResult, 1)
+	n.waiters[entry.Index] = raftWaiter{term: entry.Term, done: done}
+	n.advanceCommit()
+	n.broadcast()
+	n.mutex.Unlock()
+
+	select {
+	case result := <-done:
+		return result.response, result.err
+	case <-ctx.Done():
+		n.mutex.Lock()
+		delete(n.waiters, entry.Index)
+		n.mutex.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// readBarrier waits until everything committed before the call is applied
+// and a majority confirmed this node still leads, so a following local
+// read is linearizable
+func (n *raftNode) readBarrier(ctx context.Context) error {
+	n.mutex.Lock()
+	if n.role != raftLeader {
+		n.mutex.Unlock()
+		return errNotLeader
+	}
+	if n.termAt(n.commitIndex) != n.state.Term {
+		n.mutex.Unlock()
+		return &requestError{http.StatusServiceUnavailable, "The cluster leader is not ready yet."}
+	}
+	readIndex := n.commitIndex
+	term := n.state.Term
+	requests := make(map[string]raftAppendRequest)
+	for _, peer := range n.members {
+		if peer != n.id {
+			request := n.appendRequest(peer)
+			request.Entries = nil
+			requests[peer] = request
+		}
+	}
+	acks := 0
+	if n.isMember(n.id) {
+		acks++
+	}
+	quorum := n.quorum()
+	n.mutex.Unlock()
+
+	responses := make(chan bool, len(requests))
+	for peer, request := range requests {
+		go func(peer string, request raftAppendRequest) {
+			var response raftAppendResponse
+			err := n.transport(peer, "append", request, &response)
+			responses <- err == nil && response.Term == term
+		}(peer, request)
+	}
+	for i := 0; i < len(requests) && acks < quorum; i++ {
+		select {
+		case ack := <-responses:
+			if ack {
+				acks++
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	n.mutex.Lock()
+	if acks < quorum || n.state.Term != term {
+		n.mutex.Unlock()
+		return errNotLeader
+	}
+	for n.state.Applied < readIndex {
+		applied := n.applied
+		n.mutex.Unlock()
+		select {
+		case <-applied:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		n.mutex.Lock()
+	}
+	n.mutex.Unlock()
+	return nil
+}
+
+// changeMembers adds or removes a single member
+func (n *raftNode) changeMembers(ctx context.Context, id string, add bool) error {
+	n.mutex.Lock()
+	members := []string{}
+	found := false
+	for _, member := range n.members {
+		if member == id {
+			found = true
+			if add {
+				members = append(members, member)
+			}
+		} else {
+			members = append(members, member)
+		}
+	}
+	n.mutex.Unlock()
+
+	if found == add {
+		return nil
+	}
+	if add {
+		members = append(members, id)
+	} else if len(members) == 0 {
+		return &requestError{http.StatusConflict, "The last member cannot be removed."}
+	}
+	_, err := n.propose(ctx, nil, members)
+	return err
+}
+
+// status returns the node's view of the cluster
+func (n *raftNode) status() ClusterStatus {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return ClusterStatus{
+		ID:          n.id,
+		Role:        n.role,
+		Term:        n.state.Term,
+		Leader:      n.leader,
+		Members:     append([]string{}, n.members...),
+		CommitIndex: n.commitIndex,
+		Applied:     n.state.Applied,
+	}
+}
+
+func (n *raftNode) currentLeader() string {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.leader
+}
@@ -0,0 +1,261 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testRaft connects raft nodes in memory, nodes can be cut off and
+// restarted from their directories
+type testRaft struct {
+	t       *testing.T
+	dir     string
+	ids     []string
+	mutex   sync.Mutex
+	nodes   map[string]*raftNode
+	applied map[string][]string
+	down    map[string]bool
+}
+
+func newTestRaft(t *testing.T, ids ...string) *testRaft {
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	cluster := &testRaft{
+		t:       t,
+		dir:     dir,
+		ids:     ids,
+		nodes:   make(map[string]*raftNode),
+		applied: make(map[string][]string),
+		down:    make(map[string]bool),
+	}
+	for _, id := range ids {
+		cluster.start(id, ids)
+	}
+	return cluster
+}
+
+func (c *testRaft) start(id string, peers []string) {
+	n, err := newRaftNode(id, filepath.Join(c.dir, id), peers)
+	assert.Nil(c.t, err)
+	n.electionTimeout = 100 * time.Millisecond
+	n.heartbeatInterval = 20 * time.Millisecond
+	n.transport = func(peer, rpc string, request, response interface{}) error {
+		return c.send(id, peer, rpc, request, response)
+	}
+	n.apply = func(entry raftEntry) *recordedResponse {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		c.applied[id] = append(c.applied[id], entry.Command.Path)
+		return newRecordedResponse()
+	}
+	c.mutex.Lock()
+	c.nodes[id] = n
+	c.down[id] = false
+	c.mutex.Unlock()
+	n.start()
+}
+
+func (c *testRaft) stop(id string) {
+	c.mutex.Lock()
+	n := c.nodes[id]
+	c.down[id] = true
+	c.mutex.Unlock()
+	n.shutdown()
+}
+
+func (c *testRaft) stopAll() {
+	for _, id := range c.ids {
+		if !c.isDown(id) {
+			c.stop(id)
+		}
+	}
+	os.RemoveAll(c.dir)
+}
+
+func (c *testRaft) isDown(id string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.down[id]
+}
+
+func (c *testRaft) setDown(id string, down bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.down[id] = down
+}
+
+// send passes a request through JSON like the HTTP transport does
+func (c *testRaft) send(from, to, rpc string, request, response interface{}) error {
+	c.mutex.Lock()
+	n := c.nodes[to]
+	down := c.down[from] || c.down[to]
+	c.mutex.Unlock()
+	if down {
+		return errors.New("unreachable")
+	}
+
+	body, _ := json.Marshal(request)
+	var result interface{}
+	if rpc == "vote" {
+		var req raftVoteRequest
+		json.Unmarshal(body, &req)
+		result = n.handleVote(req)
+	} else {
+		var req raftAppendRequest
+		json.Unmarshal(body, &req)
+		result = n.handleAppend(req)
+	}
+	body, _ = json.Marshal(result)
+	return json.Unmarshal(body, response)
+}
+
+// leader waits for a single leader all reachable nodes agree on
+func (c *testRaft) leader() *raftNode {
+	var leader *raftNode
+	waitFor(c.t, func() bool {
+		leader = nil
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		leaders := map[string]bool{}
+		for id, n := range c.nodes {
+			if c.down[id] {
+				continue
+			}
+			status := n.status()
+			leaders[status.Leader] = true
+			if status.Role == raftLeader {
+				leader = n
+			}
+		}
+		return leader != nil && len(leaders) == 1
+	})
+	return leader
+}
+
+func (c *testRaft) propose(n *raftNode, path string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err := n.propose(ctx, &clusterCommand{Method: "PUT", Path: path}, nil)
+	return err
+}
+
+func (c *testRaft) appliedBy(id string) []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]string{}, c.applied[id]...)
+}
+
+func TestRaftElectsSingleLeader(t *testing.T) {
+	c := newTestRaft(t, "a", "b", "c")
+	defer c.stopAll()
+
+	leader := c.leader()
+	for _, id := range c.ids {
+		if id != leader.id {
+			assert.Equal(t, errNotLeader, c.propose(c.nodes[id], "x"))
+		}
+	}
+	assert.Nil(t, c.propose(leader, "x"))
+	waitFor(t, func() bool {
+		return len(c.appliedBy("a")) == 1 && len(c.appliedBy("b")) == 1 && len(c.appliedBy("c")) == 1
+	})
+}
+
+func TestRaftReplicatesAcrossFailures(t *testing.T) {
+	c := newTestRaft(t, "a", "b", "c")
+	defer c.stopAll()
+
+	leader := c.leader()
+	assert.Nil(t, c.propose(leader, "1"))
+
+	// a follower misses entries and catches up after reconnecting
+	var follower string
+	for _, id := range c.ids {
+		if id != leader.id {
+			follower = id
+		}
+	}
+	c.setDown(follower, true)
+	assert.Nil(t, c.propose(leader, "2"))
+	assert.Nil(t, c.propose(leader, "3"))
+	c.setDown(follower, false)
+
+	// the leader is cut off, its uncommitted entry is replaced
+	c.setDown(leader.id, true)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	_, err := leader.propose(ctx, &clusterCommand{Method: "PUT", Path: "lost"}, nil)
+	cancel()
+	assert.NotNil(t, err)
+
+	newLeader := c.leader()
+	assert.NotEqual(t, leader.id, newLeader.id)
+	assert.Nil(t, c.propose(newLeader, "4"))
+	c.setDown(leader.id, false)
+
+	expected := []string{"1", "2", "3", "4"}
+	waitFor(t, func() bool {
+		for _, id := range c.ids {
+			if len(c.appliedBy(id)) != len(expected) {
+				return false
+			}
+		}
+		return true
+	})
+	for _, id := range c.ids {
+		assert.Equal(t, expected, c.appliedBy(id))
+	}
+}
+
+func TestRaftRestart(t *testing.T) {
+	c := newTestRaft(t, "a", "b", "c")
+	defer c.stopAll()
+
+	leader := c.leader()
+	assert.Nil(t, c.propose(leader, "1"))
+	waitFor(t, func() bool { return len(c.appliedBy("a")) == 1 })
+	term := leader.status().Term
+
+	// restarted nodes keep their log, term and what they applied
+	for _, id := range c.ids {
+		c.stop(id)
+	}
+	for _, id := range c.ids {
+		c.start(id, nil)
+	}
+	leader = c.leader()
+	assert.True(t, leader.status().Term > term)
+	assert.Nil(t, c.propose(leader, "2"))
+	waitFor(t, func() bool { return len(c.appliedBy("a")) == 2 })
+	assert.Equal(t, []string{"1", "2"}, c.appliedBy("a"))
+}
+
+func TestRaftMembership(t *testing.T) {
+	c := newTestRaft(t, "a", "b", "c")
+	defer c.stopAll()
+	leader := c.leader()
+	assert.Nil(t, c.propose(leader, "1"))
+
+	// a new node starts without members and learns the log from the leader
+	c.ids = append(c.ids, "d")
+	c.start("d", nil)
+	assert.Equal(t, []string{}, c.nodes["d"].status().Members)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Nil(t, leader.changeMembers(ctx, "d", true))
+	waitFor(t, func() bool { return len(c.appliedBy("d")) == 1 })
+	assert.Equal(t, []string{"a", "b", "c", "d"}, c.nodes["d"].status().Members)
+
+	assert.Nil(t, leader.changeMembers(ctx, "d", false))
+	assert.Equal(t, []string{"a", "b", "c"}, leader.status().Members)
+	assert.Nil(t, c.propose(leader, "2"))
+	waitFor(t, func() bool { return len(c.appliedBy("a")) == 2 })
+}
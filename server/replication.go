@@ -0,0 +1,293 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// replicationLogSize is the number of mutations kept for followers that
+// reconnect, followers further behind have to resync from a snapshot
+const replicationLogSize = 10000
+
+// Mutation is an entry of the replication stream. It carries the state of
+// a key after a change: 'set' to a value or 'delete' with everything below
+// it. 'heartbeat' entries report the current sequence number.
+type Mutation struct {
+	Seq   uint64    `json:"seq"`
+	Op    string    `json:"op"`
+	Key   string    `json:"key,omitempty"`
+	Value string    `json:"value,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+// ReplicationSnapshot holds all keys as of a sequence number of the
+// replication stream
+type ReplicationSnapshot struct {
+	Epoch     string     `json:"epoch"`
+	Seq       uint64     `json:"seq"`
+	Mutations []Mutation `json:"mutations"`
+}
+
+// ReplicationStatus describes the replication role of a server. For
+// followers Lag is the number of mutations not applied yet and LagSeconds
+// how long the follower has been behind.
+type ReplicationStatus struct {
+	Role        string     `json:"role"`
+	Primary     string     `json:"primary,omitempty"`
+	Epoch       string     `json:"epoch"`
+	Seq         uint64     `json:"seq"`
+	PrimarySeq  uint64     `json:"primarySeq,omitempty"`
+	Lag         uint64     `json:"lag"`
+	LagSeconds  float64    `json:"lagSeconds"`
+	Connected   bool       `json:"connected,omitempty"`
+	LastContact *time.Time `json:"lastContact,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// replicationLog numbers the mutations of a server, sequence numbers are only
+// meaningful within an epoch. The position is saved on shutdown and resumed
+// on the next start, after a crash a new epoch begins.
+type replicationLog struct {
+	mutex    sync.Mutex
+	epoch    string
+	seq      uint64
+	entries  []Mutation
+	appended chan struct{}
+}
+
+// replicationPosition is the saved position of a replication log
+type replicationPosition struct {
+	Epoch string `json:"epoch"`
+	Seq   uint64 `json:"seq"`
+}
+
+func newReplicationLog() *replicationLog {
+	epoch := make([]byte, 8)
+	rand.Read(epoch)
+	return &replicationLog{epoch: hex.EncodeToString(epoch), appended: make(chan struct{})}
+}
+
+// resumeReplicationLog continues at the position saved in path. The file is
+// removed, so a crash before the next save starts a new epoch instead of
+// reusing sequence numbers.
+func resumeReplicationLog(path string) *replicationLog {
+	log := newReplicationLog()
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return log
+	}
+	var position replicationPosition
+	if err == nil {
+		err = json.Unmarshal(content, &position)
+	}
+	if err == nil {
+		err = os.Remove(path)
+	}
+	if err != nil || position.Epoch == "" {
+		logger().Error("Resuming the replication log failed", Fields{"error": err})
+		return log
+	}
+	log.epoch, log.seq = position.Epoch, position.Seq
+	return log
+}
+
+// save writes the position to path for resumeReplicationLog
+func (log *replicationLog) save(path string) error {
+	epoch, seq := log.position()
+	content, err := json.Marshal(replicationPosition{Epoch: epoch, Seq: seq})
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, content)
+}
+
+func (log *replicationLog) append(mutations []Mutation) {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	now := time.Now()
+	for _, m := range mutations {
+		log.seq++
+		m.Seq, m.Time = log.seq, now
+		log.entries = append(log.entries, m)
+	}
+	if len(log.entries) > replicationLogSize {
+		log.entries = append([]Mutation(nil), log.entries[len(log.entries)-replicationLogSize:]...)
+	}
+	close(log.appended)
+	log.appended = make(chan struct{})
+}
+
+func (log *replicationLog) position() (string, uint64) {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	return log.epoch, log.seq
+}
+
+// since returns the mutations after seq and a channel closed on the next
+// append. It fails if the mutations are no longer kept.
+func (log *replicationLog) since(epoch string, seq uint64) ([]Mutation, <-chan struct{}, bool) {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	oldest := log.seq - uint64(len(log.entries))
+	if epoch != log.epoch || seq > log.seq || seq < oldest {
+		return nil, nil, false
+	}
+	return append([]Mutation(nil), log.entries[seq-oldest:]...), log.appended, true
+}
+
+// recordMutation appends the current state of key to the replication log.
+// The state is read under the key's lock, so the last mutation logged for a
+// key always reflects its last change.
+func (s *Server) recordMutation(key string) {
+	keyPath := filepath.Join(s.dataPath, key)
+	unlock := lockPath(keyPath)
+	defer unlock()
+
+	mutations := []Mutation{{Op: "delete", Key: key}}
+	if info, err := os.Stat(keyPath); err == nil && info.IsDir() {
+		mutations = append(mutations, s.keysBelow(key)...)
+	} else if err == nil {
+		if content, err := ioutil.ReadFile(keyPath); err == nil {
+			mutations = []Mutation{{Op: "set", Key: key, Value: string(content)}}
+		}
+	}
+	s.replication.append(mutations)
+}
+
+// keysBelow returns 'set' mutations for all keys below prefix, or all keys
+// if prefix is empty
+func (s *Server) keysBelow(prefix string) []Mutation {
+	mutations := []Mutation{}
+	filepath.Walk(filepath.Join(s.dataPath, prefix), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		key, _ := filepath.Rel(s.dataPath, path)
+		key = filepath.ToSlash(key)
+		if isReservedKey(key) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if content, err := ioutil.ReadFile(path); err == nil {
+			mutations = append(mutations, Mutation{Op: "set", Key: key, Value: string(content)})
+		}
+		return nil
+	})
+	return mutations
+}
+
+// withholdSecrets turns 'set' mutations of secret keys the caller of r may
+// not reveal into deletes, so the values stay on the primary
+func (s *Server) withholdSecrets(r *http.Request, mutations []Mutation) []Mutation {
+	withheld := make([]Mutation, 0, len(mutations))
+	for _, m := range mutations {
+		if m.Op == "set" && !s.mayReveal(r, m.Key) {
+			m = Mutation{Seq: m.Seq, Op: "delete", Key: m.Key, Time: m.Time}
+		}
+		withheld = append(withheld, m)
+	}
+	return withheld
+}
+
+// serveReplication handles /_/replication: GET /_/replication/snapshot
+// returns all keys, /_/replication/stream?epoch=<epoch>&after=<seq> streams
+// the mutations after a snapshot and /_/replication/status shows the role.
+// Secret values are only sent given reveal=true, with an ACL the caller
+// needs the reveal permission on the keys.
+func (s *Server) serveReplication(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeJSON(w, http.StatusMethodNotAllowed, ReplicationStatus{Error: "Only GET is allowed."})
+		return
+	}
+
+	switch strings.Trim(strings.TrimPrefix(r.URL.Path, "/_/replication"), "/") {
+	case "snapshot":
+		// mutations logged while walking the keys are streamed again,
+		// which is harmless as they carry state
+		epoch, seq := s.replication.position()
+		mutations := []Mutation{}
+		for _, m := range s.withholdSecrets(r, s.keysBelow("")) {
+			if m.Op == "set" {
+				mutations = append(mutations, m)
+			}
+		}
+		writeJSON(w, http.StatusOK, ReplicationSnapshot{Epoch: epoch, Seq: seq, Mutations: mutations})
+	case "stream":
+		s.serveReplicationStream(w, r)
+	case "status":
+		if s.follower != nil {
+			writeJSON(w, http.StatusOK, s.follower.Status())
+			return
+		}
+		epoch, seq := s.replication.position()
+		writeJSON(w, http.StatusOK, ReplicationStatus{Role: "primary", Epoch: epoch, Seq: seq})
+	default:
+		writeJSON(w, http.StatusNotFound, ReplicationStatus{Error: "Unknown replication path."})
+	}
+}
+
+func (s *Server) serveReplicationStream(w http.ResponseWriter, r *http.Request) {
+	epoch := r.URL.Query().Get("epoch")
+	seq, err := strconv.ParseUint(r.URL.Query().Get("after"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, ReplicationStatus{Error: "Parameter 'after' is not a sequence number."})
+		return
+	}
+	mutations, appended, ok := s.replication.since(epoch, seq)
+	if !ok {
+		writeJSON(w, http.StatusGone, ReplicationStatus{Error: "The mutations after this position are gone, resync from a snapshot."})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	heartbeat := time.NewTicker(time.Second)
+	defer heartbeat.Stop()
+	for {
+		for _, m := range s.withholdSecrets(r, mutations) {
+			if err := encoder.Encode(m); err != nil {
+				return
+			}
+			seq = m.Seq
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		select {
+		case <-appended:
+		case <-heartbeat.C:
+			_, current := s.replication.position()
+			if err := encoder.Encode(Mutation{Seq: current, Op: "heartbeat", Time: time.Now()}); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		case <-s.draining:
+			return
+		}
+		if mutations, appended, ok = s.replication.since(epoch, seq); !ok {
+			// fell too far behind, the follower resyncs on reconnect
+			return
+		}
+	}
+}
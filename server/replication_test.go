@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplicationLogSince(t *testing.T) {
+	log := newReplicationLog()
+	log.append([]Mutation{{Op: "set", Key: "a", Value: "1"}, {Op: "delete", Key: "b"}})
+
+	mutations, _, ok := log.since(log.epoch, 0)
+	assert.True(t, ok)
+	assert.Equal(t, 2, len(mutations))
+	assert.Equal(t, uint64(1), mutations[0].Seq)
+	assert.Equal(t, uint64(2), mutations[1].Seq)
+
+	mutations, appended, ok := log.since(log.epoch, 2)
+	assert.True(t, ok)
+	assert.Equal(t, 0, len(mutations))
+	log.append([]Mutation{{Op: "set", Key: "c", Value: "3"}})
+	<-appended
+
+	_, _, ok = log.since("other", 0)
+	assert.False(t, ok)
+	_, _, ok = log.since(log.epoch, 4)
+	assert.False(t, ok)
+
+	for i := 0; i < replicationLogSize; i++ {
+		log.append([]Mutation{{Op: "set", Key: "a", Value: "1"}})
+	}
+	_, _, ok = log.since(log.epoch, 2)
+	assert.False(t, ok)
+	mutations, _, ok = log.since(log.epoch, 3)
+	assert.True(t, ok)
+	assert.Equal(t, replicationLogSize, len(mutations))
+}
+
+func TestReplicationRecordsState(t *testing.T) {
+	cleanData()
+	s := NewServer(testDataPath, nil, nil)
+	_, start := s.replication.position()
+
+	assert.Equal(t, http.StatusOK, sendRequest(s.ServeHTTP, "PUT", "a/b", url.Values{"value": {"1"}}))
+	assert.Equal(t, http.StatusOK, sendRequest(s.ServeHTTP, "POST", "a/n", url.Values{"op": {"incr"}, "init": {"5"}}))
+	assert.Equal(t, http.StatusOK, sendRequest(s.ServeHTTP, "DELETE", "a/b", url.Values{}))
+
+	mutations, _, ok := s.replication.since(s.replication.epoch, start)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"set a/b 1", "set a/n 6", "delete a/b "}, describeMutations(mutations))
+
+	req, _ := http.NewRequest("GET", "http://localhost/_/replication/snapshot", nil)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	var snapshot ReplicationSnapshot
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &snapshot))
+	assert.Equal(t, s.replication.epoch, snapshot.Epoch)
+	assert.Equal(t, start+3, snapshot.Seq)
+	assert.Equal(t, []string{"set a/n 6"}, describeMutations(snapshot.Mutations))
+
+	assert.Equal(t, http.StatusGone, sendRequest(s.ServeHTTP, "GET", "_/replication/stream", url.Values{"epoch": {"other"}, "after": {"0"}}))
+	assert.Equal(t, http.StatusBadRequest, sendRequest(s.ServeHTTP, "GET", "_/replication/stream", url.Values{"epoch": {snapshot.Epoch}}))
+}
+
+func describeMutations(mutations []Mutation) []string {
+	descriptions := []string{}
+	for _, m := range mutations {
+		descriptions = append(descriptions, m.Op+" "+m.Key+" "+m.Value)
+	}
+	return descriptions
+}
+
+func TestReplicationWithholdsSecrets(t *testing.T) {
+	cleanData()
+	s := NewServer(testDataPath, nil, nil)
+	assert.Nil(t, s.MarkSecret("secrets"))
+	_, start := s.replication.position()
+	assert.Equal(t, http.StatusOK, sendRequest(s.ServeHTTP, "PUT", "secrets/db", url.Values{"value": {"hunter2"}}))
+
+	snapshot := func(vals url.Values) []string {
+		w := sendAs(s, "", "GET", "_/replication/snapshot", vals)
+		var snapshot ReplicationSnapshot
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &snapshot))
+		return describeMutations(snapshot.Mutations)
+	}
+	assert.Equal(t, []string{}, snapshot(nil))
+	assert.Equal(t, []string{"set secrets/db hunter2"}, snapshot(url.Values{"reveal": {"true"}}))
+
+	// the stream deletes what it withholds, so followers keep no old values
+	stream := func(vals url.Values) string {
+		vals.Set("epoch", s.replication.epoch)
+		vals.Set("after", strconv.FormatUint(start, 10))
+		req, _ := http.NewRequest("GET", "http://localhost/_/replication/stream?"+vals.Encode(), nil)
+		ctx, cancel := context.WithTimeout(req.Context(), 50*time.Millisecond)
+		defer cancel()
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req.WithContext(ctx))
+		var m Mutation
+		assert.Nil(t, json.NewDecoder(w.Body).Decode(&m))
+		return m.Op + " " + m.Key + " " + m.Value
+	}
+	assert.Equal(t, "delete secrets/db ", stream(url.Values{}))
+	assert.Equal(t, "set secrets/db hunter2", stream(url.Values{"reveal": {"true"}}))
+}
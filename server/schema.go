@@ -0,0 +1,460 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Rule restricts the values of all keys below the prefix it is registered
+// for. Type is one of int, bool, enum, regex, json or schema.
+type Rule struct {
+	Type    string          `json:"type"`
+	Min     *int64          `json:"min,omitempty"`     // int
+	Max     *int64          `json:"max,omitempty"`     // int
+	Values  []string        `json:"values,omitempty"`  // enum
+	Pattern string          `json:"pattern,omitempty"` // regex
+	Schema  json.RawMessage `json:"schema,omitempty"`  // schema, a JSON Schema document
+
+	regexp *regexp.Regexp
+	schema *schemaNode
+}
+
+// compile checks the rule and prepares it for validation
+func (rule *Rule) compile() error {
+	var err error
+	switch rule.Type {
+	case "int", "bool", "json":
+	case "enum":
+		if len(rule.Values) == 0 {
+			return errors.New("enum rule needs values")
+		}
+	case "regex":
+		rule.regexp, err = regexp.Compile(rule.Pattern)
+	case "schema":
+		var document interface{}
+		if document, err = decodeJSON(rule.Schema); err == nil {
+			rule.schema, err = compileSchema(document)
+		}
+	default:
+		return fmt.Errorf("unknown rule type '%s'", rule.Type)
+	}
+	return err
+}
+
+// validate returns an error describing why value violates the rule
+func (rule *Rule) validate(value string) error {
+	switch rule.Type {
+	case "int":
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return errors.New("not an integer")
+		}
+		if rule.Min != nil && i < *rule.Min {
+			return fmt.Errorf("less than %d", *rule.Min)
+		}
+		if rule.Max != nil && i > *rule.Max {
+			return fmt.Errorf("greater than %d", *rule.Max)
+		}
+	case "bool":
+		if value != "true" && value != "false" {
+			return errors.New("not 'true' or 'false'")
+		}
+	case "enum":
+		for _, v := range rule.Values {
+			if v == value {
+				return nil
+			}
+		}
+		return fmt.Errorf("not one of %v", rule.Values)
+	case "regex":
+		if !rule.regexp.MatchString(value) {
+			return fmt.Errorf("does not match %s", rule.Pattern)
+		}
+	case "json":
+		if !json.Valid([]byte(value)) {
+			return errors.New("not valid JSON")
+		}
+	case "schema":
+		document, err := decodeJSON([]byte(value))
+		if err != nil {
+			return errors.New("not valid JSON")
+		}
+		return validateSchema(rule.schema, document, "$")
+	}
+	return nil
+}
+
+// schemaRegistry holds the rules by prefix and persists them in a file
+type schemaRegistry struct {
+	mutex sync.RWMutex
+	path  string
+	rules map[string]*Rule
+}
+
+func loadSchemaRegistry(path string) (*schemaRegistry, error) {
+	registry := &schemaRegistry{path: path, rules: make(map[string]*Rule)}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return registry, nil
+	} else if err != nil {
+		return registry, err
+	}
+
+	if err = json.Unmarshal(content, &registry.rules); err != nil {
+		return registry, err
+	}
+	for prefix, rule := range registry.rules {
+		if err = rule.compile(); err != nil {
+			return registry, fmt.Errorf("rule for '%s': %s", prefix, err)
+		}
+	}
+	return registry, nil
+}
+
+func (registry *schemaRegistry) save() error {
+	content, err := json.MarshalIndent(registry.rules, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(registry.path, content)
+}
+
+func (registry *schemaRegistry) set(prefix string, rule *Rule) error {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.rules[prefix] = rule
+	return registry.save()
+}
+
+func (registry *schemaRegistry) remove(prefix string) (bool, error) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	if _, ok := registry.rules[prefix]; !ok {
+		return false, nil
+	}
+	delete(registry.rules, prefix)
+	return true, registry.save()
+}
+
+func (registry *schemaRegistry) get(prefix string) (*Rule, bool) {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	rule, ok := registry.rules[prefix]
+	return rule, ok
+}
+
+func (registry *schemaRegistry) all() map[string]*Rule {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	rules := make(map[string]*Rule, len(registry.rules))
+	for prefix, rule := range registry.rules {
+		rules[prefix] = rule
+	}
+	return rules
+}
+
+// validate checks value against the rule with the longest prefix matching
+// key, if there is any
+func (registry *schemaRegistry) validate(key, value string) error {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+
+	var prefix string
+	var rule *Rule
+	for p, r := range registry.rules {
+		if matchesPrefix(key, p) && (rule == nil || len(p) > len(prefix)) {
+			prefix, rule = p, r
+		}
+	}
+	if rule == nil {
+		return nil
+	}
+	if err := rule.validate(value); err != nil {
+		return fmt.Errorf("Value violates the %s rule registered for '%s': %s", rule.Type, prefix, err)
+	}
+	return nil
+}
+
+type schemaResponse struct {
+	Prefix string           `json:"prefix,omitempty"`
+	Rule   *Rule            `json:"rule,omitempty"`
+	Rules  map[string]*Rule `json:"rules,omitempty"`
+	Error  string           `json:"error,omitempty"`
+}
+
+// serveSchemas manages rules through /_/schemas/<prefix>, new rules are
+// passed as JSON in the form field 'rule'
+func (s *Server) serveSchemas(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	prefix := strings.Trim(strings.TrimPrefix(r.URL.Path, "/_/schemas"), "/")
+	if r.Method != "GET" {
+		defer s.changing()()
+	}
+
+	if prefix == "" {
+		if r.Method != "GET" {
+			writeJSON(w, http.StatusMethodNotAllowed, schemaResponse{Error: "A prefix is required."})
+			return
+		}
+		writeJSON(w, http.StatusOK, schemaResponse{Rules: s.schemas.all()})
+		return
+	}
+	if !validKey.MatchString(prefix) || isReservedKey(prefix) {
+		writeJSON(w, http.StatusBadRequest, schemaResponse{Prefix: prefix, Error: "Invalid prefix."})
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		if rule, ok := s.schemas.get(prefix); ok {
+			writeJSON(w, http.StatusOK, schemaResponse{Prefix: prefix, Rule: rule})
+		} else {
+			writeJSON(w, http.StatusNotFound, schemaResponse{Prefix: prefix, Error: "No rule registered."})
+		}
+	case "PUT", "POST":
+		var rule Rule
+		err := json.Unmarshal([]byte(r.PostForm.Get("rule")), &rule)
+		if err == nil {
+			err = rule.compile()
+		}
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, schemaResponse{Prefix: prefix, Error: "Invalid rule: " + err.Error()})
+			return
+		}
+		if err = s.schemas.set(prefix, &rule); err != nil {
+			writeJSON(w, http.StatusInternalServerError, schemaResponse{Prefix: prefix, Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, schemaResponse{Prefix: prefix, Rule: &rule})
+	case "DELETE":
+		found, err := s.schemas.remove(prefix)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, schemaResponse{Prefix: prefix, Error: err.Error()})
+		} else if !found {
+			writeJSON(w, http.StatusNotFound, schemaResponse{Prefix: prefix, Error: "No rule registered."})
+		} else {
+			writeJSON(w, http.StatusOK, schemaResponse{Prefix: prefix})
+		}
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, schemaResponse{Prefix: prefix, Error: "Method not allowed."})
+	}
+}
+
+// The supported subset of JSON Schema: type, enum, minimum, maximum,
+// minLength, maxLength, pattern, properties, required,
+// additionalProperties, items, minItems and maxItems.
+
+// schemaNode is a schema with its patterns and subschemas compiled
+type schemaNode struct {
+	keywords   map[string]interface{}
+	pattern    *regexp.Regexp
+	properties map[string]*schemaNode
+	items      *schemaNode
+	additional *schemaNode
+}
+
+// compileSchema checks a schema and all its subschemas and compiles their
+// patterns
+func compileSchema(schema interface{}) (*schemaNode, error) {
+	object, ok := schema.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("schema must be an object")
+	}
+	node := &schemaNode{keywords: object}
+	var err error
+	if pattern, ok := object["pattern"]; ok {
+		text, ok := pattern.(string)
+		if !ok {
+			return nil, errors.New("pattern must be a string")
+		}
+		if node.pattern, err = regexp.Compile(text); err != nil {
+			return nil, err
+		}
+	}
+	if properties, ok := object["properties"]; ok {
+		members, ok := properties.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("properties must be an object")
+		}
+		node.properties = make(map[string]*schemaNode, len(members))
+		for name, property := range members {
+			if node.properties[name], err = compileSchema(property); err != nil {
+				return nil, fmt.Errorf("property '%s': %s", name, err)
+			}
+		}
+	}
+	if items, ok := object["items"]; ok {
+		if node.items, err = compileSchema(items); err != nil {
+			return nil, fmt.Errorf("items: %s", err)
+		}
+	}
+	switch additional := object["additionalProperties"].(type) {
+	case nil, bool:
+	case map[string]interface{}:
+		if node.additional, err = compileSchema(additional); err != nil {
+			return nil, fmt.Errorf("additionalProperties: %s", err)
+		}
+	default:
+		return nil, errors.New("additionalProperties must be a boolean or an object")
+	}
+	return node, nil
+}
+
+// decode JSON keeping numbers as json.Number, data after the first value is
+// an error
+func decodeJSON(data []byte) (interface{}, error) {
+	var document interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&document); err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after the JSON value")
+	}
+	return document, nil
+}
+
+func schemaType(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+func typeMatches(expected, actual string) bool {
+	return expected == actual || (expected == "number" && actual == "integer")
+}
+
+func schemaNumber(value interface{}) (float64, bool) {
+	if n, ok := value.(json.Number); ok {
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func validateSchema(node *schemaNode, value interface{}, location string) error {
+	object := node.keywords
+	actual := schemaType(value)
+
+	switch expected := object["type"].(type) {
+	case string:
+		if !typeMatches(expected, actual) {
+			return fmt.Errorf("%s: expected %s, got %s", location, expected, actual)
+		}
+	case []interface{}:
+		found := false
+		for _, t := range expected {
+			if s, ok := t.(string); ok && typeMatches(s, actual) {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: expected one of %v, got %s", location, expected, actual)
+		}
+	}
+
+	if enum, ok := object["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if fmt.Sprint(e) == fmt.Sprint(value) && schemaType(e) == actual {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: not one of %v", location, enum)
+		}
+	}
+
+	if number, ok := schemaNumber(value); ok {
+		if minimum, ok := schemaNumber(object["minimum"]); ok && number < minimum {
+			return fmt.Errorf("%s: less than %v", location, minimum)
+		}
+		if maximum, ok := schemaNumber(object["maximum"]); ok && number > maximum {
+			return fmt.Errorf("%s: greater than %v", location, maximum)
+		}
+	}
+
+	if s, ok := value.(string); ok {
+		length := float64(utf8.RuneCountInString(s))
+		if minLength, ok := schemaNumber(object["minLength"]); ok && length < minLength {
+			return fmt.Errorf("%s: shorter than %v", location, minLength)
+		}
+		if maxLength, ok := schemaNumber(object["maxLength"]); ok && length > maxLength {
+			return fmt.Errorf("%s: longer than %v", location, maxLength)
+		}
+		if node.pattern != nil && !node.pattern.MatchString(s) {
+			return fmt.Errorf("%s: does not match %s", location, node.pattern)
+		}
+	}
+
+	if items, ok := value.([]interface{}); ok {
+		length := float64(len(items))
+		if minItems, ok := schemaNumber(object["minItems"]); ok && length < minItems {
+			return fmt.Errorf("%s: fewer than %v items", location, minItems)
+		}
+		if maxItems, ok := schemaNumber(object["maxItems"]); ok && length > maxItems {
+			return fmt.Errorf("%s: more than %v items", location, maxItems)
+		}
+		if node.items != nil {
+			for i, item := range items {
+				if err := validateSchema(node.items, item, fmt.Sprintf("%s[%d]", location, i)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if members, ok := value.(map[string]interface{}); ok {
+		if required, ok := object["required"].([]interface{}); ok {
+			for _, name := range required {
+				if _, ok := members[fmt.Sprint(name)]; !ok {
+					return fmt.Errorf("%s: missing property '%v'", location, name)
+				}
+			}
+		}
+		for name, member := range members {
+			memberLocation := location + "." + name
+			if propertySchema, ok := node.properties[name]; ok {
+				if err := validateSchema(propertySchema, member, memberLocation); err != nil {
+					return err
+				}
+				continue
+			}
+			if node.additional != nil {
+				if err := validateSchema(node.additional, member, memberLocation); err != nil {
+					return err
+				}
+			} else if additional, ok := object["additionalProperties"].(bool); ok && !additional {
+				return fmt.Errorf("%s: property not allowed", memberLocation)
+			}
+		}
+	}
+
+	return nil
+}
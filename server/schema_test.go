@@ -0,0 +1,131 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func compileRule(t *testing.T, definition string) *Rule {
+	var rule Rule
+	if err := json.Unmarshal([]byte(definition), &rule); err != nil {
+		t.Fatal(err)
+	}
+	if err := rule.compile(); err != nil {
+		t.Fatal(err)
+	}
+	return &rule
+}
+
+func TestRuleValidate(t *testing.T) {
+	tests := []struct {
+		rule  string
+		value string
+		valid bool
+	}{
+		{`{"type":"int"}`, "8080", true},
+		{`{"type":"int"}`, "80a", false},
+		{`{"type":"int","min":1,"max":65535}`, "0", false},
+		{`{"type":"int","min":1,"max":65535}`, "65536", false},
+		{`{"type":"bool"}`, "true", true},
+		{`{"type":"bool"}`, "yes", false},
+		{`{"type":"enum","values":["dhcp","static"]}`, "static", true},
+		{`{"type":"enum","values":["dhcp","static"]}`, "manual", false},
+		{`{"type":"regex","pattern":"^[a-z]+$"}`, "foo", true},
+		{`{"type":"regex","pattern":"^[a-z]+$"}`, "Foo", false},
+		{`{"type":"json"}`, `{"foo": [1, 2]}`, true},
+		{`{"type":"json"}`, `{"foo": [1, 2}`, false},
+		{`{"type":"schema","schema":{"type":"object","required":["port"],"properties":{"port":{"type":"integer","minimum":1}}}}`, `{"port": 80}`, true},
+		{`{"type":"schema","schema":{"type":"object","required":["port"],"properties":{"port":{"type":"integer","minimum":1}}}}`, `{"port": 0}`, false},
+		{`{"type":"schema","schema":{"type":"object","required":["port"],"properties":{"port":{"type":"integer","minimum":1}}}}`, `{"port": "80"}`, false},
+		{`{"type":"schema","schema":{"type":"object","required":["port"],"properties":{"port":{"type":"integer","minimum":1}}}}`, `{}`, false},
+		{`{"type":"schema","schema":{"type":"object","required":["port"],"properties":{"port":{"type":"integer","minimum":1}}}}`, `{"port":1}}`, false},
+		{`{"type":"schema","schema":{"type":"object","required":["port"],"properties":{"port":{"type":"integer","minimum":1}}}}`, `{"port":1}xyz`, false},
+		{`{"type":"schema","schema":{"type":"object","required":["port"],"properties":{"port":{"type":"integer","minimum":1}}}}`, `{"port":1} {"port":2}`, false},
+		{`{"type":"schema","schema":{"type":"object","required":["port"],"properties":{"port":{"type":"integer","minimum":1}}}}`, "{\"port\":1}\n", true},
+		{`{"type":"schema","schema":{"type":"object","additionalProperties":false}}`, `{"foo": 1}`, false},
+		{`{"type":"schema","schema":{"type":"array","items":{"enum":["a","b"]},"maxItems":2}}`, `["a","b"]`, true},
+		{`{"type":"schema","schema":{"type":"array","items":{"enum":["a","b"]},"maxItems":2}}`, `["a","c"]`, false},
+		{`{"type":"schema","schema":{"type":"array","items":{"enum":["a","b"]},"maxItems":2}}`, `["a","b","a"]`, false},
+		{`{"type":"schema","schema":{"type":"string","pattern":"^v[0-9]+$","maxLength":3}}`, `"v12"`, true},
+		{`{"type":"schema","schema":{"type":"string","pattern":"^v[0-9]+$","maxLength":3}}`, `"v123"`, false},
+		{`{"type":"schema","schema":{"type":"object","items":{"type":"string"},"additionalProperties":{"type":"string","pattern":"^[a-z]+$"}}}`, `{"a":"b"}`, true},
+		{`{"type":"schema","schema":{"type":"object","items":{"type":"string"},"additionalProperties":{"type":"string","pattern":"^[a-z]+$"}}}`, `{"a":"B"}`, false},
+	}
+
+	for _, test := range tests {
+		err := compileRule(t, test.rule).validate(test.value)
+		if test.valid && err != nil {
+			t.Errorf("Value '%s' should be valid for %s, got: %s", test.value, test.rule, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("Value '%s' should not be valid for %s", test.value, test.rule)
+		}
+	}
+}
+
+func TestInvalidRules(t *testing.T) {
+	for _, definition := range []string{`{"type":"float"}`, `{"type":"enum"}`, `{"type":"regex","pattern":"("}`, `{"type":"schema","schema":"int"}`,
+		`{"type":"schema","schema":{"type":"object","items":{"type":"string"},"additionalProperties":{"type":"string","pattern":"("}}}`,
+		`{"type":"schema","schema":{"type":"object","properties":{"a":{"items":{"pattern":"["}}}}}`,
+		`{"type":"schema","schema":{"type":"string","pattern":1}}`} {
+		var rule Rule
+		assert.Nil(t, json.Unmarshal([]byte(definition), &rule))
+		assert.NotNil(t, rule.compile(), definition)
+	}
+}
+
+func TestMostSpecificRuleApplies(t *testing.T) {
+	registry := &schemaRegistry{rules: map[string]*Rule{
+		"network":      compileRule(t, `{"type":"json"}`),
+		"network/port": compileRule(t, `{"type":"int"}`),
+	}}
+	assert.Nil(t, registry.validate("network/port", "80"))
+	assert.NotNil(t, registry.validate("network/port", "{}"))
+	assert.Nil(t, registry.validate("network/dns", "{}"))
+	assert.Nil(t, registry.validate("networking", "foo"))
+}
+
+func TestHTTPSchemaValidation(t *testing.T) {
+	cleanData()
+	handler := NewServerHandler(testDataPath, nil, nil)
+	post := func(path string, values url.Values) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", "http://localhost/"+path, strings.NewReader(values.Encode()))
+		assert.Nil(t, err)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+
+	w := post("_/schemas/network/port", url.Values{"rule": {`{"type":"int","min":1,"max":65535}`}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = post("_/schemas/network", url.Values{"rule": {`{"type":"nonsense"}`}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = post("_/schemas/cfg", url.Values{"rule": {`{"type":"schema","schema":{"type":"object","items":{"type":"string"},"additionalProperties":{"type":"string","pattern":"("}}}`}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = post("cfg", url.Values{"value": {`{"a":"b"}`}})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = post("network/port", url.Values{"value": {"http"}})
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Contains(t, w.Body.String(), "int rule registered for 'network/port'")
+	w = post("network/port", url.Values{"value": {"8080"}})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// rules survive a restart
+	handler = NewServerHandler(testDataPath, nil, nil)
+	w = post("network/port", url.Values{"value": {"0"}})
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	req, _ := http.NewRequest("DELETE", "http://localhost/_/schemas/network/port", nil)
+	w = httptest.NewRecorder()
+	handler(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = post("network/port", url.Values{"value": {"0"}})
+	assert.Equal(t, http.StatusOK, w.Code)
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// secretRegistry holds the prefixes whose values are secret and persists
+// them in a file. Secret values are redacted in responses unless revealed.
+type secretRegistry struct {
+	mutex    sync.RWMutex
+	path     string
+	prefixes map[string]bool
+}
+
+func loadSecretRegistry(path string) (*secretRegistry, error) {
+	registry := &secretRegistry{path: path, prefixes: make(map[string]bool)}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return registry, nil
+	} else if err != nil {
+		return registry, err
+	}
+
+	var prefixes []string
+	if err = json.Unmarshal(content, &prefixes); err != nil {
+		return registry, err
+	}
+	for _, prefix := range prefixes {
+		registry.prefixes[prefix] = true
+	}
+	return registry, nil
+}
+
+func (registry *secretRegistry) save() error {
+	content, err := json.MarshalIndent(registry.allLocked(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(registry.path, content)
+}
+
+func (registry *secretRegistry) mark(prefix string) error {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.prefixes[prefix] = true
+	return registry.save()
+}
+
+func (registry *secretRegistry) unmark(prefix string) (bool, error) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	if !registry.prefixes[prefix] {
+		return false, nil
+	}
+	delete(registry.prefixes, prefix)
+	return true, registry.save()
+}
+
+func (registry *secretRegistry) marked(prefix string) bool {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	return registry.prefixes[prefix]
+}
+
+func (registry *secretRegistry) all() []string {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	return registry.allLocked()
+}
+
+func (registry *secretRegistry) allLocked() []string {
+	prefixes := []string{}
+	for prefix := range registry.prefixes {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
+
+// covers reports whether the value of key is secret
+func (registry *secretRegistry) covers(key string) bool {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	for prefix := range registry.prefixes {
+		if matchesPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// MarkSecret makes the values of all keys below prefix secret
+func (s *Server) MarkSecret(prefix string) error {
+	return s.secrets.mark(strings.Trim(prefix, "/"))
+}
+
+// reveals reports whether r asks for secret values in plain
+func reveals(r *http.Request) bool {
+	return r.FormValue("reveal") == "true"
+}
+
+// mayReveal reports whether the value of key can go to the caller of r in
+// plain: it is not secret, or r asks to reveal it and may do so. Responses,
+// replication, sync digests and snapshots all redact through it.
+func (s *Server) mayReveal(r *http.Request, key string) bool {
+	if !s.secrets.covers(key) {
+		return true
+	}
+	return reveals(r) && (s.acl == nil || isCommand(r) || s.acl.allowed(callerNames(r), PermissionReveal, key))
+}
+
+// redact blanks the value of a response for a secret key unless the
+// request may reveal it
+func (s *Server) redact(r *http.Request, key string, responseData *ResponseData) {
+	if responseData.IsNamespace || s.mayReveal(r, key) {
+		return
+	}
+	responseData.Value = ""
+	responseData.Redacted = true
+}
+
+type secretsResponse struct {
+	Prefix   string   `json:"prefix,omitempty"`
+	Prefixes []string `json:"prefixes,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// revealedTo returns a filter passing the keys whose values may go to the
+// caller of r
+func (s *Server) revealedTo(r *http.Request) func(key string) bool {
+	return func(key string) bool {
+		return s.mayReveal(r, key)
+	}
+}
+
+// serveSecrets marks prefixes secret through /_/secrets/<prefix>: GET
+// reports whether a prefix is marked, PUT marks and DELETE unmarks it.
+// GET /_/secrets lists all marked prefixes.
+func (s *Server) serveSecrets(w http.ResponseWriter, r *http.Request) {
+	prefix := strings.Trim(strings.TrimPrefix(r.URL.Path, "/_/secrets"), "/")
+	if r.Method != "GET" {
+		defer s.changing()()
+	}
+
+	if prefix == "" {
+		if r.Method != "GET" {
+			writeJSON(w, http.StatusMethodNotAllowed, secretsResponse{Error: "A prefix is required."})
+			return
+		}
+		writeJSON(w, http.StatusOK, secretsResponse{Prefixes: s.secrets.all()})
+		return
+	}
+	if !validKey.MatchString(prefix) || isReservedKey(prefix) {
+		writeJSON(w, http.StatusBadRequest, secretsResponse{Prefix: prefix, Error: "Invalid prefix."})
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		if s.secrets.marked(prefix) {
+			writeJSON(w, http.StatusOK, secretsResponse{Prefix: prefix})
+		} else {
+			writeJSON(w, http.StatusNotFound, secretsResponse{Prefix: prefix, Error: "Prefix is not secret."})
+		}
+	case "PUT", "POST":
+		if err := s.secrets.mark(prefix); err != nil {
+			writeJSON(w, http.StatusInternalServerError, secretsResponse{Prefix: prefix, Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, secretsResponse{Prefix: prefix})
+	case "DELETE":
+		found, err := s.secrets.unmark(prefix)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, secretsResponse{Prefix: prefix, Error: err.Error()})
+		} else if !found {
+			writeJSON(w, http.StatusNotFound, secretsResponse{Prefix: prefix, Error: "Prefix is not secret."})
+		} else {
+			writeJSON(w, http.StatusOK, secretsResponse{Prefix: prefix})
+		}
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, secretsResponse{Prefix: prefix, Error: "Method not allowed."})
+	}
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecretsRedacted(t *testing.T) {
+	cleanData()
+	s := NewServer(testDataPath, nil, nil)
+	assert.Equal(t, http.StatusOK, sendRequest(s.ServeHTTP, "PUT", "_/secrets/creds", nil))
+	assert.Equal(t, http.StatusOK, sendRequest(s.ServeHTTP, "GET", "_/secrets/creds", nil))
+	assert.Equal(t, http.StatusNotFound, sendRequest(s.ServeHTTP, "GET", "_/secrets/other", nil))
+
+	var data ResponseData
+	w := sendAs(s, "", "PUT", "creds/db", url.Values{"value": {"hunter2"}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), "hunter2")
+
+	w = sendAs(s, "", "GET", "creds/db", nil)
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &data))
+	assert.Equal(t, "", data.Value)
+	assert.True(t, data.Redacted)
+	w = sendAs(s, "", "GET", "creds/db", url.Values{"reveal": {"true"}})
+	data = ResponseData{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &data))
+	assert.Equal(t, "hunter2", data.Value)
+	assert.False(t, data.Redacted)
+
+	// namespaces are listed, errors do not show the value
+	w = sendAs(s, "", "GET", "creds", nil)
+	assert.Contains(t, w.Body.String(), `"db"`)
+	w = sendAs(s, "", "POST", "creds/db", url.Values{"op": {"incr"}})
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.NotContains(t, w.Body.String(), "hunter2")
+
+	// the marks survive a restart
+	s = NewServer(testDataPath, nil, nil)
+	w = sendAs(s, "", "GET", "creds/db", nil)
+	assert.NotContains(t, w.Body.String(), "hunter2")
+	assert.Equal(t, http.StatusOK, sendRequest(s.ServeHTTP, "DELETE", "_/secrets/creds", nil))
+	w = sendAs(s, "", "GET", "creds/db", nil)
+	assert.Contains(t, w.Body.String(), "hunter2")
+}
+
+func TestSecretsRevealNeedsPermission(t *testing.T) {
+	cleanData()
+	f, err := ioutil.TempFile("", "acl")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString(`[
+		{"principal": "app", "prefix": "creds", "permissions": ["read", "write", "reveal"]},
+		{"principal": "ops", "prefix": "creds", "permissions": ["read"]}
+	]`)
+	f.Close()
+	acl, err := LoadACL(f.Name())
+	assert.Nil(t, err)
+	s := NewServer(testDataPath, nil, nil)
+	assert.Nil(t, s.MarkSecret("/creds/"))
+	s.EnforceACL(acl)
+
+	assert.Equal(t, http.StatusOK, sendAs(s, "app", "PUT", "creds/db", url.Values{"value": {"hunter2"}}).Code)
+	assert.Equal(t, http.StatusOK, sendAs(s, "ops", "GET", "creds/db", nil).Code)
+	assert.Equal(t, http.StatusForbidden, sendAs(s, "ops", "GET", "creds/db", url.Values{"reveal": {"true"}}).Code)
+	w := sendAs(s, "app", "GET", "creds/db", url.Values{"reveal": {"true"}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "hunter2")
+}
@@ -0,0 +1,293 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SemaphoreHolder is a holder of a semaphore slot
+type SemaphoreHolder struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+// SemaphoreInfo describes the state of a semaphore
+type SemaphoreInfo struct {
+	Name     string            `json:"name"`
+	Capacity int               `json:"capacity"`
+	Holders  []SemaphoreHolder `json:"holders"`
+	Waiting  int               `json:"waiting"`
+}
+
+type semaphoreResponse struct {
+	Semaphore  *SemaphoreInfo  `json:"semaphore,omitempty"`
+	Semaphores []SemaphoreInfo `json:"semaphores,omitempty"`
+	Error      string          `json:"error,omitempty"`
+}
+
+type semaphoreWaiter struct {
+	holder  string
+	ttl     time.Duration
+	granted chan struct{}
+}
+
+type semaphore struct {
+	name     string
+	capacity int
+	holders  map[string]*SemaphoreHolder
+	// waiters in the order they arrived, slots are handed out first come,
+	// first served
+	waiters []*semaphoreWaiter
+}
+
+func (sem *semaphore) info() SemaphoreInfo {
+	info := SemaphoreInfo{Name: sem.name, Capacity: sem.capacity, Holders: []SemaphoreHolder{}, Waiting: len(sem.waiters)}
+	for _, holder := range sem.holders {
+		info.Holders = append(info.Holders, *holder)
+	}
+	sort.Slice(info.Holders, func(i, j int) bool { return info.Holders[i].Holder < info.Holders[j].Holder })
+	return info
+}
+
+// semaphoreManager holds named counting semaphores, a slot whose holder
+// does not renew it in time is freed automatically
+type semaphoreManager struct {
+	mutex      sync.Mutex
+	semaphores map[string]*semaphore
+}
+
+func newSemaphoreManager() *semaphoreManager {
+	return &semaphoreManager{semaphores: make(map[string]*semaphore)}
+}
+
+// grant hands a slot to holder and arranges for it to expire, must be
+// called with the mutex held
+func (m *semaphoreManager) grant(sem *semaphore, holder string, ttl time.Duration) *SemaphoreHolder {
+	slot := &SemaphoreHolder{Holder: holder, Expires: time.Now().Add(ttl)}
+	sem.holders[holder] = slot
+	time.AfterFunc(ttl, func() {
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		if sem.holders[holder] == slot {
+			delete(sem.holders, holder)
+			m.dispatch(sem)
+		}
+	})
+	return slot
+}
+
+// dispatch frees expired slots, hands free slots to waiters in FIFO order
+// and forgets unused semaphores, must be called with the mutex held
+func (m *semaphoreManager) dispatch(sem *semaphore) {
+	now := time.Now()
+	for holder, slot := range sem.holders {
+		if !now.Before(slot.Expires) {
+			delete(sem.holders, holder)
+		}
+	}
+	for len(sem.holders) < sem.capacity && len(sem.waiters) > 0 {
+		waiter := sem.waiters[0]
+		sem.waiters = sem.waiters[1:]
+		m.grant(sem, waiter.holder, waiter.ttl)
+		close(waiter.granted)
+	}
+	if len(sem.holders) == 0 && len(sem.waiters) == 0 && m.semaphores[sem.name] == sem {
+		delete(m.semaphores, sem.name)
+	}
+}
+
+// acquire takes a slot of the semaphore for holder, waiting up to wait or
+// until cancel is closed. Acquiring a slot already held renews it.
+func (m *semaphoreManager) acquire(name, holder string, capacity int, ttl, wait time.Duration, cancel <-chan struct{}) (SemaphoreInfo, error) {
+	m.mutex.Lock()
+	sem, ok := m.semaphores[name]
+	if ok {
+		// forgets the semaphore if all its slots expired
+		m.dispatch(sem)
+		sem, ok = m.semaphores[name]
+	}
+	if !ok {
+		sem = &semaphore{name: name, capacity: capacity, holders: make(map[string]*SemaphoreHolder)}
+		m.semaphores[name] = sem
+	} else if sem.capacity != capacity {
+		info := sem.info()
+		m.mutex.Unlock()
+		return info, &requestError{http.StatusConflict, "Semaphore '" + name + "' has a capacity of " + strconv.Itoa(sem.capacity) + "."}
+	}
+
+	if _, held := sem.holders[holder]; held || (len(sem.holders) < capacity && len(sem.waiters) == 0) {
+		m.grant(sem, holder, ttl)
+		info := sem.info()
+		m.mutex.Unlock()
+		return info, nil
+	}
+
+	full := &requestError{http.StatusConflict, "All slots of semaphore '" + name + "' are taken."}
+	if wait <= 0 {
+		info := sem.info()
+		m.mutex.Unlock()
+		return info, full
+	}
+
+	waiter := &semaphoreWaiter{holder: holder, ttl: ttl, granted: make(chan struct{})}
+	sem.waiters = append(sem.waiters, waiter)
+	m.mutex.Unlock()
+
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+	select {
+	case <-waiter.granted:
+	case <-timeout.C:
+	case <-cancel:
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	select {
+	case <-waiter.granted:
+		return sem.info(), nil
+	default:
+	}
+	for i, w := range sem.waiters {
+		if w == waiter {
+			sem.waiters = append(sem.waiters[:i], sem.waiters[i+1:]...)
+			break
+		}
+	}
+	info := sem.info()
+	m.dispatch(sem)
+	return info, full
+}
+
+func (m *semaphoreManager) held(name, holder string) (*semaphore, error) {
+	sem, ok := m.semaphores[name]
+	if ok {
+		m.dispatch(sem)
+	}
+	if !ok || sem.holders[holder] == nil {
+		return nil, &requestError{http.StatusNotFound, "'" + holder + "' holds no slot of semaphore '" + name + "'."}
+	}
+	return sem, nil
+}
+
+// renew extends the TTL of the slot held by holder
+func (m *semaphoreManager) renew(name, holder string, ttl time.Duration) (SemaphoreInfo, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	sem, err := m.held(name, holder)
+	if err != nil {
+		return SemaphoreInfo{}, err
+	}
+	m.grant(sem, holder, ttl)
+	return sem.info(), nil
+}
+
+// release frees the slot held by holder
+func (m *semaphoreManager) release(name, holder string) (SemaphoreInfo, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	sem, err := m.held(name, holder)
+	if err != nil {
+		return SemaphoreInfo{}, err
+	}
+	delete(sem.holders, holder)
+	m.dispatch(sem)
+	return sem.info(), nil
+}
+
+func (m *semaphoreManager) get(name string) (SemaphoreInfo, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	sem, ok := m.semaphores[name]
+	if !ok {
+		return SemaphoreInfo{}, false
+	}
+	m.dispatch(sem)
+	return sem.info(), true
+}
+
+func (m *semaphoreManager) list() []SemaphoreInfo {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	semaphores := []SemaphoreInfo{}
+	for _, sem := range m.semaphores {
+		semaphores = append(semaphores, sem.info())
+	}
+	sort.Slice(semaphores, func(i, j int) bool { return semaphores[i].Name < semaphores[j].Name })
+	return semaphores
+}
+
+// serveSemaphores handles /_/semaphores/<name>: POST acquires one of
+// 'capacity' slots for 'holder', waiting up to 'wait' for it, PUT renews it
+// for another 'ttl', DELETE releases it and GET lists the holders
+func (s *Server) serveSemaphores(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/_/semaphores"), "/")
+	if name == "" {
+		if r.Method != "GET" {
+			writeJSON(w, http.StatusMethodNotAllowed, semaphoreResponse{Error: "A semaphore name is required."})
+			return
+		}
+		writeJSON(w, http.StatusOK, semaphoreResponse{Semaphores: s.semaphores.list()})
+		return
+	}
+	if !validKey.MatchString(name) {
+		writeJSON(w, http.StatusBadRequest, semaphoreResponse{Error: "Invalid semaphore name. Only " + validKey.String() + " allowed!"})
+		return
+	}
+
+	if r.Method == "GET" {
+		if info, ok := s.semaphores.get(name); ok {
+			writeJSON(w, http.StatusOK, semaphoreResponse{Semaphore: &info})
+		} else {
+			writeJSON(w, http.StatusNotFound, semaphoreResponse{Error: "Semaphore '" + name + "' has no holders."})
+		}
+		return
+	}
+
+	holder := r.Form.Get("holder")
+	if holder == "" {
+		writeJSON(w, http.StatusBadRequest, semaphoreResponse{Error: "Parameter 'holder' is required."})
+		return
+	}
+	ttl, wait, err := durationParams(r.Form)
+	if err != nil {
+		writeSemaphoreError(w, err, nil)
+		return
+	}
+
+	var info SemaphoreInfo
+	switch r.Method {
+	case "POST":
+		capacity, convErr := strconv.Atoi(r.Form.Get("capacity"))
+		if convErr != nil || capacity < 1 {
+			err = &requestError{http.StatusBadRequest, "Parameter 'capacity' is not a positive integer."}
+			break
+		}
+		info, err = s.semaphores.acquire(name, holder, capacity, ttl, wait, r.Context().Done())
+	case "PUT":
+		info, err = s.semaphores.renew(name, holder, ttl)
+	case "DELETE":
+		info, err = s.semaphores.release(name, holder)
+	default:
+		err = &requestError{http.StatusMethodNotAllowed, "Method not allowed."}
+	}
+
+	if err != nil {
+		writeSemaphoreError(w, err, &info)
+		return
+	}
+	writeJSON(w, http.StatusOK, semaphoreResponse{Semaphore: &info})
+}
+
+func writeSemaphoreError(w http.ResponseWriter, err error, info *SemaphoreInfo) {
+	if info != nil && info.Name == "" {
+		info = nil
+	}
+	responseData := errorResponse("", err, http.StatusInternalServerError)
+	writeJSON(w, responseData.StatusCode, semaphoreResponse{Semaphore: info, Error: responseData.Error})
+}
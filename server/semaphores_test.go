@@ -0,0 +1,112 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSemaphoreCapacity(t *testing.T) {
+	m := newSemaphoreManager()
+	for _, holder := range []string{"a", "b"} {
+		_, err := m.acquire("jobs", holder, 2, time.Minute, 0, nil)
+		assert.Nil(t, err)
+	}
+	_, err := m.acquire("jobs", "c", 2, time.Minute, 0, nil)
+	assert.NotNil(t, err)
+	_, err = m.acquire("jobs", "c", 3, time.Minute, 0, nil)
+	assert.NotNil(t, err)
+
+	info, ok := m.get("jobs")
+	assert.True(t, ok)
+	assert.Len(t, info.Holders, 2)
+
+	info, err = m.release("jobs", "a")
+	assert.Nil(t, err)
+	assert.Len(t, info.Holders, 1)
+	_, err = m.release("jobs", "a")
+	assert.NotNil(t, err)
+
+	_, err = m.acquire("jobs", "c", 2, time.Minute, 0, nil)
+	assert.Nil(t, err)
+}
+
+func TestSemaphoreExpires(t *testing.T) {
+	m := newSemaphoreManager()
+	_, err := m.acquire("jobs", "a", 1, 50*time.Millisecond, 0, nil)
+	assert.Nil(t, err)
+	_, err = m.acquire("jobs", "b", 1, time.Minute, 0, nil)
+	assert.NotNil(t, err)
+
+	time.Sleep(80 * time.Millisecond)
+	_, err = m.renew("jobs", "a", time.Minute)
+	assert.NotNil(t, err)
+	_, err = m.acquire("jobs", "b", 1, time.Minute, 0, nil)
+	assert.Nil(t, err)
+}
+
+func TestSemaphoreWaitersAreServedInOrder(t *testing.T) {
+	m := newSemaphoreManager()
+	_, err := m.acquire("jobs", "holder", 1, time.Minute, 0, nil)
+	assert.Nil(t, err)
+
+	order := make(chan string, 3)
+	for i, waiter := range []string{"first", "second", "third"} {
+		go func(waiter string) {
+			if _, err := m.acquire("jobs", waiter, 1, time.Minute, 5*time.Second, nil); err != nil {
+				t.Error(err)
+				return
+			}
+			order <- waiter
+			time.Sleep(10 * time.Millisecond)
+			m.release("jobs", waiter)
+		}(waiter)
+		// make sure the waiters queue up in this order
+		for {
+			info, _ := m.get("jobs")
+			if info.Waiting == i+1 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	_, err = m.release("jobs", "holder")
+	assert.Nil(t, err)
+
+	assert.Equal(t, "first", <-order)
+	assert.Equal(t, "second", <-order)
+	assert.Equal(t, "third", <-order)
+}
+
+func TestSemaphoreWaiterTimesOut(t *testing.T) {
+	m := newSemaphoreManager()
+	_, err := m.acquire("jobs", "a", 1, time.Minute, 0, nil)
+	assert.Nil(t, err)
+	_, err = m.acquire("jobs", "b", 1, time.Minute, 20*time.Millisecond, nil)
+	assert.NotNil(t, err)
+	info, _ := m.get("jobs")
+	assert.Equal(t, 0, info.Waiting)
+}
+
+func TestHTTPSemaphores(t *testing.T) {
+	handler := NewServerHandler(testDataPath, nil, nil)
+	request := func(method string, vals url.Values) int {
+		req, _ := http.NewRequest(method, "http://localhost/_/semaphores/jobs?"+vals.Encode(), nil)
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusBadRequest, request("POST", url.Values{"holder": {"a"}}))
+	assert.Equal(t, http.StatusOK, request("POST", url.Values{"holder": {"a"}, "capacity": {"1"}}))
+	assert.Equal(t, http.StatusConflict, request("POST", url.Values{"holder": {"b"}, "capacity": {"1"}}))
+	assert.Equal(t, http.StatusOK, request("GET", url.Values{}))
+	assert.Equal(t, http.StatusOK, request("PUT", url.Values{"holder": {"a"}, "ttl": {"60"}}))
+	assert.Equal(t, http.StatusNotFound, request("DELETE", url.Values{"holder": {"b"}}))
+	assert.Equal(t, http.StatusOK, request("DELETE", url.Values{"holder": {"a"}}))
+	assert.Equal(t, http.StatusNotFound, request("GET", url.Values{}))
+}
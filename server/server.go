@@ -3,7 +3,6 @@ package server
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -12,6 +11,8 @@ import (
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type ResponseData struct {
@@ -19,84 +20,371 @@ type ResponseData struct {
 	Key         string   `json:"key"`
 	IsNamespace bool     `json:"namespace"`
 	Value       string   `json:"value"`
-	Keys        []string `json:"keys,omitempty"`  // need better decision here
+	Keys        []string `json:"keys,omitempty"` // need better decision here
+	Redacted    bool     `json:"redacted,omitempty"`
 	Error       string   `json:"error,omitempty"` // need better decision here
 }
 
-type Entry struct {
-	data        []string
-	isNamespace bool
+var validKey = regexp.MustCompile(`^[a-zA-Z0-9_\-/:]+$`)
+
+// the namespace reservedNamespace and the paths below it belong to the
+// system APIs, so no key can clash with them
+const (
+	reservedNamespace = "_"
+	reservedPrefix    = reservedNamespace + "/"
+)
+
+// Server serves the key API and the system APIs below /_/
+type Server struct {
+	dataPath           string
+	cacheExemptionList []string
+	webHookURLs        []string
+	systemRoutes       map[string]http.HandlerFunc
+	schemas            *schemaRegistry
+	secrets            *secretRegistry
+	locks              *lockManager
+	semaphores         *semaphoreManager
+	expiries           *expiryRegistry
+	tokens             *TokenStore
+	acl                *ACL
+	readOnly           int32
+	replication        *replicationLog
+	follower           *Follower
+	cluster            *Cluster
+	syncer             *Syncer
+	syncKey            []byte
+	snapshotGate       sync.RWMutex
+	backups            *BackupScheduler
+	encryption         *Encryption
+	auditLog           *AuditLog
+	requestMetrics     *requestMetrics
+	storageCounts      storageCounts
+	readiness          ReadinessConfig
+	startupComplete    int32
+	started            time.Time
+	draining           chan struct{}
+	drainOnce          sync.Once
 }
 
-var skvsCache map[string]Entry = make(map[string]Entry)
-var skvsCacheMutex sync.Mutex
+// NewServer returns a server storing its keys below dataPath
+func NewServer(dataPath string, cacheExemptionList []string, webHookURLs []string) *Server {
+	s := &Server{
+		dataPath:           dataPath,
+		cacheExemptionList: cacheExemptionList,
+		webHookURLs:        webHookURLs,
+		systemRoutes:       make(map[string]http.HandlerFunc),
+		locks:              newLockManager(),
+		semaphores:         newSemaphoreManager(),
+		requestMetrics:     newRequestMetrics(),
+		started:            time.Now(),
+		draining:           make(chan struct{}),
+	}
 
-var validKey = regexp.MustCompile(`^[a-zA-Z0-9_\-/:]+$`)
+	s.replication = resumeReplicationLog(s.systemPath("replication-log.json"))
+	var err error
+	if s.schemas, err = loadSchemaRegistry(s.systemPath("schemas.json")); err != nil {
+		logger().Error("Loading schemas failed", Fields{"error": err})
+	}
+	if s.secrets, err = loadSecretRegistry(s.systemPath("secrets.json")); err != nil {
+		logger().Error("Loading secrets failed", Fields{"error": err})
+	}
+	if s.expiries, err = loadExpiryRegistry(s.systemPath("expiries.json"), s.expireKey); err != nil {
+		logger().Error("Loading expiries failed", Fields{"error": err})
+	}
+	s.expiries.start()
+	s.resumeHooks()
+
+	s.HandleSystem("events", s.serveEvents)
+	s.HandleSystem("schemas", s.serveSchemas)
+	s.HandleSystem("secrets", s.serveSecrets)
+	s.HandleSystem("locks", s.serveLocks)
+	s.HandleSystem("semaphores", s.serveSemaphores)
+	s.HandleSystem("admin", s.serveAdmin)
+	s.HandleSystem("replication", s.serveReplication)
+	s.HandleSystem("sync", s.serveSync)
+	s.HandleSystem("audit", s.serveAudit)
+	s.HandleSystem("metrics", s.serveMetrics)
+	s.HandleSystem("health", s.serveHealth)
+	s.HandleSystem("ready", s.serveReady)
+	return s
+}
 
 func NewServerHandler(dataPath string, cacheExempionList []string, webHookURLs []string) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		r.ParseForm()
-		var responseData ResponseData
-		key := r.URL.Path[1:]
-		if validKey.MatchString(key) {
-			key_path := filepath.Join(dataPath, key)
-			exempt := isExemptFromCache(key, cacheExempionList)
-			value := r.PostForm.Get("value")
-			var keys []string
-			var err error
-
-			switch r.Method {
-			case "GET":
-				var entry Entry
-				entry, err = readKey(key_path, exempt)
-				if err == nil {
-					if entry.isNamespace {
-						keys = entry.data
-					} else {
-						value = entry.data[0]
-					}
-				}
-			case "DELETE":
-				err = deleteKey(key_path)
-			case "PUT", "POST":
-				err = putKey(key_path, exempt, value)
-			}
+	return NewServer(dataPath, cacheExempionList, webHookURLs).ServeHTTP
+}
+
+// HandleSystem registers handler for /_name and all paths below it
+func (s *Server) HandleSystem(name string, handler http.HandlerFunc) {
+	s.systemRoutes[name] = handler
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	started := time.Now()
+	r = withRequestID(r, newRequestID(r))
+	w.Header().Set(RequestIDHeader, RequestID(r))
+	w.Header().Set(ModeHeader, s.mode())
+	recorder := &statusRecorder{ResponseWriter: w}
+	if isProbe(r.URL.Path[1:]) {
+		// orchestrators probe without credentials, on every member
+		s.serveSystem(recorder, r, r.URL.Path[1:])
+	} else if authenticated, ok := s.authenticate(recorder, r); ok {
+		r = authenticated
+		s.route(recorder, r)
+	}
+	latency := time.Since(started)
+	s.requestMetrics.observe(r.Method, recorder.code(), latency)
+	logRequest(r, recorder.code(), latency)
+}
+
+// authenticate sets the principal of r, requests that fail authentication
+// are answered
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	key := r.URL.Path[1:]
+	if principal, ok := certificatePrincipal(r); ok {
+		r = withPrincipal(r, principal)
+	} else if s.tokens != nil && r.Header.Get("Authorization") != "" {
+		var ok bool
+		if r, ok = s.tokens.authenticate(r); !ok {
+			writeUnauthorized(w, key)
+			return r, false
+		}
+	} else if principal, ok := peerPrincipal(r); ok {
+		r = withPrincipal(r, principal)
+	} else if s.tokens != nil {
+		writeUnauthorized(w, key)
+		return r, false
+	}
+	return r, true
+}
+
+// route passes an authenticated request on to the cluster, the system APIs
+// or the keys
+func (s *Server) route(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Path[1:]
+	if s.rejectsChange(r, key) {
+		writeResponse(w, errorResponse(key, errReadOnly, http.StatusServiceUnavailable))
+		return
+	}
+	if s.follower != nil && s.follower.handlesChange(w, r, key) {
+		return
+	}
+
+	if isReservedKey(key) {
+		if err := s.authorizeSystem(r, key); err != nil {
+			writeResponse(w, errorResponse(key, err, http.StatusForbidden))
+			return
+		}
+	}
+	if s.cluster != nil && s.cluster.serve(w, r, key) {
+		return
+	}
+
+	if isReservedKey(key) {
+		s.serveSystem(w, r, key)
+	} else {
+		s.serveKey(w, r, key)
+	}
+}
+
+func (s *Server) serveSystem(w http.ResponseWriter, r *http.Request, path string) {
+	name := strings.SplitN(strings.TrimPrefix(path, reservedPrefix), "/", 2)[0]
+	if handler, ok := s.systemRoutes[name]; ok {
+		handler(w, r)
+		return
+	}
+	writeResponse(w, ResponseData{StatusCode: http.StatusNotFound, Key: path, Error: "Unknown system path. The namespace '" + reservedNamespace + "' is reserved."})
+}
+
+func (s *Server) serveKey(w http.ResponseWriter, r *http.Request, key string) {
+	r.ParseForm()
+	if r.Method != "GET" {
+		defer s.changing()()
+	}
+	if err := s.authorizeReveal(r, key); err != nil {
+		writeResponse(w, errorResponse(key, err, http.StatusForbidden))
+		return
+	}
+	var responseData ResponseData
+	var change Event
+	if validKey.MatchString(key) {
+		key_path := filepath.Join(s.dataPath, key)
+		exempt := isExemptFromCache(key, s.cacheExemptionList)
+		value := r.PostForm.Get("value")
+		var keys []string
+		var err error
+		var oldHash string
+		change = Event{Key: key, Action: r.Method}
+		if r.Method != "GET" {
+			oldHash = s.auditHash(key, key_path)
+		}
 
+		switch r.Method {
+		case "GET":
+			if s.acl != nil && !s.acl.visible(callerNames(r), key) {
+				err = s.deny(r, PermissionRead, key)
+				break
+			}
+			var entry Entry
+			entry, err = readKey(key_path, exempt)
 			if err == nil {
-				responseData = ResponseData{StatusCode: http.StatusOK, Key: key, Value: value, Keys: keys}
-				if keys == nil {
-					responseData.IsNamespace = false
+				err = s.authorizeRead(r, key, &entry)
+			}
+			if err == nil {
+				if entry.isNamespace {
+					keys = entry.data
 				} else {
-					responseData.IsNamespace = true
+					value = entry.data[0]
 				}
+			}
+		case "DELETE":
+			if err = s.authorizeChange(r, key); err == nil {
+				err = s.removeKey(key, key_path, exempt, r.Form)
+			}
+		case "PUT", "POST":
+			if err = s.authorizeChange(r, key); err != nil {
+				break
+			}
+			if op := operation(r); op != "" {
+				change, value, err = s.applyOperation(op, key, key_path, exempt, r.Form)
+			} else if err = s.validate(key, value); err == nil {
+				err = s.writeKey(key, key_path, exempt, value, r.Form, requestTime(r))
+			}
+		}
+
+		if err == nil {
+			responseData = ResponseData{StatusCode: http.StatusOK, Key: change.Key, Value: value, Keys: keys}
+			if keys == nil {
+				responseData.IsNamespace = false
 			} else {
-				responseData = ResponseData{StatusCode: http.StatusNotFound, Key: key, Error: err.Error()}
+				responseData.IsNamespace = true
+			}
+			if r.Method != "GET" {
+				s.auditChange(r, change, oldHash, value)
 			}
+			s.redact(r, change.Key, &responseData)
 		} else {
-			responseData = ResponseData{StatusCode: http.StatusBadRequest, Key: key, Error: "Invalid key. Only " + validKey.String() + " allowed!"}
+			responseData = errorResponse(key, err, http.StatusNotFound)
 		}
+	} else {
+		responseData = ResponseData{StatusCode: http.StatusBadRequest, Key: key, Error: "Invalid key. Only " + validKey.String() + " allowed!"}
+	}
 
-		content, err := json.Marshal(responseData)
-		if err == nil && responseData.StatusCode != 0 {
-			callHooks(key, r.Method, nil)
-			w.WriteHeader(responseData.StatusCode)
-			w.Header().Set("Content-Type", "application/json")
-			w.Write(append(content, '\n'))
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
-			fmt.Println(err)
+	if writeResponse(w, responseData) && r.Method != "GET" && responseData.StatusCode == http.StatusOK {
+		s.notifyChange(r, change.Key, change.Action)
+	}
+}
+
+// operation returns the operation requested by a POST, if any
+func operation(r *http.Request) string {
+	if r.Method != "POST" {
+		return ""
+	}
+	if r.Form.Get("sequential") == "true" {
+		return "push"
+	}
+	return r.Form.Get("op")
+}
+
+// requestError is an error caused by the request, answered with status
+type requestError struct {
+	status  int
+	message string
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+// errorResponse answers a failed request on key, errors not caused by the
+// request are answered with fallbackStatus
+func errorResponse(key string, err error, fallbackStatus int) ResponseData {
+	if e, ok := err.(*requestError); ok {
+		return ResponseData{StatusCode: e.status, Key: key, Error: e.message}
+	}
+	return ResponseData{StatusCode: fallbackStatus, Key: key, Error: err.Error()}
+}
+
+// writeResponse sends responseData with its status code
+func writeResponse(w http.ResponseWriter, responseData ResponseData) bool {
+	return writeJSON(w, responseData.StatusCode, responseData)
+}
+
+// writeJSON sends data as JSON and reports whether that succeeded
+func writeJSON(w http.ResponseWriter, status int, data interface{}) bool {
+	content, err := json.Marshal(data)
+	if err == nil && status != 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write(append(content, '\n'))
+		return true
+	}
+
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
+	logger().Error("Encoding response failed", Fields{"error": err})
+	return false
+}
+
+// validate checks value against the rules registered for key
+func (s *Server) validate(key, value string) error {
+	if err := s.schemas.validate(key, value); err != nil {
+		return &requestError{http.StatusUnprocessableEntity, err.Error()}
+	}
+	return nil
+}
+
+// systemPath returns the path of a file holding server state, it lies in
+// the reserved part of the data path
+func (s *Server) systemPath(name string) string {
+	return filepath.Join(s.dataPath, reservedPrefix+"system", name)
+}
+
+// publish a change of key to web hooks and event subscribers, r is the
+// request that made it or nil for changes the server made itself
+func (s *Server) notifyChange(r *http.Request, key, action string) {
+	s.recordMutation(key)
+	switch effectsOf(r) {
+	case allEffects:
+		requestID := ""
+		if r != nil {
+			requestID = RequestID(r)
 		}
+		callHooks(key, action, requestID, s.webHookURLs)
+		fallthrough
+	case localEffects:
+		publishChange(s.dataPath, key, action)
 	}
 }
 
+// report whether key belongs to the reserved system namespace
+func isReservedKey(key string) bool {
+	return key == reservedNamespace || strings.HasPrefix(key, reservedPrefix)
+}
+
 func readKey(path string, exemptFromCache bool) (Entry, error) {
+	unlock := rlockPath(path)
+	defer unlock()
+	return readKeyLocked(path, exemptFromCache)
+}
+
+// readKeyLocked is readKey for callers already holding the lock of path
+func readKeyLocked(path string, exemptFromCache bool) (Entry, error) {
+	encryption, key := encryptionFor(path)
+	if encryption != nil && !encryption.cachePlaintext {
+		exemptFromCache = true
+	}
+
 	// return from cache if available
-	if cached, ok := skvsCache[path]; ok {
+	if cached, ok := cacheLookup(path); ok && !exemptFromCache {
+		atomic.AddUint64(&cacheHits, 1)
 		return cached, nil
 	}
+	if !exemptFromCache {
+		atomic.AddUint64(&cacheMisses, 1)
+	}
 
 	// otherwise read from FS
+	generation := cacheGeneration()
 	var result []string
 	var err error
 
@@ -114,7 +402,12 @@ func readKey(path string, exemptFromCache bool) (Entry, error) {
 			}
 		} else {
 			var content []byte
-			if content, err = ioutil.ReadFile(path); err == nil {
+			if content, err = ioutil.ReadFile(path); err == nil && encryption != nil {
+				var value string
+				if value, err = encryption.open(key, string(content)); err == nil {
+					result = append(result, value)
+				}
+			} else if err == nil {
 				result = append(result, string(content))
 			}
 		}
@@ -123,68 +416,197 @@ func readKey(path string, exemptFromCache bool) (Entry, error) {
 	entry := Entry{data: result, isNamespace: isNamespace}
 	if err == nil && !exemptFromCache {
 		// store in cache for future reads
-		skvsCacheMutex.Lock()
-		defer skvsCacheMutex.Unlock()
-		skvsCache[path] = entry
+		cacheStoreRead(path, entry, generation)
 	}
 
 	return entry, err
 }
 
 func putKey(path string, exemptFromCache bool, value string) error {
+	unlock := lockPath(path)
+	defer unlock()
+	return putKeyLocked(path, exemptFromCache, value)
+}
+
+// putKeyLocked is putKey for callers already holding the lock of path
+func putKeyLocked(path string, exemptFromCache bool, value string) error {
+	content := value
+	if encryption, key := encryptionFor(path); encryption != nil {
+		var err error
+		if content, value, err = encryption.prepare(key, value); err != nil {
+			return err
+		}
+		exemptFromCache = exemptFromCache || !encryption.cachePlaintext
+	}
+
 	// if cache already contains identical data, then do nothing
-	if v, ok := skvsCache[path]; ok && !exemptFromCache && len(v.data) == 1 && v.data[0] == value {
+	if v, ok := cacheLookup(path); ok && !exemptFromCache && !v.isNamespace && len(v.data) == 1 && v.data[0] == value {
 		return nil
 	}
 
-	os.MkdirAll(filepath.Dir(path), os.ModePerm)
-	err := ioutil.WriteFile(path, []byte(value), os.ModePerm)
+	makeDirs(filepath.Dir(path))
+	done := markOwnChange(path)
+	err := ioutil.WriteFile(path, []byte(content), os.ModePerm)
+	done()
 	if err != nil {
+		invalidateCache(path)
 		return err
 	}
 
-	if !exemptFromCache {
-		// update cache
-		skvsCacheMutex.Lock()
-		defer skvsCacheMutex.Unlock()
+	if exemptFromCache {
 		invalidateCache(path)
-
-		skvsCache[path] = Entry{data: []string{value}, isNamespace: false}
+	} else {
+		cacheStoreWrite(path, Entry{data: []string{value}, isNamespace: false})
 	}
 
 	return nil
 }
 
-func deleteKey(path string) error {
-	skvsCacheMutex.Lock()
-	defer skvsCacheMutex.Unlock()
-	invalidateCache(path)
-	return os.RemoveAll(path)
+// updateKey atomically replaces the value at path with the result of
+// update, which is called with the current value and whether it exists
+func updateKey(path string, exemptFromCache bool, update func(value string, exists bool) (string, error)) (string, error) {
+	unlock := lockPath(path)
+	defer unlock()
+
+	value, exists, err := currentValue(path, exemptFromCache)
+	if err != nil {
+		return "", err
+	}
+	if value, err = update(value, exists); err != nil {
+		return "", err
+	}
+	return value, putKeyLocked(path, exemptFromCache, value)
 }
 
-// Return nil if File exists, else non-nil value
-func fileExists(filename string) error {
-	_, err := os.Stat(filename)
-	return err
+// checkPrecondition verifies the 'prevValue' and 'prevExist' parameters
+// of a request against the current state of a key
+func checkPrecondition(form url.Values, value string, exists bool) error {
+	if prevExist := form.Get("prevExist"); prevExist != "" && (prevExist == "true") != exists {
+		if exists {
+			return &requestError{http.StatusPreconditionFailed, "Key already exists."}
+		}
+		return &requestError{http.StatusPreconditionFailed, "Key does not exist."}
+	}
+	if prevValue, ok := form["prevValue"]; ok && (!exists || prevValue[0] != value) {
+		return &requestError{http.StatusPreconditionFailed, "Current value does not match 'prevValue'."}
+	}
+	return nil
 }
 
-// removes cache entries for the given path and all its parents and/or children
-func invalidateCache(path string) {
-	key, _ := readKey(path, true)
-	if key.isNamespace {
-		for _, child := range key.data {
-			invalidateCache(path + "/" + child)
+// currentValue returns the value at path and whether it exists, the caller
+// has to hold the lock of path
+func currentValue(path string, exemptFromCache bool) (string, bool, error) {
+	entry, err := readKeyLocked(path, exemptFromCache)
+	if os.IsNotExist(err) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	if entry.isNamespace {
+		return "", true, &requestError{http.StatusConflict, "'" + filepath.Base(path) + "' is a namespace."}
+	}
+	return entry.data[0], true, nil
+}
+
+// writeKey stores value at key if the preconditions of the request hold
+// and sets or clears the key's expiry according to the 'ttl' parameter
+func (s *Server) writeKey(key, keyPath string, exempt bool, value string, form url.Values, now time.Time) error {
+	ttl, err := parseDuration(form.Get("ttl"), 0)
+	if err != nil || ttl < 0 {
+		return &requestError{http.StatusBadRequest, "Parameter 'ttl' is not a duration."}
+	}
+
+	unlock := lockPath(keyPath)
+	defer unlock()
+
+	if form.Get("prevExist") != "" || form["prevValue"] != nil {
+		current, exists, err := currentValue(keyPath, exempt)
+		if err != nil {
+			return err
+		}
+		if err = checkPrecondition(form, current, exists); err != nil {
+			return err
 		}
 	}
 
-	for {
-		delete(skvsCache, path)
-		if path == "/" {
-			break
-		} else {
-			path = filepath.Dir(path)
+	if err = putKeyLocked(keyPath, exempt, value); err != nil {
+		return err
+	}
+	var deadline time.Time
+	if ttl > 0 {
+		deadline = now.Add(ttl)
+	}
+	return s.expiries.set(key, deadline)
+}
+
+// removeKey deletes key and everything below it if the preconditions of
+// the request hold
+func (s *Server) removeKey(key, keyPath string, exempt bool, form url.Values) error {
+	unlock := lockPath(keyPath)
+	defer unlock()
+
+	if form.Get("prevExist") != "" || form["prevValue"] != nil {
+		current, exists, err := currentValue(keyPath, exempt)
+		if err != nil {
+			return err
+		}
+		if err = checkPrecondition(form, current, exists); err != nil {
+			return err
 		}
 	}
+
+	if err := deleteKeyLocked(keyPath); err != nil {
+		return err
+	}
+	return s.expiries.clear(key)
+}
+
+func deleteKey(path string) error {
+	unlock := lockPath(path)
+	defer unlock()
+	return deleteKeyLocked(path)
+}
+
+// deleteKeyLocked is deleteKey for callers already holding the lock of path
+func deleteKeyLocked(path string) error {
+	done := markOwnRemoval(path)
+	err := os.RemoveAll(path)
+	done()
+	invalidateCache(path)
+	return err
+}
+
+// writeFileAtomic replaces the file at path with content, readers see
+// either the old or the new content
+func writeFileAtomic(path string, content []byte) error {
+	if err := makeDirs(filepath.Dir(path)); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer markOwnChange(tmp.Name(), path)()
+	_, err = tmp.Write(content)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// Return nil if File exists, else non-nil value
+func fileExists(filename string) error {
+	_, err := os.Stat(filename)
+	return err
 }
 
 // Return nil if filename is a directory, else non-nil value
@@ -196,30 +618,20 @@ func isDirectory(filename string) error {
 	return nil
 }
 
-func callHooks(key, action string, webHookURLs []string) {
+func callHooks(key, action, requestID string, webHookURLs []string) {
 	keyparts := strings.Split(key, "/")
 	tmpkey := keyparts[0]
-	callHook(tmpkey, action, webHookURLs)
+	callHook(tmpkey, action, requestID, webHookURLs)
 	for _, keypart := range keyparts[1:] {
 		tmpkey = tmpkey + "/" + keypart
-		callHook(tmpkey, action, webHookURLs)
+		callHook(tmpkey, action, requestID, webHookURLs)
 	}
 }
 
-// ignore errors, just print them and continue
-func callHook(key, action string, webHookURLs []string) {
-	if webHookURLs == nil {
-		return
-	}
-
+// ignore errors, just log them and continue
+func callHook(key, action, requestID string, webHookURLs []string) {
 	for _, hookUrl := range webHookURLs {
-		go func(hookUrl string, hookData url.Values) {
-			if _, err := http.PostForm(hookUrl, hookData); err != nil {
-				fmt.Printf("WebHook Post failed: %s\n", err)
-			} else {
-				fmt.Printf("Called '%s' with Payload '%+v'.\n", hookUrl, hookData)
-			}
-		}(hookUrl, url.Values{"key": {key}, "action": {action}})
+		deliverHook(&hookDelivery{URL: hookUrl, Key: key, Action: action, RequestID: requestID})
 	}
 }
 
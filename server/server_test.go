@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -522,7 +523,17 @@ func TestRemoveRecursive(t *testing.T) {
 
 func cleanData() {
 	os.RemoveAll(testDataPath)
-	skvsCache = make(map[string]Entry)
+	flushCache()
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	for i := 0; i < 100; i++ {
+		if condition() {
+			return
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	t.Error("Condition not met in time.")
 }
 
 func TestMain(m *testing.M) {
@@ -535,3 +546,43 @@ func TestMain(m *testing.M) {
 	cleanData()
 	os.Exit(exit)
 }
+
+func TestHTTPReservedKey(t *testing.T) {
+	cleanData()
+	handler := NewServerHandler(testDataPath, nil, nil)
+	for _, method := range []string{"GET", "PUT", "DELETE"} {
+		req, err := http.NewRequest(method, "http://localhost/_/foobar", nil)
+		assert.Nil(t, err)
+		w := httptest.NewRecorder()
+		handler(w, req)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	}
+	_, err := os.Stat(expandPath("_/foobar"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestHTTPSystemRoute(t *testing.T) {
+	cleanData()
+	s := NewServer(testDataPath, nil, nil)
+	var paths []string
+	s.HandleSystem("test", func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+	})
+
+	for _, path := range []string{"/_/test", "/_/test/foo/bar", "/_testing", "/test"} {
+		req, err := http.NewRequest("GET", "http://localhost"+path, nil)
+		assert.Nil(t, err)
+		s.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	assert.Equal(t, []string{"/_/test", "/_/test/foo/bar"}, paths)
+}
+
+func TestHTTPKeysStartingWithUnderscore(t *testing.T) {
+	cleanData()
+	s := NewServer(testDataPath, nil, nil)
+	assert.Equal(t, http.StatusOK, sendRequest(s.ServeHTTP, "PUT", "_legacy/events", url.Values{"value": {"1"}}))
+	assert.Equal(t, http.StatusOK, sendRequest(s.ServeHTTP, "GET", "_legacy/events", nil))
+	assert.Equal(t, http.StatusOK, sendRequest(s.ServeHTTP, "PUT", "_events", url.Values{"value": {"1"}}))
+	assert.Equal(t, http.StatusOK, sendRequest(s.ServeHTTP, "GET", "_events", nil))
+	assert.Equal(t, http.StatusNotFound, sendRequest(s.ServeHTTP, "PUT", "_/legacy", url.Values{"value": {"1"}}))
+}
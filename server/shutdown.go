@@ -0,0 +1,57 @@
+package server
+
+import "context"
+
+// Drain ends the event and replication streams, which would otherwise keep
+// their connections open, and makes the server report that it is not
+// ready. Call it before shutting down the HTTP servers.
+func (s *Server) Drain() {
+	s.drainOnce.Do(func() { close(s.draining) })
+}
+
+// isDraining reports whether the server is shutting down
+func (s *Server) isDraining() bool {
+	select {
+	case <-s.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// Shutdown stops the background work of the server and waits for pending
+// web hook calls until ctx is done. The calls still pending then are saved
+// and made again on the next start, like the replication position. Call
+// it once no requests are served anymore.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.Drain()
+	if s.syncer != nil {
+		s.syncer.Stop()
+	}
+	if s.backups != nil {
+		s.backups.Stop()
+	}
+	if s.follower != nil {
+		s.follower.Stop()
+	}
+	if s.cluster != nil {
+		s.cluster.Stop()
+	}
+	s.expiries.stopTimers()
+
+	var err error
+	if pending := waitForHooks(ctx); len(pending) > 0 {
+		if err = s.persistHooks(pending); err == nil {
+			logger().Warn("Saved pending web hooks for the next start", Fields{"count": len(pending)})
+		}
+	}
+	if saveErr := s.replication.save(s.systemPath("replication-log.json")); err == nil {
+		err = saveErr
+	}
+	if s.auditLog != nil {
+		if closeErr := s.auditLog.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDrainEndsStreams(t *testing.T) {
+	cleanData()
+	s := NewServer(testDataPath, nil, nil)
+	s.StartupComplete()
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/_/events")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	done := make(chan error)
+	go func() {
+		_, err := ioutil.ReadAll(resp.Body)
+		done <- err
+	}()
+
+	s.Drain()
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Error("The event stream did not end.")
+	}
+	status, readiness := probe(s, "_/ready")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, "Shutting down.", readiness.Checks["recovery"].Message)
+}
+
+func TestShutdownSavesPendingHooks(t *testing.T) {
+	cleanData()
+	release := make(chan struct{})
+	calls := make(chan string, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("key") != "k" {
+			return
+		}
+		calls <- r.Header.Get(RequestIDHeader)
+		<-release
+	}))
+	defer hook.Close()
+
+	s := NewServer(testDataPath, nil, []string{hook.URL})
+	assert.Equal(t, http.StatusOK, sendRequest(s.ServeHTTP, "PUT", "k", url.Values{"value": {"1"}}))
+	<-calls
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Nil(t, s.Shutdown(ctx))
+	_, err := os.Stat(s.systemPath("webhooks.json"))
+	assert.Nil(t, err)
+	close(release)
+	waitFor(t, func() bool { return pendingHookCount() == 0 })
+
+	// the next start calls the hook again
+	NewServer(testDataPath, nil, []string{hook.URL})
+	select {
+	case <-calls:
+	case <-time.After(5 * time.Second):
+		t.Error("The saved web hook was not called.")
+	}
+	_, err = os.Stat(s.systemPath("webhooks.json"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestShutdownWaitsForHooks(t *testing.T) {
+	cleanData()
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer hook.Close()
+
+	s := NewServer(testDataPath, nil, []string{hook.URL})
+	assert.Equal(t, http.StatusOK, sendRequest(s.ServeHTTP, "PUT", "a/b", url.Values{"value": {"1"}}))
+	assert.Nil(t, s.Shutdown(context.Background()))
+	assert.Equal(t, 0, pendingHookCount())
+	_, err := os.Stat(s.systemPath("webhooks.json"))
+	assert.True(t, os.IsNotExist(err))
+}
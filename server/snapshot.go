@@ -0,0 +1,374 @@
+package server
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// snapshotManifestName is the last entry of a snapshot archive, no key can
+// have this name as keys cannot contain dots
+const snapshotManifestName = "manifest.json"
+
+// SnapshotManifest lists the files of a snapshot with their SHA-256 hashes
+type SnapshotManifest struct {
+	Created time.Time         `json:"created"`
+	Files   map[string]string `json:"files"`
+}
+
+type snapshotFile struct {
+	name     string
+	content  []byte
+	modified time.Time
+}
+
+// changing holds off snapshots until the returned function is called, all
+// changes to keys and system state happen in between
+func (s *Server) changing() func() {
+	s.snapshotGate.RLock()
+	return s.snapshotGate.RUnlock
+}
+
+// snapshotted reports whether the file name, relative to the data path,
+// belongs into a snapshot: all keys, the schemas, secret prefixes, expiries
+// and queue sequences, but not the state of replication or the cluster
+func snapshotted(name string) bool {
+	if !isReservedKey(name) {
+		return true
+	}
+	system := reservedPrefix + "system/"
+	return name == system+"schemas.json" || name == system+"secrets.json" || name == system+"expiries.json" || strings.HasPrefix(name, system+"sequences/")
+}
+
+// collectSnapshot reads all files of a snapshot, keys not passing include
+// are left out and nil includes all. Changes wait while the files are read,
+// readers are not blocked.
+func (s *Server) collectSnapshot(include func(key string) bool) ([]snapshotFile, error) {
+	s.snapshotGate.Lock()
+	defer s.snapshotGate.Unlock()
+
+	files := []snapshotFile{}
+	err := filepath.Walk(s.dataPath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		name, _ := filepath.Rel(s.dataPath, filePath)
+		name = filepath.ToSlash(name)
+		if info.IsDir() {
+			if name != "." && name != reservedNamespace && isReservedKey(name) && name != reservedPrefix+"system" && !snapshotted(name+"/") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !snapshotted(name) || (include != nil && !isReservedKey(name) && !include(name)) {
+			return nil
+		}
+		content, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return err
+		}
+		files = append(files, snapshotFile{name: name, content: content, modified: info.ModTime()})
+		return nil
+	})
+	return files, err
+}
+
+// Snapshot writes a consistent gzipped tar archive of the keys and system
+// state to w
+func (s *Server) Snapshot(w io.Writer) error {
+	files, err := s.collectSnapshot(nil)
+	if err != nil {
+		return err
+	}
+	return writeSnapshot(w, files)
+}
+
+func writeSnapshot(w io.Writer, files []snapshotFile) error {
+	gz := gzip.NewWriter(w)
+	archive := tar.NewWriter(gz)
+	manifest := SnapshotManifest{Created: time.Now().UTC(), Files: map[string]string{}}
+	for _, file := range files {
+		sum := sha256.Sum256(file.content)
+		manifest.Files[file.name] = hex.EncodeToString(sum[:])
+		if err := writeSnapshotEntry(archive, file); err != nil {
+			return err
+		}
+	}
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = writeSnapshotEntry(archive, snapshotFile{name: snapshotManifestName, content: content, modified: manifest.Created}); err != nil {
+		return err
+	}
+	if err = archive.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func writeSnapshotEntry(archive *tar.Writer, file snapshotFile) error {
+	header := &tar.Header{Name: file.name, Mode: 0644, Size: int64(len(file.content)), ModTime: file.modified, Typeflag: tar.TypeReg}
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := archive.Write(file.content)
+	return err
+}
+
+// readSnapshot reads the archive at path and checks that it holds exactly
+// the files of its manifest with the listed hashes
+func readSnapshot(archivePath string) ([]snapshotFile, SnapshotManifest, error) {
+	var manifest SnapshotManifest
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return nil, manifest, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, manifest, err
+	}
+	archive := tar.NewReader(gz)
+
+	files := []snapshotFile{}
+	hashes := map[string]string{}
+	manifestFound := false
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, manifest, err
+		}
+		if manifestFound {
+			return nil, manifest, errors.New("entries after the manifest")
+		}
+		content, err := ioutil.ReadAll(archive)
+		if err != nil {
+			return nil, manifest, err
+		}
+		if header.Name == snapshotManifestName {
+			if err = json.Unmarshal(content, &manifest); err != nil {
+				return nil, manifest, fmt.Errorf("invalid manifest: %s", err)
+			}
+			manifestFound = true
+			continue
+		}
+		if header.Typeflag != tar.TypeReg || path.Clean(header.Name) != header.Name || path.IsAbs(header.Name) ||
+			strings.HasPrefix(header.Name, "../") || !snapshotted(header.Name) {
+			return nil, manifest, fmt.Errorf("unexpected entry '%s'", header.Name)
+		}
+		if _, ok := hashes[header.Name]; ok {
+			return nil, manifest, fmt.Errorf("duplicate entry '%s'", header.Name)
+		}
+		sum := sha256.Sum256(content)
+		hashes[header.Name] = hex.EncodeToString(sum[:])
+		files = append(files, snapshotFile{name: header.Name, content: content, modified: header.ModTime})
+	}
+
+	if !manifestFound {
+		return nil, manifest, errors.New("the manifest is missing, the snapshot is incomplete")
+	}
+	if len(hashes) != len(manifest.Files) {
+		return nil, manifest, fmt.Errorf("the manifest lists %d files, the snapshot holds %d", len(manifest.Files), len(hashes))
+	}
+	for name, hash := range manifest.Files {
+		if hashes[name] != hash {
+			return nil, manifest, fmt.Errorf("'%s' is missing or damaged", name)
+		}
+	}
+	return files, manifest, nil
+}
+
+// VerifySnapshot checks the integrity of the snapshot at archivePath
+func VerifySnapshot(archivePath string) (SnapshotManifest, error) {
+	_, manifest, err := readSnapshot(archivePath)
+	return manifest, err
+}
+
+// RestoreSnapshot replaces dataPath with the snapshot at archivePath. The
+// snapshot is verified and unpacked next to dataPath before it is swapped
+// in, the previous data is kept in dataPath.before-restore. The server must
+// not be running.
+func RestoreSnapshot(archivePath, dataPath string) error {
+	files, _, err := readSnapshot(archivePath)
+	if err != nil {
+		return fmt.Errorf("verifying snapshot: %s", err)
+	}
+
+	dataPath = filepath.Clean(dataPath)
+	restorePath := dataPath + ".restoring"
+	if err = os.RemoveAll(restorePath); err != nil {
+		return err
+	}
+	if err = os.MkdirAll(restorePath, os.ModePerm); err != nil {
+		return err
+	}
+	for _, file := range files {
+		filePath := filepath.Join(restorePath, filepath.FromSlash(file.name))
+		if err = os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+			return err
+		}
+		if err = ioutil.WriteFile(filePath, file.content, os.ModePerm); err != nil {
+			return err
+		}
+		if err = os.Chtimes(filePath, file.modified, file.modified); err != nil {
+			return err
+		}
+	}
+
+	previousPath := dataPath + ".before-restore"
+	if _, err = os.Stat(dataPath); err == nil {
+		if err = os.RemoveAll(previousPath); err != nil {
+			return err
+		}
+		if err = os.Rename(dataPath, previousPath); err != nil {
+			return err
+		}
+	}
+	return os.Rename(restorePath, dataPath)
+}
+
+// BackupConfig configures scheduled snapshots
+type BackupConfig struct {
+	// Dir is the directory the snapshots are written to
+	Dir string
+	// Interval between snapshots
+	Interval time.Duration
+	// Keep is the number of snapshots kept, older ones are removed
+	Keep int
+}
+
+// BackupScheduler writes snapshots to a local directory at an interval
+type BackupScheduler struct {
+	server *Server
+	config BackupConfig
+	stop   chan struct{}
+	done   chan struct{}
+	mutex  sync.Mutex
+}
+
+// ScheduleBackups writes a snapshot to config.Dir every config.Interval
+func (s *Server) ScheduleBackups(config BackupConfig) (*BackupScheduler, error) {
+	if config.Interval <= 0 || config.Keep <= 0 {
+		return nil, errors.New("the interval and number of backups kept must be positive")
+	}
+	if err := os.MkdirAll(config.Dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	b := &BackupScheduler{server: s, config: config, stop: make(chan struct{}), done: make(chan struct{})}
+	s.backups = b
+	go b.run()
+	return b, nil
+}
+
+// Stop ends the scheduled snapshots
+func (b *BackupScheduler) Stop() {
+	close(b.stop)
+	<-b.done
+}
+
+func (b *BackupScheduler) run() {
+	defer close(b.done)
+	ticker := time.NewTicker(b.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+			if name, err := b.Backup(); err != nil {
+				logger().Error("Writing backup failed", Fields{"error": err})
+			} else {
+				logger().Info("Wrote backup", Fields{"path": name})
+			}
+		}
+	}
+}
+
+// Backup writes a snapshot now, removes the snapshots beyond the number
+// kept and returns the path of the new one
+func (b *BackupScheduler) Backup() (string, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	name := filepath.Join(b.config.Dir, "skvs-"+time.Now().UTC().Format("20060102-150405.000")+".tar.gz")
+	f, err := ioutil.TempFile(b.config.Dir, ".backup")
+	if err != nil {
+		return "", err
+	}
+	err = b.server.Snapshot(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return name, b.prune()
+}
+
+func (b *BackupScheduler) prune() error {
+	files, err := ioutil.ReadDir(b.config.Dir)
+	if err != nil {
+		return err
+	}
+	backups := []string{}
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), "skvs-") && strings.HasSuffix(file.Name(), ".tar.gz") {
+			backups = append(backups, file.Name())
+		}
+	}
+	sort.Strings(backups)
+	for len(backups) > b.config.Keep {
+		if err = os.Remove(filepath.Join(b.config.Dir, backups[0])); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// serveSnapshot answers POST /_/admin/snapshot with a snapshot archive.
+// Secret keys are only part of it given reveal=true.
+func (s *Server) serveSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeResponse(w, ResponseData{StatusCode: http.StatusMethodNotAllowed, Key: r.URL.Path[1:], Error: "Only POST is allowed."})
+		return
+	}
+	files, err := s.collectSnapshot(s.revealedTo(r))
+	if err != nil {
+		writeResponse(w, errorResponse(r.URL.Path[1:], err, http.StatusInternalServerError))
+		return
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"skvs-"+time.Now().UTC().Format("20060102-150405")+".tar.gz\"")
+	if err = writeSnapshot(w, files); err != nil {
+		logger().Warn("Sending snapshot failed", Fields{"error": err})
+	}
+}
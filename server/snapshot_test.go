@@ -0,0 +1,178 @@
+package server
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshotAndRestore(t *testing.T) {
+	cleanData()
+	s := NewServer(testDataPath, nil, nil)
+	assert.Equal(t, http.StatusOK, sendRequest(s.ServeHTTP, "PUT", "a/b", url.Values{"value": {"1"}}))
+	assert.Equal(t, http.StatusOK, sendRequest(s.ServeHTTP, "POST", "q", url.Values{"op": {"push"}, "value": {"x"}}))
+	assert.Equal(t, http.StatusOK, sendRequest(s.ServeHTTP, "PUT", "_/schemas/a", url.Values{"rule": {`{"type":"int"}`}}))
+	assert.Nil(t, ioutil.WriteFile(s.systemPath("replication.json"), []byte("{}"), 0644))
+
+	s.SetReadOnly(true)
+	req, _ := http.NewRequest("POST", "http://localhost/_/admin/snapshot", nil)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/gzip", w.Header().Get("Content-Type"))
+
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	archivePath := filepath.Join(dir, "snapshot.tar.gz")
+	assert.Nil(t, ioutil.WriteFile(archivePath, w.Body.Bytes(), 0644))
+	manifest, err := VerifySnapshot(archivePath)
+	assert.Nil(t, err)
+	assert.Contains(t, manifest.Files, "a/b")
+	assert.Contains(t, manifest.Files, "q/0000000001")
+	assert.Contains(t, manifest.Files, "_/system/schemas.json")
+	assert.Contains(t, manifest.Files, "_/system/sequences/q/.last")
+	assert.NotContains(t, manifest.Files, "_/system/replication.json")
+
+	dataPath := filepath.Join(dir, "data")
+	assert.Nil(t, putKey(filepath.Join(dataPath, "old"), false, "x"))
+	assert.Nil(t, RestoreSnapshot(archivePath, dataPath))
+	content, err := ioutil.ReadFile(filepath.Join(dataPath, "a/b"))
+	assert.Nil(t, err)
+	assert.Equal(t, "1", string(content))
+	_, err = os.Stat(filepath.Join(dataPath, "old"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dataPath+".before-restore", "old"))
+	assert.Nil(t, err)
+
+	restored := NewServer(dataPath, nil, nil)
+	assert.Equal(t, http.StatusUnprocessableEntity, sendRequest(restored.ServeHTTP, "PUT", "a/c", url.Values{"value": {"x"}}))
+	assert.Equal(t, http.StatusOK, sendRequest(restored.ServeHTTP, "POST", "q", url.Values{"op": {"push"}, "value": {"y"}}))
+	_, err = os.Stat(filepath.Join(dataPath, "q/0000000002"))
+	assert.Nil(t, err)
+}
+
+func TestRestoreChecksIntegrity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	dataPath := filepath.Join(dir, "data")
+	assert.Nil(t, putKey(filepath.Join(dataPath, "a"), false, "1"))
+
+	// a file that does not match the manifest
+	archivePath := filepath.Join(dir, "damaged.tar.gz")
+	f, err := os.Create(archivePath)
+	assert.Nil(t, err)
+	gz := gzip.NewWriter(f)
+	archive := tar.NewWriter(gz)
+	assert.Nil(t, writeSnapshotEntry(archive, snapshotFile{name: "a", content: []byte("2")}))
+	assert.Nil(t, writeSnapshotEntry(archive, snapshotFile{name: snapshotManifestName, content: []byte(`{"files":{"a":"00"}}`)}))
+	archive.Close()
+	gz.Close()
+	f.Close()
+	assert.NotNil(t, RestoreSnapshot(archivePath, dataPath))
+
+	// a truncated snapshot
+	s := NewServer(dataPath, nil, nil)
+	f, err = os.Create(archivePath)
+	assert.Nil(t, err)
+	assert.Nil(t, s.Snapshot(f))
+	info, _ := f.Stat()
+	f.Truncate(info.Size() / 2)
+	f.Close()
+	_, err = VerifySnapshot(archivePath)
+	assert.NotNil(t, err)
+	assert.NotNil(t, RestoreSnapshot(archivePath, dataPath))
+
+	content, err := ioutil.ReadFile(filepath.Join(dataPath, "a"))
+	assert.Nil(t, err)
+	assert.Equal(t, "1", string(content))
+}
+
+func TestSnapshotWaitsForChanges(t *testing.T) {
+	cleanData()
+	s := NewServer(testDataPath, nil, nil)
+	done := s.changing()
+	collected := make(chan []snapshotFile)
+	go func() {
+		files, _ := s.collectSnapshot(nil)
+		collected <- files
+	}()
+
+	// readers are not blocked while the snapshot waits
+	time.Sleep(20 * time.Millisecond)
+	_, err := readKey(filepath.Join(testDataPath, "missing"), false)
+	assert.True(t, os.IsNotExist(err))
+	select {
+	case <-collected:
+		t.Fatal("snapshot taken during a change")
+	default:
+	}
+	assert.Nil(t, putKey(filepath.Join(testDataPath, "a"), false, "1"))
+	done()
+	files := <-collected
+	assert.Equal(t, 1, len(files))
+}
+
+func TestScheduledBackups(t *testing.T) {
+	cleanData()
+	s := NewServer(testDataPath, nil, nil)
+	assert.Equal(t, http.StatusOK, sendRequest(s.ServeHTTP, "PUT", "a", url.Values{"value": {"1"}}))
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = s.ScheduleBackups(BackupConfig{Dir: dir, Interval: time.Second})
+	assert.NotNil(t, err)
+	backups, err := s.ScheduleBackups(BackupConfig{Dir: dir, Interval: 10 * time.Millisecond, Keep: 2})
+	assert.Nil(t, err)
+	count := func() int {
+		files, _ := filepath.Glob(filepath.Join(dir, "skvs-*.tar.gz"))
+		return len(files)
+	}
+	waitFor(t, func() bool { return count() == 2 })
+	time.Sleep(50 * time.Millisecond)
+	backups.Stop()
+	assert.Equal(t, 2, count())
+
+	name, err := backups.Backup()
+	assert.Nil(t, err)
+	_, err = VerifySnapshot(name)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count())
+}
+
+func TestSnapshotLeavesOutSecrets(t *testing.T) {
+	cleanData()
+	s := NewServer(testDataPath, nil, nil)
+	assert.Nil(t, s.MarkSecret("secrets"))
+	assert.Equal(t, http.StatusOK, sendRequest(s.ServeHTTP, "PUT", "secrets/db", url.Values{"value": {"hunter2"}}))
+	assert.Equal(t, http.StatusOK, sendRequest(s.ServeHTTP, "PUT", "a", url.Values{"value": {"1"}}))
+
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	snapshot := func(vals url.Values) SnapshotManifest {
+		w := sendAs(s, "", "POST", "_/admin/snapshot", vals)
+		assert.Equal(t, http.StatusOK, w.Code)
+		archivePath := filepath.Join(dir, "snapshot.tar.gz")
+		assert.Nil(t, ioutil.WriteFile(archivePath, w.Body.Bytes(), 0644))
+		manifest, err := VerifySnapshot(archivePath)
+		assert.Nil(t, err)
+		return manifest
+	}
+	manifest := snapshot(url.Values{})
+	assert.Contains(t, manifest.Files, "a")
+	assert.Contains(t, manifest.Files, "_/system/secrets.json")
+	assert.NotContains(t, manifest.Files, "secrets/db")
+	assert.Contains(t, snapshot(url.Values{"reveal": {"true"}}).Files, "secrets/db")
+}
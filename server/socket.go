@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+const peerContextKey contextKey = 1
+
+// PeerCredentials identify the process on the other end of a unix socket
+type PeerCredentials struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+// ListenUnix listens on a unix socket at path with the given permissions,
+// replacing a socket left over by a previous run
+func ListenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// ConnContext records the peer credentials of unix socket connections for
+// the requests sent over them, use it as http.Server.ConnContext
+func ConnContext(ctx context.Context, conn net.Conn) context.Context {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+	credentials, err := peerCredentials(unixConn)
+	if err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, peerContextKey, credentials)
+}
+
+// Peer returns the credentials of the process that sent r over a unix
+// socket
+func Peer(r *http.Request) (PeerCredentials, bool) {
+	credentials, ok := r.Context().Value(peerContextKey).(*PeerCredentials)
+	if !ok {
+		return PeerCredentials{}, false
+	}
+	return *credentials, true
+}
+
+// peerPrincipal names unix socket peers by their user id
+func peerPrincipal(r *http.Request) (string, bool) {
+	credentials, ok := Peer(r)
+	if !ok {
+		return "", false
+	}
+	return "uid:" + strconv.FormatUint(uint64(credentials.UID), 10), true
+}
+
+// callerNames returns the names ACL rules can refer to the caller by: its
+// principal and, for unix socket peers, 'uid:<uid>' and 'gid:<gid>'
+func callerNames(r *http.Request) []string {
+	names := []string{Principal(r)}
+	if credentials, ok := Peer(r); ok {
+		names = append(names,
+			"uid:"+strconv.FormatUint(uint64(credentials.UID), 10),
+			"gid:"+strconv.FormatUint(uint64(credentials.GID), 10))
+	}
+	return names
+}
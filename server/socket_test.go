@@ -0,0 +1,74 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSocketPeerCredentials(t *testing.T) {
+	cleanData()
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "skvs.sock")
+	// a stale socket from a previous run is replaced
+	stale, err := net.Listen("unix", socketPath)
+	assert.Nil(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := ListenUnix(socketPath, 0600)
+	assert.Nil(t, err)
+	defer listener.Close()
+	info, err := os.Stat(socketPath)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	uid := "uid:" + strconv.Itoa(os.Getuid())
+	gid := "gid:" + strconv.Itoa(os.Getgid())
+	s := NewServer(testDataPath, nil, nil)
+	s.EnforceACL(&ACL{rules: []ACLRule{
+		{Principal: uid, Prefix: "_/whoami", Permissions: []string{"read"}},
+		{Principal: gid, Prefix: "shared", Permissions: []string{"read", "write"}},
+	}})
+	var principal string
+	var peer PeerCredentials
+	s.HandleSystem("whoami", func(w http.ResponseWriter, r *http.Request) {
+		principal = Principal(r)
+		peer, _ = Peer(r)
+	})
+	go (&http.Server{Handler: s, ConnContext: ConnContext}).Serve(listener)
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return net.Dial("unix", socketPath)
+		},
+	}}
+	resp, err := client.Get("http://skvs/_/whoami")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, uid, principal)
+	assert.Equal(t, uint32(os.Getuid()), peer.UID)
+	assert.Equal(t, int32(os.Getpid()), peer.PID)
+
+	resp, err = client.PostForm("http://skvs/shared/key", map[string][]string{"value": {"a"}})
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, err = client.PostForm("http://skvs/private/key", map[string][]string{"value": {"a"}})
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
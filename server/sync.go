@@ -0,0 +1,531 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Conflict policies of a sync
+const (
+	// SyncPolicyNewest keeps the value modified last
+	SyncPolicyNewest = "newest"
+	// SyncPolicyLocal keeps the local value
+	SyncPolicyLocal = "local"
+	// SyncPolicyRemote keeps the remote value
+	SyncPolicyRemote = "remote"
+)
+
+// SyncConfig configures the anti-entropy sync with a remote server
+type SyncConfig struct {
+	// Remote is the URL of the other server
+	Remote string
+	// Token authenticates the sync at the remote
+	Token string
+	// Client sends the requests to the remote, http.DefaultClient if nil
+	Client *http.Client
+	// Prefixes are the namespaces or keys kept in sync, all keys if empty
+	Prefixes []string
+	// Policy decides conflicts, SyncPolicyNewest if empty
+	Policy string
+	// Interval between runs, if zero runs only happen on request
+	Interval time.Duration
+}
+
+// SyncDigest is a node of the Merkle tree of the keys. The hash of a value
+// is the HMAC-SHA256 of its content with the sync key, the hash of a
+// namespace covers the names and hashes of its children. Keys that do not
+// exist and empty namespaces have an empty hash.
+type SyncDigest struct {
+	Key       string       `json:"key"`
+	Hash      string       `json:"hash"`
+	Namespace bool         `json:"namespace"`
+	Modified  *time.Time   `json:"modified,omitempty"`
+	Children  []SyncDigest `json:"children,omitempty"`
+}
+
+// SyncConflict is a key that had different values on both sides. Winner is
+// 'local' or 'remote', or empty if the conflict could not be resolved.
+type SyncConflict struct {
+	Key    string `json:"key"`
+	Winner string `json:"winner,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// SyncReport describes a sync run. Compared is the number of namespaces
+// whose digests were exchanged, Pulled and Pushed are the keys copied from
+// and to the remote.
+type SyncReport struct {
+	Remote    string         `json:"remote"`
+	Policy    string         `json:"policy"`
+	Prefixes  []string       `json:"prefixes"`
+	Started   time.Time      `json:"started"`
+	Duration  float64        `json:"durationSeconds"`
+	Compared  int            `json:"compared"`
+	Pulled    []string       `json:"pulled"`
+	Pushed    []string       `json:"pushed"`
+	Conflicts []SyncConflict `json:"conflicts"`
+	Errors    []string       `json:"errors"`
+}
+
+// Syncer brings the keys below the configured prefixes in line with a
+// remote server. Keys missing on one side are copied, keys differing on
+// both are decided by the policy. Deletions are not synced.
+type Syncer struct {
+	server *Server
+	config SyncConfig
+	stop   chan struct{}
+	done   chan struct{}
+
+	running sync.Mutex
+	mutex   sync.Mutex
+	last    *SyncReport
+}
+
+// SetSyncKey sets the key digests hash values with, so they cannot be
+// matched against guessed values. Both sides of a sync need the same key,
+// without one no digests are served.
+func (s *Server) SetSyncKey(key []byte) {
+	s.syncKey = key
+}
+
+// StartSync syncs the server with config.Remote every config.Interval and
+// on POST /_/sync/run. Followers and cluster members cannot sync, as the
+// sync changes keys locally.
+func (s *Server) StartSync(config SyncConfig) (*Syncer, error) {
+	if s.follower != nil || s.cluster != nil {
+		return nil, errors.New("followers and cluster members cannot sync")
+	}
+	if len(s.syncKey) == 0 {
+		return nil, errors.New("a sync key is required")
+	}
+	switch config.Policy {
+	case "":
+		config.Policy = SyncPolicyNewest
+	case SyncPolicyNewest, SyncPolicyLocal, SyncPolicyRemote:
+	default:
+		return nil, fmt.Errorf("unknown sync policy '%s'", config.Policy)
+	}
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+	if len(config.Prefixes) == 0 {
+		config.Prefixes = []string{""}
+	}
+	for i, prefix := range config.Prefixes {
+		config.Prefixes[i] = strings.Trim(prefix, "/")
+	}
+
+	syncer := &Syncer{server: s, config: config, stop: make(chan struct{}), done: make(chan struct{})}
+	s.syncer = syncer
+	go syncer.schedule()
+	return syncer, nil
+}
+
+// Stop ends the scheduled runs
+func (syncer *Syncer) Stop() {
+	close(syncer.stop)
+	<-syncer.done
+}
+
+// Report returns the report of the last run, false if there was none
+func (syncer *Syncer) Report() (SyncReport, bool) {
+	syncer.mutex.Lock()
+	defer syncer.mutex.Unlock()
+	if syncer.last == nil {
+		return SyncReport{}, false
+	}
+	return *syncer.last, true
+}
+
+func (syncer *Syncer) schedule() {
+	defer close(syncer.done)
+	if syncer.config.Interval <= 0 {
+		<-syncer.stop
+		return
+	}
+	ticker := time.NewTicker(syncer.config.Interval)
+	defer ticker.Stop()
+	for {
+		report := syncer.Run()
+		if len(report.Errors) > 0 {
+			logger().Warn("Syncing failed", Fields{"remote": syncer.config.Remote, "error": report.Errors[0]})
+		}
+		select {
+		case <-syncer.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Run syncs all prefixes once. Runs do not overlap, a run requested during
+// another one waits for it. While the server is read-only nothing is
+// synced.
+func (syncer *Syncer) Run() SyncReport {
+	syncer.running.Lock()
+	defer syncer.running.Unlock()
+
+	run := &syncRun{syncer: syncer, report: SyncReport{
+		Remote:    syncer.config.Remote,
+		Policy:    syncer.config.Policy,
+		Prefixes:  syncer.config.Prefixes,
+		Started:   time.Now(),
+		Pulled:    []string{},
+		Pushed:    []string{},
+		Conflicts: []SyncConflict{},
+		Errors:    []string{},
+	}}
+	if syncer.server.ReadOnly() {
+		run.report.Errors = append(run.report.Errors, errReadOnly.Error())
+	} else {
+		for _, prefix := range syncer.config.Prefixes {
+			run.sync(prefix)
+		}
+	}
+	run.report.Duration = time.Since(run.report.Started).Seconds()
+
+	syncer.mutex.Lock()
+	syncer.last = &run.report
+	syncer.mutex.Unlock()
+	return run.report
+}
+
+type syncRun struct {
+	syncer *Syncer
+	report SyncReport
+}
+
+func (run *syncRun) fail(key string, err error) {
+	run.report.Errors = append(run.report.Errors, fmt.Sprintf("'%s': %s", key, err))
+}
+
+// sync compares key on both sides, descending into the namespaces whose
+// hashes differ
+func (run *syncRun) sync(key string) {
+	local, err := run.syncer.server.digest(key, true, nil)
+	if err != nil {
+		run.fail(key, err)
+		return
+	}
+	remote, err := run.remoteDigest(key)
+	if err != nil {
+		run.fail(key, err)
+		return
+	}
+	run.report.Compared++
+	run.merge(key, local, remote, true)
+}
+
+// merge reconciles key given its digests on both sides. Namespaces are
+// merged child by child, which needs the digests of their children.
+func (run *syncRun) merge(key string, local, remote SyncDigest, withChildren bool) {
+	switch {
+	case local.Hash == remote.Hash:
+	case local.Hash != "" && remote.Hash != "" && local.Namespace != remote.Namespace:
+		run.report.Conflicts = append(run.report.Conflicts, SyncConflict{Key: key, Reason: "a namespace on one side and a value on the other"})
+	case !local.Namespace && !remote.Namespace:
+		run.resolve(key, local, remote)
+	case !withChildren:
+		run.sync(key)
+	default:
+		children := map[string][2]SyncDigest{}
+		for _, child := range local.Children {
+			pair := children[child.Key]
+			pair[0] = child
+			children[child.Key] = pair
+		}
+		for _, child := range remote.Children {
+			pair := children[child.Key]
+			pair[1] = child
+			children[child.Key] = pair
+		}
+		keys := []string{}
+		for childKey := range children {
+			keys = append(keys, childKey)
+		}
+		sort.Strings(keys)
+		for _, childKey := range keys {
+			if !strings.HasPrefix(childKey, strings.TrimPrefix(key+"/", "/")) || !validKey.MatchString(childKey) || isReservedKey(childKey) {
+				run.fail(childKey, errors.New("invalid key in digest"))
+				continue
+			}
+			run.merge(childKey, children[childKey][0], children[childKey][1], false)
+		}
+	}
+}
+
+// resolve copies a value missing on one side or decides a conflict
+func (run *syncRun) resolve(key string, local, remote SyncDigest) {
+	pull := local.Hash == ""
+	if local.Hash != "" && remote.Hash != "" {
+		conflict := SyncConflict{Key: key}
+		switch run.syncer.config.Policy {
+		case SyncPolicyLocal:
+			conflict.Reason = "policy prefers local"
+		case SyncPolicyRemote:
+			pull, conflict.Reason = true, "policy prefers remote"
+		default:
+			localModified, remoteModified := modifiedTime(local), modifiedTime(remote)
+			switch {
+			case remoteModified.After(localModified):
+				pull, conflict.Reason = true, "remote modified last"
+			case localModified.After(remoteModified):
+				conflict.Reason = "local modified last"
+			default:
+				// both sides must pick the same value on a tie
+				pull, conflict.Reason = remote.Hash > local.Hash, "modified at the same time, higher hash"
+			}
+		}
+		if pull {
+			conflict.Winner = "remote"
+		} else {
+			conflict.Winner = "local"
+		}
+		run.report.Conflicts = append(run.report.Conflicts, conflict)
+	}
+
+	var err error
+	if pull {
+		if err = run.pull(key); err == nil {
+			run.report.Pulled = append(run.report.Pulled, key)
+		}
+	} else {
+		if err = run.push(key); err == nil {
+			run.report.Pushed = append(run.report.Pushed, key)
+		}
+	}
+	if err != nil {
+		run.fail(key, err)
+	}
+}
+
+func modifiedTime(digest SyncDigest) time.Time {
+	if digest.Modified == nil {
+		return time.Time{}
+	}
+	return *digest.Modified
+}
+
+// pull sets the local key to the remote value, secret values are revealed
+func (run *syncRun) pull(key string) error {
+	var data ResponseData
+	if err := run.request("GET", key+"?reveal=true", nil, &data); err != nil {
+		return err
+	}
+	if data.IsNamespace {
+		return errors.New("became a namespace on the remote")
+	}
+	if data.Redacted {
+		return errors.New("the remote redacted the secret value")
+	}
+	s := run.syncer.server
+	if err := s.validate(key, data.Value); err != nil {
+		return err
+	}
+	defer s.changing()()
+	keyPath := filepath.Join(s.dataPath, key)
+	unlock := lockPath(keyPath)
+	oldHash := s.auditHashLocked(key, keyPath)
+	err := putKeyLocked(keyPath, isExemptFromCache(key, s.cacheExemptionList), data.Value)
+	unlock()
+	if err != nil {
+		return err
+	}
+	s.audit(nil, AuditEntry{Key: key, Action: "IMPORT", Principal: "sync:" + run.syncer.config.Remote, OldHash: oldHash, NewHash: hashValue(data.Value)})
+	s.notifyChange(nil, key, "PUT")
+	return nil
+}
+
+// push sets the remote key to the local value
+func (run *syncRun) push(key string) error {
+	s := run.syncer.server
+	entry, err := readKey(filepath.Join(s.dataPath, key), isExemptFromCache(key, s.cacheExemptionList))
+	if err != nil {
+		return err
+	}
+	if entry.isNamespace {
+		return errors.New("became a namespace locally")
+	}
+	return run.request("PUT", key, url.Values{"value": {entry.data[0]}}, nil)
+}
+
+func (run *syncRun) remoteDigest(key string) (SyncDigest, error) {
+	var digest SyncDigest
+	err := run.request("GET", strings.TrimSuffix(reservedPrefix+"sync/digest/"+key, "/")+"?reveal=true", nil, &digest)
+	return digest, err
+}
+
+// request sends a request for path to the remote and decodes the response
+// into result
+func (run *syncRun) request(method, path string, form url.Values, result interface{}) error {
+	requestURL := strings.TrimSuffix(run.syncer.config.Remote, "/") + "/" + path
+	var req *http.Request
+	var err error
+	if form != nil {
+		req, err = http.NewRequest(method, requestURL, strings.NewReader(form.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	} else {
+		req, err = http.NewRequest(method, requestURL, nil)
+	}
+	if err != nil {
+		return err
+	}
+	if run.syncer.config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+run.syncer.config.Token)
+	}
+	resp, err := run.syncer.config.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: remote responded with %s", method, path, resp.Status)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// digest returns the Merkle tree node of key, with the nodes of its
+// children if withChildren. Keys and namespaces not passing include are
+// left out, nil includes all.
+func (s *Server) digest(key string, withChildren bool, include func(key string, namespace bool) bool) (SyncDigest, error) {
+	keyPath := filepath.Join(s.dataPath, key)
+	info, err := os.Stat(keyPath)
+	if os.IsNotExist(err) {
+		return SyncDigest{Key: key}, nil
+	}
+	if err != nil {
+		return SyncDigest{Key: key}, err
+	}
+	if include != nil && !include(key, info.IsDir()) {
+		return SyncDigest{Key: key}, nil
+	}
+
+	if !info.IsDir() {
+		entry, err := readKey(keyPath, isExemptFromCache(key, s.cacheExemptionList))
+		if err != nil || entry.isNamespace {
+			return SyncDigest{Key: key}, err
+		}
+		mac := hmac.New(sha256.New, s.syncKey)
+		mac.Write([]byte(entry.data[0]))
+		modified := info.ModTime().UTC()
+		return SyncDigest{Key: key, Hash: hex.EncodeToString(mac.Sum(nil)), Modified: &modified}, nil
+	}
+
+	files, err := ioutil.ReadDir(keyPath)
+	if err != nil {
+		return SyncDigest{Key: key}, err
+	}
+	digest := SyncDigest{Key: key, Namespace: true}
+	hash := sha256.New()
+	empty := true
+	for _, file := range files {
+		childKey := strings.TrimPrefix(key+"/"+file.Name(), "/")
+		if isReservedKey(childKey) {
+			continue
+		}
+		child, err := s.digest(childKey, false, include)
+		if err != nil {
+			return SyncDigest{Key: key}, err
+		}
+		if child.Hash == "" {
+			continue
+		}
+		empty = false
+		fmt.Fprintf(hash, "%s %t %s\n", file.Name(), child.Namespace, child.Hash)
+		if withChildren {
+			digest.Children = append(digest.Children, child)
+		}
+	}
+	if !empty {
+		digest.Hash = hex.EncodeToString(hash.Sum(nil))
+	}
+	return digest, nil
+}
+
+// digestedFor returns the filter of the keys in digests for the caller of r:
+// like in listings namespaces need to be visible, values need read and
+// secret values reveal
+func (s *Server) digestedFor(r *http.Request) func(key string, namespace bool) bool {
+	names := callerNames(r)
+	permitted := func(key string, namespace bool) bool {
+		if s.acl == nil || isCommand(r) {
+			return true
+		}
+		if namespace {
+			return s.acl.visible(names, key)
+		}
+		return s.acl.allowed(names, PermissionRead, key)
+	}
+	return func(key string, namespace bool) bool {
+		return permitted(key, namespace) && (namespace || s.mayReveal(r, key))
+	}
+}
+
+// serveSync handles /_/sync: GET /_/sync/digest/<key> returns the Merkle tree
+// node of key and its children the caller may see, POST /_/sync/run starts
+// a sync run and returns its report, GET /_/sync/report returns the last
+// report
+func (s *Server) serveSync(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/_/sync"), "/")
+	switch {
+	case path == "digest" || strings.HasPrefix(path, "digest/"):
+		if r.Method != "GET" {
+			writeResponse(w, ResponseData{StatusCode: http.StatusMethodNotAllowed, Key: r.URL.Path[1:], Error: "Only GET is allowed."})
+			return
+		}
+		key := strings.Trim(strings.TrimPrefix(path, "digest"), "/")
+		if key != "" && (!validKey.MatchString(key) || isReservedKey(key)) {
+			writeResponse(w, ResponseData{StatusCode: http.StatusBadRequest, Key: key, Error: "Invalid key."})
+			return
+		}
+		if len(s.syncKey) == 0 {
+			writeResponse(w, ResponseData{StatusCode: http.StatusNotFound, Key: r.URL.Path[1:], Error: "No sync key is configured."})
+			return
+		}
+		digest, err := s.digest(key, true, s.digestedFor(r))
+		if err != nil {
+			writeResponse(w, errorResponse(key, err, http.StatusInternalServerError))
+			return
+		}
+		writeJSON(w, http.StatusOK, digest)
+	case path == "run" || path == "report":
+		if s.syncer == nil {
+			writeResponse(w, ResponseData{StatusCode: http.StatusNotFound, Key: r.URL.Path[1:], Error: "No sync is configured."})
+			return
+		}
+		if path == "run" && r.Method == "POST" {
+			writeJSON(w, http.StatusOK, s.syncer.Run())
+			return
+		}
+		if path == "report" && r.Method == "GET" {
+			report, ok := s.syncer.Report()
+			if !ok {
+				writeResponse(w, ResponseData{StatusCode: http.StatusNotFound, Key: r.URL.Path[1:], Error: "No sync has run yet."})
+				return
+			}
+			writeJSON(w, http.StatusOK, report)
+			return
+		}
+		writeResponse(w, ResponseData{StatusCode: http.StatusMethodNotAllowed, Key: r.URL.Path[1:], Error: "Method not allowed."})
+	default:
+		writeResponse(w, ResponseData{StatusCode: http.StatusNotFound, Key: r.URL.Path[1:], Error: "Unknown sync path."})
+	}
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type syncSide struct {
+	path   string
+	server *Server
+}
+
+func newSyncSide(t *testing.T) *syncSide {
+	path, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	side := &syncSide{path: path, server: NewServer(path, nil, nil)}
+	side.server.SetSyncKey([]byte("shared"))
+	return side
+}
+
+func (side *syncSide) put(t *testing.T, key, value string, modified time.Time) {
+	assert.Nil(t, putKey(filepath.Join(side.path, key), false, value))
+	assert.Nil(t, os.Chtimes(filepath.Join(side.path, key), modified, modified))
+}
+
+func (side *syncSide) value(key string) string {
+	entry, err := readKey(filepath.Join(side.path, key), false)
+	if err != nil || entry.isNamespace {
+		return ""
+	}
+	return entry.data[0]
+}
+
+func TestSync(t *testing.T) {
+	local, remote := newSyncSide(t), newSyncSide(t)
+	defer os.RemoveAll(local.path)
+	defer os.RemoveAll(remote.path)
+	srv := httptest.NewServer(remote.server)
+	defer srv.Close()
+
+	earlier, later := time.Now().Add(-time.Hour), time.Now().Add(-time.Minute)
+	local.put(t, "config/a", "1", earlier)
+	local.put(t, "config/b", "local", earlier)
+	local.put(t, "config/d/e", "local", later)
+	local.put(t, "config/n/m", "x", earlier)
+	remote.put(t, "config/b", "remote", later)
+	remote.put(t, "config/c", "3", earlier)
+	remote.put(t, "config/d/e", "remote", earlier)
+	remote.put(t, "config/n", "x", earlier)
+	remote.put(t, "other", "x", earlier)
+
+	syncer, err := local.server.StartSync(SyncConfig{Remote: srv.URL, Prefixes: []string{"/config/"}})
+	assert.Nil(t, err)
+	defer syncer.Stop()
+	_, ok := syncer.Report()
+	assert.False(t, ok)
+
+	report := syncer.Run()
+	assert.Equal(t, []string{"config/b", "config/c"}, report.Pulled)
+	assert.Equal(t, []string{"config/a", "config/d/e"}, report.Pushed)
+	assert.Equal(t, []SyncConflict{
+		{Key: "config/b", Winner: "remote", Reason: "remote modified last"},
+		{Key: "config/d/e", Winner: "local", Reason: "local modified last"},
+		{Key: "config/n", Reason: "a namespace on one side and a value on the other"},
+	}, report.Conflicts)
+	assert.Empty(t, report.Errors)
+	assert.Equal(t, "remote", local.value("config/b"))
+	assert.Equal(t, "3", local.value("config/c"))
+	assert.Equal(t, "1", remote.value("config/a"))
+	assert.Equal(t, "local", remote.value("config/d/e"))
+	assert.Equal(t, "", local.value("other"))
+
+	// only the conflict is left, unchanged namespaces are not descended into
+	report = syncer.Run()
+	assert.Empty(t, report.Pulled)
+	assert.Empty(t, report.Pushed)
+	assert.Equal(t, 1, len(report.Conflicts))
+	assert.Equal(t, 1, report.Compared)
+
+	req, _ := http.NewRequest("GET", "http://localhost/_/sync/report", nil)
+	w := httptest.NewRecorder()
+	local.server.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var last SyncReport
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &last))
+	assert.Equal(t, report.Started.Unix(), last.Started.Unix())
+}
+
+func TestSyncPolicy(t *testing.T) {
+	local, remote := newSyncSide(t), newSyncSide(t)
+	defer os.RemoveAll(local.path)
+	defer os.RemoveAll(remote.path)
+	srv := httptest.NewServer(remote.server)
+	defer srv.Close()
+
+	local.put(t, "a", "local", time.Now().Add(-time.Hour))
+	remote.put(t, "a", "remote", time.Now())
+	syncer, err := local.server.StartSync(SyncConfig{Remote: srv.URL, Policy: SyncPolicyLocal})
+	assert.Nil(t, err)
+	defer syncer.Stop()
+
+	req, _ := http.NewRequest("POST", "http://localhost/_/sync/run", nil)
+	w := httptest.NewRecorder()
+	local.server.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var report SyncReport
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.Equal(t, []string{"a"}, report.Pushed)
+	assert.Equal(t, "local", remote.value("a"))
+
+	_, err = local.server.StartSync(SyncConfig{Remote: srv.URL, Policy: "random"})
+	assert.NotNil(t, err)
+}
+
+func TestSyncDigest(t *testing.T) {
+	side := newSyncSide(t)
+	defer os.RemoveAll(side.path)
+	side.put(t, "a/b", "1", time.Now())
+	side.put(t, "a/c/d", "2", time.Now())
+
+	digest, err := side.server.digest("a", true, nil)
+	assert.Nil(t, err)
+	assert.True(t, digest.Namespace)
+	assert.Equal(t, 2, len(digest.Children))
+	assert.Equal(t, "a/b", digest.Children[0].Key)
+	assert.NotNil(t, digest.Children[0].Modified)
+	assert.Nil(t, digest.Children[1].Children)
+
+	// the hash of a namespace changes with any key below it
+	side.put(t, "a/c/d", "3", time.Now())
+	changed, err := side.server.digest("a", true, nil)
+	assert.Nil(t, err)
+	assert.NotEqual(t, digest.Hash, changed.Hash)
+	assert.Equal(t, digest.Children[0].Hash, changed.Children[0].Hash)
+
+	missing, err := side.server.digest("missing", true, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "", missing.Hash)
+
+	// values are hashed with the sync key, not plain SHA-256
+	plain := sha256.Sum256([]byte("1"))
+	assert.NotEqual(t, hex.EncodeToString(plain[:]), digest.Children[0].Hash)
+	side.server.SetSyncKey([]byte("other"))
+	rekeyed, err := side.server.digest("a", true, nil)
+	assert.Nil(t, err)
+	assert.NotEqual(t, changed.Children[0].Hash, rekeyed.Children[0].Hash)
+
+	side.server.SetSyncKey(nil)
+	assert.Equal(t, http.StatusNotFound, sendRequest(side.server.ServeHTTP, "GET", "_/sync/digest/a", nil))
+	_, err = side.server.StartSync(SyncConfig{Remote: "http://localhost"})
+	assert.NotNil(t, err)
+}
+
+func TestSyncDigestFollowsACL(t *testing.T) {
+	side := newSyncSide(t)
+	defer os.RemoveAll(side.path)
+	side.put(t, "a/public", "1", time.Now())
+	side.put(t, "a/private/b", "2", time.Now())
+	side.server.EnforceACL(&ACL{rules: []ACLRule{
+		{Principal: "sync", Prefix: "a", Permissions: []string{"list"}},
+		{Principal: "sync", Prefix: "a/public", Permissions: []string{"read"}},
+		{Principal: "admin", Prefix: "", Permissions: []string{"read"}},
+	}})
+
+	digest := func(principal string) SyncDigest {
+		w := sendAs(side.server, principal, "GET", "_/sync/digest/a", nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		var digest SyncDigest
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &digest))
+		return digest
+	}
+	// like in listings, only the children the caller may see are covered
+	partial := digest("sync")
+	assert.Equal(t, 1, len(partial.Children))
+	assert.Equal(t, "a/public", partial.Children[0].Key)
+	full := digest("admin")
+	assert.Equal(t, 2, len(full.Children))
+	assert.NotEqual(t, full.Hash, partial.Hash)
+
+	assert.Equal(t, http.StatusForbidden, sendAs(side.server, "other", "GET", "_/sync/digest/a", nil).Code)
+	assert.Equal(t, http.StatusForbidden, sendAs(side.server, "sync", "GET", "_/sync/digest/b", nil).Code)
+}
+
+func TestSyncDigestLeavesOutSecrets(t *testing.T) {
+	side := newSyncSide(t)
+	defer os.RemoveAll(side.path)
+	assert.Nil(t, side.server.MarkSecret("a/secret"))
+	side.put(t, "a/b", "1", time.Now())
+	side.put(t, "a/secret", "hunter2", time.Now())
+
+	digest := func(vals url.Values) SyncDigest {
+		w := sendAs(side.server, "", "GET", "_/sync/digest/a", vals)
+		assert.Equal(t, http.StatusOK, w.Code)
+		var digest SyncDigest
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &digest))
+		return digest
+	}
+	withheld := digest(nil)
+	assert.Equal(t, 1, len(withheld.Children))
+	assert.Equal(t, "a/b", withheld.Children[0].Key)
+	revealed := digest(url.Values{"reveal": {"true"}})
+	assert.Equal(t, 2, len(revealed.Children))
+	assert.NotEqual(t, withheld.Hash, revealed.Hash)
+}
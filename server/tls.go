@@ -0,0 +1,81 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+// CertificateStore serves a certificate and key pair that can be reloaded
+// from disk while the server is running
+type CertificateStore struct {
+	certFile string
+	keyFile  string
+	mutex    sync.RWMutex
+	cert     *tls.Certificate
+}
+
+// LoadCertificateStore reads the PEM encoded certificate and key
+func LoadCertificateStore(certFile, keyFile string) (*CertificateStore, error) {
+	store := &CertificateStore{certFile: certFile, keyFile: keyFile}
+	return store, store.Reload()
+}
+
+// Reload reads the certificate again, on failure the previous one is kept
+func (store *CertificateStore) Reload() error {
+	cert, err := tls.LoadX509KeyPair(store.certFile, store.keyFile)
+	if err != nil {
+		return err
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.cert = &cert
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (store *CertificateStore) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	return store.cert, nil
+}
+
+// TLSConfig returns a server configuration using the store's certificate.
+// With a clientCAFile client certificates signed by those CAs are verified,
+// requireClientCert rejects connections without one.
+func (store *CertificateStore) TLSConfig(clientCAFile string, requireClientCert bool) (*tls.Config, error) {
+	config := &tls.Config{GetCertificate: store.GetCertificate}
+	if clientCAFile == "" {
+		return config, nil
+	}
+
+	pem, err := ioutil.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	config.ClientCAs = x509.NewCertPool()
+	if !config.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found in " + clientCAFile)
+	}
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	if requireClientCert {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// certificatePrincipal returns the principal named by a verified client
+// certificate: its common name, or the whole subject if it has none
+func certificatePrincipal(r *http.Request) (string, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", false
+	}
+	subject := r.TLS.VerifiedChains[0][0].Subject
+	if subject.CommonName != "" {
+		return subject.CommonName, true
+	}
+	return subject.String(), true
+}
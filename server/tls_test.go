@@ -0,0 +1,136 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testCertificate struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+// issueCertificate writes a certificate for name signed by parent, or a
+// self-signed CA if parent is nil
+func issueCertificate(t *testing.T, dir, name string, parent *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+
+	result := &testCertificate{
+		cert:     cert,
+		key:      key,
+		certFile: filepath.Join(dir, name+".crt"),
+		keyFile:  filepath.Join(dir, name+".key"),
+	}
+	assert.Nil(t, ioutil.WriteFile(result.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.Nil(t, ioutil.WriteFile(result.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return result
+}
+
+func TestCertificateStoreReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	first := issueCertificate(t, dir, "server", nil)
+
+	store, err := LoadCertificateStore(first.certFile, first.keyFile)
+	assert.Nil(t, err)
+	cert, _ := store.GetCertificate(nil)
+	assert.Equal(t, first.cert.Raw, cert.Certificate[0])
+
+	second := issueCertificate(t, dir, "server", nil)
+	assert.Nil(t, store.Reload())
+	cert, _ = store.GetCertificate(nil)
+	assert.Equal(t, second.cert.Raw, cert.Certificate[0])
+
+	// a broken key keeps the previous certificate
+	assert.Nil(t, ioutil.WriteFile(second.keyFile, []byte("broken"), 0600))
+	assert.NotNil(t, store.Reload())
+	cert, _ = store.GetCertificate(nil)
+	assert.Equal(t, second.cert.Raw, cert.Certificate[0])
+}
+
+func TestClientCertificatePrincipal(t *testing.T) {
+	cleanData()
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	ca := issueCertificate(t, dir, "ca", nil)
+	serverCert := issueCertificate(t, dir, "server", ca)
+	clientCert := issueCertificate(t, dir, "billing", ca)
+	otherCert := issueCertificate(t, dir, "billing", issueCertificate(t, dir, "other-ca", nil))
+
+	store, err := LoadCertificateStore(serverCert.certFile, serverCert.keyFile)
+	assert.Nil(t, err)
+	config, err := store.TLSConfig(ca.certFile, true)
+	assert.Nil(t, err)
+
+	s := NewServer(testDataPath, nil, nil)
+	var principal string
+	s.HandleSystem("whoami", func(w http.ResponseWriter, r *http.Request) {
+		principal = Principal(r)
+	})
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	assert.Nil(t, err)
+	defer listener.Close()
+	go http.Serve(listener, s)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	get := func(cert *testCertificate) error {
+		clientConfig := &tls.Config{RootCAs: roots}
+		if cert != nil {
+			clientConfig.Certificates = []tls.Certificate{{Certificate: [][]byte{cert.cert.Raw}, PrivateKey: cert.key}}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+		resp, err := client.Get("https://" + listener.Addr().String() + "/_/whoami")
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	assert.NotNil(t, get(nil))
+	assert.NotNil(t, get(otherCert))
+	assert.Nil(t, get(clientCert))
+	assert.Equal(t, "billing", principal)
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// changes made by SKVS itself are reported by the file system watcher as
+// well. The state of every path SKVS changed is remembered for this long so
+// that no duplicate web hook calls are made for them.
+const ownChangeWindow = 2 * time.Second
+
+// ownChange is the state of a path after SKVS changed it
+type ownChange struct {
+	done chan struct{}
+	info os.FileInfo // nil if the path was removed
+	at   time.Time
+}
+
+var ownChanges = make(map[string]*ownChange)
+var ownChangesMutex sync.Mutex
+
+// Watcher keeps the cache coherent with changes made to the data directory
+// by other processes
+type Watcher struct {
+	dataPath    string
+	webHookURLs []string
+	done        chan struct{}
+	closeOnce   sync.Once
+	platformWatcher
+}
+
+// WatchDataPath starts watching dataPath for changes made outside of SKVS.
+// Affected cache entries are invalidated and the change is published
+// through the given web hooks and the event stream.
+func WatchDataPath(dataPath string, webHookURLs []string) (*Watcher, error) {
+	w := &Watcher{dataPath: dataPath, webHookURLs: webHookURLs, done: make(chan struct{})}
+	if err := w.start(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Close stops the watcher
+func (w *Watcher) Close() error {
+	var err error
+	w.closeOnce.Do(func() {
+		close(w.done)
+		err = w.stop()
+	})
+	return err
+}
+
+// handleChange is called by the platform specific watcher for every path
+// that was created, modified or removed
+func (w *Watcher) handleChange(path, action string) {
+	invalidateCache(path)
+
+	if isOwnChange(path) {
+		return
+	}
+
+	key, err := filepath.Rel(w.dataPath, path)
+	key = filepath.ToSlash(key)
+	if err != nil || key == "." || strings.HasPrefix(key, "..") || !validKey.MatchString(key) || isReservedKey(key) {
+		return
+	}
+	callHooks(key, action, "", w.webHookURLs)
+	publishChange(w.dataPath, key, action)
+}
+
+// handleOverflow is called when events were lost and the state of the cache
+// can no longer be trusted
+func (w *Watcher) handleOverflow() {
+	flushCache()
+}
+
+// markOwnChange remembers that SKVS itself is about to change paths, the
+// returned function records their state once the change is made
+func markOwnChange(paths ...string) func() {
+	changes := make([]*ownChange, len(paths))
+	now := time.Now()
+
+	ownChangesMutex.Lock()
+	for path, change := range ownChanges {
+		select {
+		case <-change.done:
+			if now.Sub(change.at) > ownChangeWindow {
+				delete(ownChanges, path)
+			}
+		default:
+		}
+	}
+	for i, path := range paths {
+		changes[i] = &ownChange{done: make(chan struct{})}
+		ownChanges[path] = changes[i]
+	}
+	ownChangesMutex.Unlock()
+
+	return func() {
+		for i, path := range paths {
+			changes[i].info, _ = os.Lstat(path)
+			changes[i].at = time.Now()
+			close(changes[i].done)
+		}
+	}
+}
+
+// isOwnChange reports whether path is still in the state SKVS left it in.
+// An external change made afterwards is not mistaken for an own one.
+func isOwnChange(path string) bool {
+	ownChangesMutex.Lock()
+	change, ok := ownChanges[path]
+	ownChangesMutex.Unlock()
+	if !ok {
+		return false
+	}
+
+	select {
+	case <-change.done:
+	case <-time.After(ownChangeWindow):
+		return false
+	}
+	current, err := os.Lstat(path)
+	if change.info == nil || err != nil {
+		return change.info == nil && os.IsNotExist(err)
+	}
+	if !os.SameFile(change.info, current) {
+		return false
+	}
+	// the modification time of a namespace changes with its children
+	return current.IsDir() || (current.ModTime().Equal(change.info.ModTime()) && current.Size() == change.info.Size())
+}
+
+// markOwnRemoval is markOwnChange for path and everything below it
+func markOwnRemoval(path string) func() {
+	var paths []string
+	filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		paths = append(paths, p)
+		return nil
+	})
+	return markOwnChange(paths...)
+}
+
+// makeDirs creates dir and its missing parents as an own change
+func makeDirs(dir string) error {
+	var missing []string
+	for d := dir; d != filepath.Dir(d); d = filepath.Dir(d) {
+		if _, err := os.Lstat(d); !os.IsNotExist(err) {
+			break
+		}
+		missing = append(missing, d)
+	}
+	defer markOwnChange(missing...)()
+	return os.MkdirAll(dir, os.ModePerm)
+}
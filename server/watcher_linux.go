@@ -0,0 +1,141 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const inotifyMask = syscall.IN_CLOSE_WRITE | syscall.IN_CREATE | syscall.IN_DELETE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+// platformWatcher reads events from inotify. The raw fd is kept for adding
+// watches, calling Fd() would make reads blocking, so that closing the file
+// no longer ends run.
+type platformWatcher struct {
+	inotify   *os.File
+	inotifyFd int
+	watches   map[int32]string
+	stopped   chan struct{}
+}
+
+func (w *Watcher) start() error {
+	if err := os.MkdirAll(w.dataPath, os.ModePerm); err != nil {
+		return err
+	}
+
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return os.NewSyscallError("inotify_init1", err)
+	}
+	w.inotify, w.inotifyFd = os.NewFile(uintptr(fd), "inotify"), fd
+	w.watches = make(map[int32]string)
+	w.stopped = make(chan struct{})
+
+	if err = w.addWatches(w.dataPath, false); err != nil {
+		w.inotify.Close()
+		return err
+	}
+
+	go w.run()
+	return nil
+}
+
+// stop closes inotify and waits for run to end
+func (w *Watcher) stop() error {
+	err := w.inotify.Close()
+	<-w.stopped
+	return err
+}
+
+// add watches for dir and all directories below it, if report is set
+// all files found are handled as new
+func (w *Watcher) addWatches(dir string, report bool) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// vanished while walking, there will be an event for it
+			return nil
+		}
+		if !info.IsDir() {
+			if report {
+				w.handleChange(path, "PUT")
+			}
+			return nil
+		}
+		wd, err := syscall.InotifyAddWatch(w.inotifyFd, path, inotifyMask)
+		if err != nil {
+			return os.NewSyscallError("inotify_add_watch", err)
+		}
+		w.watches[int32(wd)] = path
+		return nil
+	})
+}
+
+// remove the watches for dir and all directories below it
+func (w *Watcher) removeWatches(dir string) {
+	for wd, path := range w.watches {
+		if path == dir || strings.HasPrefix(path, dir+"/") {
+			syscall.InotifyRmWatch(w.inotifyFd, uint32(wd))
+			delete(w.watches, wd)
+		}
+	}
+}
+
+func (w *Watcher) run() {
+	defer close(w.stopped)
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := w.inotify.Read(buf)
+		if err != nil {
+			select {
+			case <-w.done:
+			default:
+				logger().Error("Watching failed", Fields{"path": w.dataPath, "error": err})
+			}
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			name := strings.TrimRight(string(buf[nameStart:nameStart+int(event.Len)]), "\x00")
+			offset = nameStart + int(event.Len)
+			w.handleEvent(event.Wd, event.Mask, name)
+		}
+	}
+}
+
+func (w *Watcher) handleEvent(wd int32, mask uint32, name string) {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		w.handleOverflow()
+		return
+	}
+
+	dir, ok := w.watches[wd]
+	if !ok {
+		return
+	}
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(w.watches, wd)
+		return
+	}
+
+	path := filepath.Join(dir, name)
+	isDir := mask&syscall.IN_ISDIR != 0
+	switch {
+	case isDir && mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0:
+		w.handleChange(path, "PUT")
+		if err := w.addWatches(path, true); err != nil {
+			logger().Warn("Watching failed", Fields{"path": path, "error": err})
+		}
+	case mask&(syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO) != 0:
+		w.handleChange(path, "PUT")
+	case mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0:
+		if isDir {
+			w.removeWatches(path)
+		}
+		w.handleChange(path, "DELETE")
+	}
+}
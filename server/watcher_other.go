@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import "errors"
+
+type platformWatcher struct{}
+
+func (w *Watcher) start() error {
+	return errors.New("watching the data path is only supported on linux")
+}
+
+func (w *Watcher) stop() error {
+	return nil
+}
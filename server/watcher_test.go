@@ -0,0 +1,170 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWatcherExternalWrite(t *testing.T) {
+	cleanData()
+	testPath := expandPath("foo/bar")
+	if err := putKey(testPath, false, "old"); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := WatchDataPath(testDataPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if err = ioutil.WriteFile(testPath, []byte("new"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, func() bool {
+		entry, err := readKey(testPath, false)
+		return err == nil && len(entry.data) == 1 && entry.data[0] == "new"
+	})
+}
+
+func TestWatcherExternalCreateInNewNamespace(t *testing.T) {
+	cleanData()
+	testPathParent := expandPath("foo")
+	if err := putKey(expandPath("foo/bar"), false, "foobar"); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := WatchDataPath(testDataPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	entry, err := readKey(testPathParent, false)
+	if err != nil || len(entry.data) != 1 {
+		t.Fatalf("Expected one child, got %+v (%v).", entry.data, err)
+	}
+
+	if err = os.MkdirAll(expandPath("foo/baz"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(expandPath("foo/baz/zero"), []byte("zero"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, func() bool {
+		entry, err := readKey(testPathParent, false)
+		return err == nil && len(entry.data) == 2
+	})
+	waitFor(t, func() bool {
+		entry, err := readKey(expandPath("foo/baz"), false)
+		return err == nil && len(entry.data) == 1
+	})
+}
+
+func TestWatcherExternalDelete(t *testing.T) {
+	cleanData()
+	testPath := expandPath("foo/bar")
+	if err := putKey(testPath, false, "foobar"); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := WatchDataPath(testDataPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if err = os.Remove(testPath); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, func() bool {
+		_, err := readKey(testPath, false)
+		return err != nil
+	})
+}
+
+func TestOwnChangeIsRecognized(t *testing.T) {
+	cleanData()
+	testPath := expandPath("foo/bar")
+	if err := putKey(testPath, false, "own"); err != nil {
+		t.Fatal(err)
+	}
+	if !isOwnChange(testPath) || !isOwnChange(expandPath("foo")) {
+		t.Error("Change should have been recognized as own change.")
+	}
+	if isOwnChange(expandPath("foobar")) {
+		t.Error("Change should not have been recognized as own change.")
+	}
+
+	// an external write right after the own one is no own change
+	if err := ioutil.WriteFile(testPath, []byte("external"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if isOwnChange(testPath) {
+		t.Error("External change should not have been recognized as own change.")
+	}
+
+	if err := deleteKey(expandPath("foo")); err != nil {
+		t.Fatal(err)
+	}
+	if !isOwnChange(testPath) || !isOwnChange(expandPath("foo")) {
+		t.Error("Removal should have been recognized as own change.")
+	}
+}
+
+func TestWatcherReportsExternalWriteAfterOwnWrite(t *testing.T) {
+	cleanData()
+	w, err := WatchDataPath(testDataPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	sub := subscribeChanges(testDataPath, "")
+	defer unsubscribeChanges(testDataPath, sub)
+
+	testPath := expandPath("foo")
+	if err = putKey(testPath, false, "own"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err = ioutil.WriteFile(testPath, []byte("external"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case event := <-sub.events:
+		if event.Key != "foo" || event.Action != "PUT" {
+			t.Errorf("Unexpected event %+v.", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("The external write was not reported.")
+	}
+}
+
+func TestWatcherCloseEndsReading(t *testing.T) {
+	cleanData()
+	w, err := WatchDataPath(testDataPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// let run block in reading
+	time.Sleep(50 * time.Millisecond)
+	closed := make(chan error)
+	go func() { closed <- w.Close() }()
+	select {
+	case err = <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close did not end the watcher.")
+	}
+}